@@ -0,0 +1,223 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+// statistics of aggregated windows
+const (
+	AggregateMin   = "min"
+	AggregateMax   = "max"
+	AggregateMean  = "mean"
+	AggregateLast  = "last"
+	AggregateCount = "count"
+)
+
+var aggregates = []string{AggregateMin, AggregateMax, AggregateMean, AggregateLast, AggregateCount}
+
+// how often windows without further readings are checked for being complete
+var aggregationTick = time.Second
+
+type aggregationRule struct {
+	filter     identFilter
+	window     time.Duration
+	statistics []string
+}
+
+// aggregationRules are checked in order, the first one matching a numeric measurement applies,
+// measurements not matched by any are sent as they are
+type aggregationRules []aggregationRule
+
+var _aggregationRules aggregationRules
+
+func selectAggregationRules(config map[string]string) aggregationRules {
+	rules, err := parseAggregationRules(config[Aggregation])
+	if err != nil {
+		printHelpAndExit(fmt.Sprintf("Illegal aggregation: %s\n", err))
+	}
+	return rules
+}
+
+// parseAggregationRules parses rules like "16.7.0 window=1m stats=min,max,mean; default window=15m stats=last"
+func parseAggregationRules(config string) (aggregationRules, error) {
+	rules, err := parseRules(config)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed := aggregationRules{}
+	for _, r := range rules {
+		rule := aggregationRule{filter: r.filter, statistics: aggregates}
+		for key, value := range r.options {
+			switch key {
+			case "window":
+				if rule.window, err = time.ParseDuration(value); err != nil || rule.window < time.Second {
+					return nil, fmt.Errorf("illegal window %s of rule %s, expected at least 1s", value, r.filter)
+				}
+			case "stats":
+				rule.statistics = strings.Split(value, ",")
+				for _, statistic := range rule.statistics {
+					if !slices.Contains(aggregates, statistic) {
+						return nil, fmt.Errorf("unknown statistic '%s' of rule %s, expected %s", statistic, r.filter, strings.Join(aggregates, ", "))
+					}
+				}
+			default:
+				return nil, fmt.Errorf("unknown option '%s' of rule %s, expected window or stats", key, r.filter)
+			}
+		}
+		if rule.window == 0 {
+			return nil, fmt.Errorf("missing window of rule %s", r.filter)
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
+
+func (r aggregationRules) ruleOf(measure *Measurement) *aggregationRule {
+	if measure.Type != NumberValue {
+		return nil
+	}
+	for i := range r {
+		if r[i].filter.matches(measure) {
+			return &r[i]
+		}
+	}
+	return nil
+}
+
+// window collects the readings of a measurement within one time window
+type window struct {
+	rule  *aggregationRule
+	start time.Time
+	// host time of the latest reading, windows are complete once no reading was received for their length
+	updated  time.Time
+	last     Measurement
+	min, max float64
+	sum      float64
+	count    int
+}
+
+// aggregator buckets readings per measurement into windows aligned to wall-clock boundaries
+type aggregator struct {
+	rules   aggregationRules
+	windows map[string]*window
+	// start of the latest window passed on per measurement, late readings of it or before are dropped
+	emitted map[string]time.Time
+	// hourly or daily windows start at the full hours or midnight of that time zone
+	location *time.Location
+}
+
+func newAggregator(rules aggregationRules) *aggregator {
+	return &aggregator{rules: rules, windows: map[string]*window{}, emitted: map[string]time.Time{}, location: time.Local}
+}
+
+// windowStart truncates to the window in local time, as Truncate aligns to UTC
+func (a *aggregator) windowStart(at time.Time, length time.Duration) time.Time {
+	_, offset := at.In(a.location).Zone()
+	shift := time.Duration(offset) * time.Second
+	return at.Add(shift).Truncate(length).Add(-shift)
+}
+
+// add collects the reading if aggregated, passing the statistics of the previous window on once a new one starts
+func (a *aggregator) add(measure Measurement, emit func(Measurement)) bool {
+	rule := a.rules.ruleOf(&measure)
+	if rule == nil {
+		return false
+	}
+
+	key := measure.key()
+	start := a.windowStart(measure.Time, rule.window)
+	if emitted, ok := a.emitted[key]; ok && !start.After(emitted) {
+		debug("Dropped late reading of an aggregated window", &measure)
+		return true
+	}
+	current, ok := a.windows[key]
+	if ok && start.Before(current.start) {
+		debug("Dropped reading of a window before the current one", &measure)
+		return true
+	}
+	if ok && !current.start.Equal(start) {
+		a.emit(key, current, emit)
+		ok = false
+	}
+	if !ok {
+		current = &window{rule: rule, start: start, min: math.Inf(1), max: math.Inf(-1)}
+		a.windows[key] = current
+	}
+
+	current.updated = time.Now()
+	current.last = measure
+	current.min = math.Min(current.min, measure.Value)
+	current.max = math.Max(current.max, measure.Value)
+	current.sum += measure.Value
+	current.count++
+	return true
+}
+
+// flushIdle passes the windows on that didn't receive readings for their length, e.g. as the meter stopped sending
+func (a *aggregator) flushIdle(emit func(Measurement)) {
+	for key, w := range a.windows {
+		if time.Since(w.updated) >= w.rule.window {
+			a.emit(key, w, emit)
+			delete(a.windows, key)
+		}
+	}
+}
+
+// flush passes all windows on, including incomplete ones
+func (a *aggregator) flush(emit func(Measurement)) {
+	for key, w := range a.windows {
+		a.emit(key, w, emit)
+		delete(a.windows, key)
+	}
+}
+
+func (a *aggregator) emit(key string, w *window, emit func(Measurement)) {
+	w.emit(emit)
+	a.emitted[key] = w.start
+}
+
+// emit passes a measurement per statistic on, stamped with the start of the window
+func (w *window) emit(emit func(Measurement)) {
+	for _, statistic := range w.rule.statistics {
+		measure := w.last
+		measure.Time = w.start
+		measure.Aggregate = statistic
+		switch statistic {
+		case AggregateMin:
+			measure.Value = w.min
+		case AggregateMax:
+			measure.Value = w.max
+		case AggregateMean:
+			measure.Value = w.sum / float64(w.count)
+		case AggregateCount:
+			measure.Value = float64(w.count)
+		}
+		if statistic != AggregateLast {
+			measure.Status, measure.HasStatus = 0, false
+		}
+		debug("Aggregated", &measure)
+		emit(measure)
+	}
+}
@@ -0,0 +1,207 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseAggregationRules(t *testing.T) {
+	// When
+	rules, err := parseAggregationRules("16.7.0 window=1m stats=min,max,mean; default window=15m stats=last")
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	power := rules.ruleOf(&Measurement{Ident: "16.7.0", Type: NumberValue})
+	if power == nil || power.window != time.Minute || !slices.Equal(power.statistics, []string{"min", "max", "mean"}) {
+		t.Errorf("Unexpected rule of 16.7.0: %+v", power)
+	}
+	other := rules.ruleOf(&Measurement{Ident: "1.8.0", Type: NumberValue})
+	if other == nil || other.window != 15*time.Minute || !slices.Equal(other.statistics, []string{"last"}) {
+		t.Errorf("Unexpected rule of 1.8.0: %+v", other)
+	}
+	if rules.ruleOf(&Measurement{Ident: "16.7.0", Type: StringValue}) != nil {
+		t.Error("Expected text values not to be aggregated")
+	}
+}
+
+func TestParseDefaultAggregationStatistics(t *testing.T) {
+	rules, err := parseAggregationRules("16.7.0 window=10s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(rules[0].statistics, aggregates) {
+		t.Errorf("Expected all statistics, got %v", rules[0].statistics)
+	}
+	if rules.ruleOf(&Measurement{Ident: "1.8.0", Type: NumberValue}) != nil {
+		t.Error("Expected measurements without rule not to be aggregated")
+	}
+}
+
+func TestParseInvalidAggregationRules(t *testing.T) {
+	for _, raw := range []string{"16.7.0", "16.7.0 window=100ms", "16.7.0 window=often", "16.7.0 window=1m stats=median", "16.7.0 window=1m size=3"} {
+		if _, err := parseAggregationRules(raw); err == nil {
+			t.Errorf("Expected '%s' to be invalid", raw)
+		}
+	}
+}
+
+func TestAggregateWindows(t *testing.T) {
+	// Given
+	rules, _ := parseAggregationRules("16.7.0 window=1m")
+	aggregator := newAggregator(rules)
+	start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	emitted := map[string]Measurement{}
+	emit := func(m Measurement) {
+		emitted[m.Aggregate] = m
+	}
+	reading := func(offset time.Duration, value float64) Measurement {
+		return Measurement{Ident: "16.7.0", Unit: "W", Type: NumberValue, Value: value, Time: start.Add(offset), Status: 4, HasStatus: true}
+	}
+
+	// When
+	for i, value := range []float64{300, 100, 500, 200} {
+		if !aggregator.add(reading(time.Duration(i*15)*time.Second, value), emit) {
+			t.Fatal("Expected reading to be aggregated")
+		}
+	}
+
+	// Then
+	if len(emitted) != 0 {
+		t.Fatalf("Expected window to be open, got %v", emitted)
+	}
+
+	// When
+	aggregator.add(reading(time.Minute, 1000), emit)
+
+	// Then
+	expected := map[string]float64{"min": 100, "max": 500, "mean": 275, "last": 200, "count": 4}
+	for statistic, value := range expected {
+		m, ok := emitted[statistic]
+		if !ok || m.Value != value || !m.Time.Equal(start) || m.Ident != "16.7.0" || m.Unit != "W" {
+			t.Errorf("Expected %s %f at %s, got %+v", statistic, value, start, m)
+		}
+	}
+	if !emitted["last"].HasStatus || emitted["mean"].HasStatus {
+		t.Error("Expected status of last reading only")
+	}
+}
+
+func TestAggregateAlignedToWallClock(t *testing.T) {
+	// Given
+	rules, _ := parseAggregationRules("16.7.0 window=15m stats=count")
+	aggregator := newAggregator(rules)
+	var emitted []Measurement
+	emit := func(m Measurement) {
+		emitted = append(emitted, m)
+	}
+	at := time.Date(2025, 3, 1, 12, 14, 59, 0, time.UTC)
+
+	// When
+	aggregator.add(Measurement{Ident: "16.7.0", Type: NumberValue, Time: at}, emit)
+	aggregator.add(Measurement{Ident: "16.7.0", Type: NumberValue, Time: at.Add(time.Second)}, emit)
+	aggregator.flush(emit)
+
+	// Then
+	if len(emitted) != 2 || !emitted[0].Time.Equal(at.Truncate(time.Hour)) || !emitted[1].Time.Equal(at.Add(time.Second)) {
+		t.Errorf("Expected windows at 12:00 and 12:15, got %+v", emitted)
+	}
+}
+
+func TestAggregateAlignedToLocalTime(t *testing.T) {
+	// Given
+	rules, _ := parseAggregationRules("16.7.0 window=1h stats=count; 1.8.0 window=24h stats=last")
+	aggregator := newAggregator(rules)
+	var emitted []Measurement
+	emit := func(m Measurement) {
+		emitted = append(emitted, m)
+	}
+	at := time.Date(2025, 3, 1, 12, 40, 0, 0, time.UTC)
+
+	// When
+	aggregator.location = time.FixedZone("IST", 5*3600+1800)
+	aggregator.add(Measurement{Ident: "16.7.0", Type: NumberValue, Time: at}, emit)
+	aggregator.flush(emit)
+	aggregator.location = time.FixedZone("CET", 3600)
+	aggregator.add(Measurement{Ident: "1.8.0", Type: NumberValue, Time: at}, emit)
+	aggregator.flush(emit)
+
+	// Then
+	hour := time.Date(2025, 3, 1, 12, 30, 0, 0, time.UTC)
+	day := time.Date(2025, 2, 28, 23, 0, 0, 0, time.UTC)
+	if len(emitted) != 2 || !emitted[0].Time.Equal(hour) || !emitted[1].Time.Equal(day) {
+		t.Errorf("Expected windows at 18:00 IST and midnight CET, got %+v", emitted)
+	}
+}
+
+func TestAggregateDropsLateReadings(t *testing.T) {
+	// Given
+	rules, _ := parseAggregationRules("16.7.0 window=1m stats=count")
+	aggregator := newAggregator(rules)
+	var emitted []Measurement
+	emit := func(m Measurement) {
+		emitted = append(emitted, m)
+	}
+	start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	reading := func(offset time.Duration) Measurement {
+		return Measurement{Ident: "16.7.0", Type: NumberValue, Time: start.Add(offset)}
+	}
+	aggregator.add(reading(10*time.Second), emit)
+	aggregator.flush(emit)
+
+	// When
+	if !aggregator.add(reading(50*time.Second), emit) {
+		t.Fatal("Expected late reading to be consumed")
+	}
+	aggregator.add(reading(70*time.Second), emit)
+	aggregator.add(reading(55*time.Second), emit)
+	aggregator.flush(emit)
+
+	// Then
+	if len(emitted) != 2 || !emitted[0].Time.Equal(start) || !emitted[1].Time.Equal(start.Add(time.Minute)) || emitted[1].Value != 1 {
+		t.Errorf("Expected a single window at 12:00 and 12:01 each, got %+v", emitted)
+	}
+}
+
+func TestFlushIdleWindows(t *testing.T) {
+	// Given
+	rules, _ := parseAggregationRules("16.7.0 window=1s stats=last; 1.8.0 window=1h stats=last")
+	aggregator := newAggregator(rules)
+	var emitted []Measurement
+	emit := func(m Measurement) {
+		emitted = append(emitted, m)
+	}
+	aggregator.add(Measurement{Ident: "16.7.0", Type: NumberValue, Time: time.Now()}, emit)
+	aggregator.add(Measurement{Ident: "1.8.0", Type: NumberValue, Time: time.Now()}, emit)
+
+	// When
+	time.Sleep(time.Second)
+	aggregator.flushIdle(emit)
+
+	// Then
+	if len(emitted) != 1 || emitted[0].Ident != "16.7.0" {
+		t.Errorf("Expected idle window of 16.7.0 only, got %+v", emitted)
+	}
+	if len(aggregator.windows) != 1 {
+		t.Errorf("Expected window of 1.8.0 to be kept, got %d", len(aggregator.windows))
+	}
+}
@@ -0,0 +1,397 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	diskqueue "github.com/nsqio/go-diskqueue"
+)
+
+// Backend stores measurements, like a database
+type Backend interface {
+	// Name identifies the backend in logs and its disk queue
+	Name() string
+	// Init connects the backend, sending retries it if failed
+	Init() error
+	// Send stores the measurement, false if it failed and should be retried later on
+	Send(measurement Measurement) bool
+	// SendBatch stores all measurements or none of them
+	SendBatch(measurements []Measurement) bool
+	// Healthy tells whether the latest sending succeeded
+	Healthy() bool
+	Close()
+}
+
+// SenderFunc adapts a plain send function as backend, sending batches one by one
+type SenderFunc func(measurement Measurement) bool
+
+func (f SenderFunc) Name() string {
+	return "sender"
+}
+
+func (f SenderFunc) Init() error {
+	return nil
+}
+
+func (f SenderFunc) Send(measurement Measurement) bool {
+	return f(measurement)
+}
+
+func (f SenderFunc) SendBatch(measurements []Measurement) bool {
+	for _, measurement := range measurements {
+		if !f(measurement) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f SenderFunc) Healthy() bool {
+	return true
+}
+
+func (f SenderFunc) Close() {}
+
+// how long sending to a failed backend pauses, its measurements are cached on disk meanwhile
+var circuitBreakDuration = 30 * time.Second
+
+// how long the drain waits for the next cached measurement to fill a batch
+var drainGap = 100 * time.Millisecond
+
+// how long a backend may take to store a batch before it's considered failed
+var sendTimeout = 20 * time.Second
+
+// how many live measurements wait for a backend before further ones are cached on disk
+var liveBuffer = 1000
+
+// batching limits how many measurements are sent at once, and how long live measurements are collected for a batch
+type batching struct {
+	size    int
+	latency time.Duration
+}
+
+var _batching = batching{size: 1000}
+
+func selectBatching(config map[string]string) batching {
+	size, err := strconv.Atoi(config[BatchSize])
+	if err != nil || size < 1 {
+		printHelpAndExit(fmt.Sprintf("Illegal batch size %s, expected a positive number\n", config[BatchSize]))
+	}
+	latency, err := time.ParseDuration(config[BatchLatency])
+	if err != nil || latency < 0 {
+		printHelpAndExit(fmt.Sprintf("Illegal batch latency %s\n", config[BatchLatency]))
+	}
+	return batching{size: size, latency: latency}
+}
+
+// backendQueue sends to a single backend, caching what couldn't be sent in its own disk queue,
+// so one backend being offline doesn't affect the others
+type backendQueue struct {
+	backend     Backend
+	diskQueue   diskqueue.Interface
+	circuitOpen atomic.Bool
+	batching    batching
+	journal     *batchJournal
+	// live measurements waiting to be sent, so a slow backend doesn't hold up the others
+	live      chan Measurement
+	collected chan struct{}
+	stopping  chan struct{}
+	drained   chan struct{}
+}
+
+// name of the disk queue and batch journal of versions supporting a single backend only
+const legacyQueue = "cached"
+
+// adoptLegacyQueue renames the disk queue of versions supporting a single backend only to the queue of the backend,
+// if there's a single one configured, it's kept for being sent once configured like that again otherwise
+func adoptLegacyQueue(backends []Backend, cacheLocation string) {
+	legacy, _ := filepath.Glob(filepath.Join(cacheLocation, legacyQueue+".diskqueue.*.dat"))
+	if _, err := os.Stat(filepath.Join(cacheLocation, legacyQueue+".pending")); err == nil {
+		legacy = append(legacy, filepath.Join(cacheLocation, legacyQueue+".pending"))
+	}
+	if len(legacy) == 0 {
+		return
+	}
+	if len(backends) != 1 {
+		log.Printf("Keeping the cache of a single backend in %s, to be sent once the backend it was written for is configured alone\n", cacheLocation)
+		return
+	}
+
+	renamed := make([]string, len(legacy))
+	for i, path := range legacy {
+		renamed[i] = filepath.Join(cacheLocation, queueName(backends[0])+strings.TrimPrefix(filepath.Base(path), legacyQueue))
+		if _, err := os.Stat(renamed[i]); err == nil {
+			log.Printf("Keeping the cache of a single backend in %s, as %s has a cache already\n", cacheLocation, backends[0].Name())
+			return
+		}
+	}
+	for i, path := range legacy {
+		if err := os.Rename(path, renamed[i]); err != nil {
+			log.Fatal("Could not adopt the cache ", err)
+		}
+	}
+	log.Printf("Adopted the cache of a single backend for %s\n", backends[0].Name())
+}
+
+func queueName(backend Backend) string {
+	return legacyQueue + "-" + backend.Name()
+}
+
+// newBackendQueue opens the disk queue of the backend
+func newBackendQueue(backend Backend, cacheLocation string) *backendQueue {
+	name := queueName(backend)
+	q := &backendQueue{
+		backend:   backend,
+		diskQueue: diskqueue.New(name, cacheLocation, 10485760, 4, 1<<10, 4096, 10*time.Second, dqLog),
+		batching:  _batching,
+		journal:   openBatchJournal(filepath.Join(cacheLocation, name+".pending")),
+		stopping:  make(chan struct{}),
+		drained:   make(chan struct{}),
+	}
+	q.live = make(chan Measurement, liveBuffer)
+	q.collected = make(chan struct{})
+	go q.drain()
+	go q.collect()
+	return q
+}
+
+// send passes the batch to the backend, opening the circuit if it failed
+func (q *backendQueue) send(batch []Measurement) bool {
+	success := q.backend.SendBatch(batch)
+	if !success {
+		q.openCircuit()
+	}
+	return success
+}
+
+func (q *backendQueue) openCircuit() {
+	if q.circuitOpen.Swap(true) {
+		return
+	}
+	log.Printf("Circuit of %s open", q.backend.Name())
+	go func() {
+		time.Sleep(circuitBreakDuration)
+		q.circuitOpen.Store(false)
+		log.Printf("Circuit of %s closed", q.backend.Name())
+	}()
+}
+
+// forward passes the measurement to be sent without blocking, it's cached on disk if the backend falls behind
+func (q *backendQueue) forward(measure Measurement) {
+	select {
+	case q.live <- measure:
+	default:
+		q.writeToDisk(measure)
+	}
+}
+
+// forwardBatch sends the measurements, or caches them on disk if the backend is failing
+func (q *backendQueue) forwardBatch(batch []Measurement) {
+	if q.circuitOpen.Load() || !q.send(batch) {
+		for _, measure := range batch {
+			q.writeToDisk(measure)
+		}
+	}
+}
+
+// collect sends the live measurements right away, or if batching is configured,
+// once a batch is full or its first one waited for the latency
+func (q *backendQueue) collect() {
+	defer close(q.collected)
+	if q.batching.latency <= 0 || q.batching.size <= 1 {
+		for measure := range q.live {
+			q.forwardBatch([]Measurement{measure})
+		}
+		return
+	}
+
+	batch := []Measurement{}
+	timer := time.NewTimer(q.batching.latency)
+	timer.Stop()
+	for {
+		select {
+		case measure, open := <-q.live:
+			if !open {
+				if len(batch) > 0 {
+					q.forwardBatch(batch)
+				}
+				return
+			}
+			if len(batch) == 0 {
+				timer.Reset(q.batching.latency)
+			}
+			batch = append(batch, measure)
+			if len(batch) >= q.batching.size {
+				timer.Stop()
+				q.forwardBatch(batch)
+				batch = []Measurement{}
+			}
+		case <-timer.C:
+			q.forwardBatch(batch)
+			batch = []Measurement{}
+		}
+	}
+}
+
+func (q *backendQueue) writeToDisk(measure Measurement) {
+	debug("Writing to disk", &measure)
+	if jsonData, err := json.Marshal(measure); err == nil {
+		q.diskQueue.Put(jsonData)
+	} else {
+		log.Fatal("Could not serialize measure", err)
+	}
+}
+
+// drain sends the measurements cached on disk in batches as soon as the backend is available,
+// a batch is retried until it's sent and kept in the journal meanwhile, so it's sent first after a restart
+func (q *backendQueue) drain() {
+	defer close(q.drained)
+	peekChan := q.diskQueue.PeekChan()
+	readChan := q.diskQueue.ReadChan()
+	pending := q.journal.load()
+
+	take := func(message []byte) {
+		var measure Measurement
+		if err := json.Unmarshal(message, &measure); err != nil {
+			log.Fatal("Failed to deserialize msg", err)
+		}
+		debug("Read from disk", &measure)
+		// journaled before it's removed from the disk queue
+		q.journal.add(message)
+		<-readChan
+		pending = append(pending, measure)
+	}
+
+	for {
+		if q.circuitOpen.Load() {
+			select {
+			case <-time.After(circuitBreakDuration):
+			case <-q.stopping:
+				return
+			}
+		}
+
+		if len(pending) == 0 {
+			select {
+			case message := <-peekChan:
+				take(message)
+			case <-q.stopping:
+				return
+			}
+		available:
+			for len(pending) < q.batching.size && q.diskQueue.Depth() > 0 {
+				select {
+				case message := <-peekChan:
+					take(message)
+				case <-time.After(drainGap):
+					break available
+				}
+			}
+			q.journal.sync()
+		}
+
+		if q.send(pending) {
+			q.journal.ack()
+			pending = []Measurement{}
+		}
+	}
+}
+
+// close sends the collected live measurements and closes the backend, a pending batch remains in the journal
+func (q *backendQueue) close() {
+	close(q.live)
+	<-q.collected
+	close(q.stopping)
+	<-q.drained
+	if depth := q.diskQueue.Depth(); depth > 0 {
+		log.Printf("%d measurements remain cached for %s (healthy: %t)\n", depth, q.backend.Name(), q.backend.Healthy())
+	}
+	q.diskQueue.Close()
+	q.journal.close()
+	q.backend.Close()
+}
+
+// batchJournal keeps the batch taken from the disk queue until the backend acknowledged it,
+// so it's neither lost nor reordered if samler is stopped or killed before
+type batchJournal struct {
+	file *os.File
+}
+
+func openBatchJournal(path string) *batchJournal {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatal("Could not open batch journal ", err)
+	}
+	return &batchJournal{file: file}
+}
+
+// load returns the batch not acknowledged before
+func (j *batchJournal) load() []Measurement {
+	pending := []Measurement{}
+	scanner := bufio.NewScanner(j.file)
+	scanner.Buffer(make([]byte, 4096), 1<<20)
+	for scanner.Scan() {
+		var measure Measurement
+		if err := json.Unmarshal(scanner.Bytes(), &measure); err != nil {
+			// the last line may be cut off, its measurement is still in the disk queue
+			log.Printf("Skipping unreadable journal entry of %s: %s\n", j.file.Name(), err)
+			continue
+		}
+		pending = append(pending, measure)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal("Could not read batch journal ", err)
+	}
+	if len(pending) > 0 {
+		log.Printf("Resending %d measurements of %s\n", len(pending), j.file.Name())
+	}
+	return pending
+}
+
+func (j *batchJournal) add(message []byte) {
+	if _, err := j.file.Write(append(message, '\n')); err != nil {
+		log.Fatal("Could not write batch journal ", err)
+	}
+}
+
+// sync persists the batch before it's sent, even on power loss
+func (j *batchJournal) sync() {
+	if err := j.file.Sync(); err != nil {
+		log.Printf("Failed to sync %s: %s\n", j.file.Name(), err)
+	}
+}
+
+func (j *batchJournal) ack() {
+	if err := j.file.Truncate(0); err != nil {
+		log.Fatal("Could not clear batch journal ", err)
+	}
+}
+
+func (j *batchJournal) close() {
+	j.file.Close()
+}
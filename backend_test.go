@@ -0,0 +1,364 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	diskqueue "github.com/nsqio/go-diskqueue"
+)
+
+// testBackend records what it received, failing while offline
+type testBackend struct {
+	name     string
+	mutex    sync.Mutex
+	offline  bool
+	received []Measurement
+	closed   bool
+}
+
+func (b *testBackend) Name() string { return b.name }
+func (b *testBackend) Init() error  { return nil }
+
+func (b *testBackend) Send(measurement Measurement) bool {
+	return b.SendBatch([]Measurement{measurement})
+}
+
+func (b *testBackend) SendBatch(measurements []Measurement) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.offline {
+		return false
+	}
+	b.received = append(b.received, measurements...)
+	return true
+}
+
+func (b *testBackend) Healthy() bool { return !b.offline }
+func (b *testBackend) Close()        { b.closed = true }
+
+func (b *testBackend) setOffline(offline bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.offline = offline
+}
+
+func (b *testBackend) count() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.received)
+}
+
+func TestFanOutToBackends(t *testing.T) {
+	// Given
+	previous := circuitBreakDuration
+	defer func() { circuitBreakDuration = previous }()
+	circuitBreakDuration = 100 * time.Millisecond
+
+	online := &testBackend{name: "online"}
+	offline := &testBackend{name: "offline", offline: true}
+	messages := make(chan Measurement)
+	stop := RunSamler(messages, []Backend{online, offline}, tempDir(), nil)
+
+	// When
+	for i := range 3 {
+		messages <- Measurement{Device: "fan-out", Ident: "1.8.0", Value: float64(i), Time: time.Now()}
+	}
+
+	// Then
+	deadline := time.Now().Add(5 * time.Second)
+	for online.count() < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if online.count() != 3 || offline.count() != 0 {
+		t.Fatalf("Expected 3 sent to online backend only, got %d and %d", online.count(), offline.count())
+	}
+
+	// When
+	offline.setOffline(false)
+	deadline = time.Now().Add(5 * time.Second)
+	for offline.count() < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+
+	// Then
+	if offline.count() != 3 || online.count() != 3 {
+		t.Errorf("Expected cached measurements sent once to the recovered backend, got %d and %d", online.count(), offline.count())
+	}
+	for i, m := range offline.received {
+		if m.Value != float64(i) {
+			t.Errorf("Expected cached measurements in order, got %f at %d", m.Value, i)
+		}
+	}
+	if !online.closed || !offline.closed {
+		t.Error("Expected backends to be closed")
+	}
+}
+
+// stuckBackend doesn't respond until released, like a blackholed server
+type stuckBackend struct {
+	testBackend
+	release chan struct{}
+}
+
+func (b *stuckBackend) Send(measurement Measurement) bool {
+	return b.SendBatch([]Measurement{measurement})
+}
+
+func (b *stuckBackend) SendBatch(measurements []Measurement) bool {
+	<-b.release
+	return b.testBackend.SendBatch(measurements)
+}
+
+func TestStuckBackendDoesntBlockOthers(t *testing.T) {
+	// Given
+	previous := liveBuffer
+	defer func() { liveBuffer = previous }()
+	liveBuffer = 2
+
+	online := &testBackend{name: "online"}
+	stuck := &stuckBackend{testBackend: testBackend{name: "stuck"}, release: make(chan struct{})}
+	messages := make(chan Measurement)
+	stop := RunSamler(messages, []Backend{online, stuck}, tempDir(), nil)
+
+	// When
+	for i := range 10 {
+		messages <- Measurement{Device: "stuck", Ident: "1.8.0", Value: float64(i), Time: time.Now()}
+	}
+
+	// Then
+	deadline := time.Now().Add(time.Second)
+	for online.count() < 10 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if online.count() != 10 || stuck.count() != 0 {
+		t.Fatalf("Expected 10 sent to online backend only, got %d and %d", online.count(), stuck.count())
+	}
+
+	// When
+	close(stuck.release)
+	deadline = time.Now().Add(5 * time.Second)
+	for stuck.count() < 10 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+
+	// Then
+	if stuck.count() != 10 {
+		t.Errorf("Expected measurements exceeding the buffer to be cached and sent later, got %d", stuck.count())
+	}
+}
+
+func TestSenderFuncBatch(t *testing.T) {
+	// Given
+	sent := 0
+	backend := SenderFunc(func(m Measurement) bool {
+		sent++
+		return m.Value >= 0
+	})
+
+	// When && Then
+	if !backend.SendBatch([]Measurement{{Value: 1}, {Value: 2}}) || sent != 2 {
+		t.Errorf("Expected batch to be sent, got %d", sent)
+	}
+	if backend.SendBatch([]Measurement{{Value: -1}, {Value: 2}}) || sent != 3 {
+		t.Errorf("Expected batch to stop at first failure, got %d", sent)
+	}
+}
+
+// batchRecorder records the size of each batch sent, failing while offline
+type batchRecorder struct {
+	testBackend
+	batches []int
+}
+
+func (b *batchRecorder) SendBatch(measurements []Measurement) bool {
+	if !b.testBackend.SendBatch(measurements) {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.batches = append(b.batches, len(measurements))
+	return true
+}
+
+func (b *batchRecorder) Send(measurement Measurement) bool {
+	return b.SendBatch([]Measurement{measurement})
+}
+
+func TestDrainInBatches(t *testing.T) {
+	// Given
+	previousBatching, previousBreak := _batching, circuitBreakDuration
+	defer func() { _batching, circuitBreakDuration = previousBatching, previousBreak }()
+	_batching = batching{size: 20}
+	circuitBreakDuration = 200 * time.Millisecond
+
+	backend := &batchRecorder{testBackend: testBackend{name: "batches", offline: true}}
+	queue := newBackendQueue(backend, tempDir())
+
+	// When
+	for i := range 50 {
+		queue.forward(Measurement{Ident: "1.8.0", Value: float64(i)})
+	}
+	// live measurements are cached once the first one failed
+	deadline := time.Now().Add(5 * time.Second)
+	for (len(queue.live) > 0 || !queue.circuitOpen.Load()) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	backend.setOffline(false)
+	deadline = time.Now().Add(5 * time.Second)
+	for backend.count() < 50 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	queue.close()
+
+	// Then
+	if backend.count() != 50 {
+		t.Fatalf("Expected 50 measurements drained, got %d", backend.count())
+	}
+	// the first one failing opened the circuit
+	if len(backend.batches) > 5 {
+		t.Errorf("Expected a few batches, got %v", backend.batches)
+	}
+	for _, size := range backend.batches {
+		if size > 20 {
+			t.Errorf("Expected batches of at most 20, got %v", backend.batches)
+		}
+	}
+}
+
+func TestPendingBatchKeepsOrderOnRestart(t *testing.T) {
+	// Given
+	previousBatching, previousBreak := _batching, circuitBreakDuration
+	defer func() { _batching, circuitBreakDuration = previousBatching, previousBreak }()
+	_batching = batching{size: 20}
+	circuitBreakDuration = 100 * time.Millisecond
+	cache := tempDir()
+
+	offline := &testBackend{name: "restart", offline: true}
+	queue := newBackendQueue(offline, cache)
+	for i := range 30 {
+		queue.forward(Measurement{Ident: "1.8.0", Value: float64(i)})
+	}
+	// the drain took a batch from the disk queue, failing to send it
+	time.Sleep(300 * time.Millisecond)
+	queue.close()
+	if journal, err := os.ReadFile(filepath.Join(cache, "cached-restart.pending")); err != nil || len(journal) == 0 {
+		t.Fatalf("Expected the pending batch to be journaled, got %q (%v)", journal, err)
+	}
+
+	// When
+	online := &testBackend{name: "restart"}
+	queue = newBackendQueue(online, cache)
+	deadline := time.Now().Add(5 * time.Second)
+	for online.count() < 30 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	queue.close()
+
+	// Then
+	if online.count() != 30 {
+		t.Fatalf("Expected 30 measurements after restart, got %d", online.count())
+	}
+	for i, measure := range online.received {
+		if measure.Value != float64(i) {
+			t.Fatalf("Expected measurements in order, got %v at %d", measure.Value, i)
+		}
+	}
+}
+
+func TestBatchLiveMeasurements(t *testing.T) {
+	// Given
+	previous := _batching
+	defer func() { _batching = previous }()
+	_batching = batching{size: 3, latency: 100 * time.Millisecond}
+
+	backend := &batchRecorder{testBackend: testBackend{name: "live"}}
+	queue := newBackendQueue(backend, tempDir())
+
+	// When
+	for i := range 4 {
+		queue.forward(Measurement{Ident: "16.7.0", Value: float64(i)})
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// Then
+	if backend.count() != 3 {
+		t.Errorf("Expected full batch to be sent right away, got %d", backend.count())
+	}
+
+	// When
+	time.Sleep(200 * time.Millisecond)
+
+	// Then
+	if backend.count() != 4 {
+		t.Errorf("Expected partial batch to be sent after latency, got %d", backend.count())
+	}
+
+	// When
+	queue.forward(Measurement{Ident: "16.7.0", Value: 4})
+	queue.close()
+
+	// Then
+	if backend.count() != 5 || len(backend.batches) != 3 {
+		t.Errorf("Expected remaining batch to be sent on close, got %d in %v", backend.count(), backend.batches)
+	}
+}
+
+func TestAdoptLegacyQueue(t *testing.T) {
+	// Given
+	cache := tempDir()
+	legacy := diskqueue.New(legacyQueue, cache, 10485760, 4, 1<<10, 4096, 10*time.Second, dqLog)
+	for i := range 3 {
+		payload, _ := json.Marshal(Measurement{Ident: "1.8.0", Value: float64(i)})
+		legacy.Put(payload)
+	}
+	legacy.Close()
+	influx, mysql := &testBackend{name: "influx"}, &testBackend{name: "mysql"}
+
+	// When
+	adoptLegacyQueue([]Backend{influx, mysql}, cache)
+
+	// Then
+	if kept, _ := filepath.Glob(filepath.Join(cache, "cached.diskqueue.*.dat")); len(kept) == 0 {
+		t.Fatal("Expected the legacy queue to be kept for multiple backends")
+	}
+
+	// When
+	adoptLegacyQueue([]Backend{mysql}, cache)
+	queue := newBackendQueue(mysql, cache)
+	deadline := time.Now().Add(5 * time.Second)
+	for mysql.count() < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	queue.close()
+
+	// Then
+	if mysql.count() != 3 {
+		t.Errorf("Expected the legacy measurements sent to the single backend, got %d", mysql.count())
+	}
+	if kept, _ := filepath.Glob(filepath.Join(cache, "cached.*")); len(kept) != 0 {
+		t.Errorf("Expected the legacy queue to be renamed, got %v", kept)
+	}
+}
@@ -0,0 +1,51 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import "time"
+
+// exponential backoff between reconnection attempts
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	current time.Duration
+	// replaceable in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newBackoff(min time.Duration, max time.Duration) *backoff {
+	return &backoff{
+		min:     min,
+		max:     max,
+		current: min,
+		now:     time.Now,
+		sleep:   time.Sleep,
+	}
+}
+
+// next returns the delay to wait now and doubles it for the following call
+func (b *backoff) next() time.Duration {
+	delay := b.current
+	b.current = min(b.current*2, b.max)
+	return delay
+}
+
+func (b *backoff) reset() {
+	b.current = b.min
+}
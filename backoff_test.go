@@ -0,0 +1,40 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	// Given
+	retry := newBackoff(time.Second, 5*time.Second)
+
+	// When && Then
+	for _, expected := range []time.Duration{1, 2, 4, 5, 5} {
+		if delay := retry.next(); delay != expected*time.Second {
+			t.Errorf("Expected %s, got %s", expected*time.Second, delay)
+		}
+	}
+
+	retry.reset()
+	if delay := retry.next(); delay != time.Second {
+		t.Errorf("Expected reset to 1s, got %s", delay)
+	}
+}
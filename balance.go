@@ -0,0 +1,252 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+// codes of the measurements the balance is derived from
+const (
+	codeImportEnergy = "1-0:1.8.0*255"
+	codeExportEnergy = "1-0:2.8.0*255"
+	codeImportPower  = "1-0:1.7.0*255"
+	codeExportPower  = "1-0:2.7.0*255"
+	codeNetPower     = "1-0:16.7.0*255"
+)
+
+// idents of the balance measurements, from the manufacturer specific range
+const (
+	NetPower             = "130.7.0"
+	NetImportPower       = "131.7.0"
+	NetExportPower       = "132.7.0"
+	DailyImport          = "131.8.0"
+	DailyExport          = "132.8.0"
+	DailyProduction      = "133.8.0"
+	DailySelfConsumption = "134.8.0"
+	DailyConsumption     = "135.8.0"
+	SelfConsumptionRatio = "136.8.0"
+	AutarkyRatio         = "137.8.0"
+)
+
+type balanceConfig struct {
+	// names of the meters at the grid connection and of the PV production
+	grid, pv string
+	// counter of the PV meter the production is read from
+	pvCounter string
+}
+
+// balance is nil unless configured
+var _balance *balanceConfig
+
+func selectBalance(config map[string]string, meters []*meter) *balanceConfig {
+	balance, err := parseBalance(config[Balance], meters)
+	if err != nil {
+		printHelpAndExit(fmt.Sprintf("Illegal balance: %s\n", err))
+	}
+	return balance
+}
+
+// parseBalance parses options like "grid=home pv=solar pv_counter=2.8.0" naming configured meters
+func parseBalance(config string, meters []*meter) (*balanceConfig, error) {
+	if config == "-" || strings.TrimSpace(config) == "" {
+		return nil, nil
+	}
+
+	names := make([]string, len(meters))
+	for i, m := range meters {
+		names[i] = m.name
+	}
+
+	balance := &balanceConfig{pvCounter: "1.8.0"}
+	for _, option := range strings.Fields(config) {
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "grid":
+			balance.grid = value
+		case "pv":
+			balance.pv = value
+		case "pv_counter":
+			balance.pvCounter = value
+			if groups := obisPattern.FindStringSubmatch(value); groups == nil || groups[1] != "" || strings.Contains(value, "*") {
+				return nil, fmt.Errorf("invalid pv_counter '%s', expected an ident like 1.8.0", value)
+			}
+		default:
+			return nil, fmt.Errorf("unknown option '%s', expected grid, pv or pv_counter", option)
+		}
+	}
+
+	if balance.grid == "" {
+		return nil, fmt.Errorf("missing grid meter")
+	}
+	for _, name := range []string{balance.grid, balance.pv} {
+		if name != "" && !slices.Contains(names, name) {
+			return nil, fmt.Errorf("unknown meter '%s', expected one of %s", name, strings.Join(names, ", "))
+		}
+	}
+	if balance.pv == balance.grid {
+		return nil, fmt.Errorf("grid and pv meter must differ")
+	}
+	return balance, nil
+}
+
+// dailyCounter tracks the energy counted since midnight, local time
+type dailyCounter struct {
+	day time.Time
+	// reading of the end of the previous day, or the first one of the day if not known
+	baseline float64
+	last     float64
+	lastDay  time.Time
+}
+
+func (c *dailyCounter) update(value float64, at time.Time) {
+	day := startOfDay(at)
+	if !c.day.Equal(day) {
+		c.baseline = value
+		if c.lastDay.AddDate(0, 0, 1).Equal(day) {
+			c.baseline = c.last
+		}
+		c.day = day
+	}
+	c.last, c.lastDay = value, day
+}
+
+func (c *dailyCounter) energy() float64 {
+	return math.Max(c.last-c.baseline, 0)
+}
+
+func startOfDay(at time.Time) time.Time {
+	year, month, day := at.Local().Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.Local)
+}
+
+// balancer derives the grid balance, and with a PV meter the self-consumption, from the readings of the meters
+type balancer struct {
+	config *balanceConfig
+	// the net power is taken from 16.7.0 if sent, otherwise calculated from 1.7.0 and 2.7.0
+	hasNetPower              bool
+	importPower, exportPower *float64
+	imported, exported, pv   *dailyCounter
+}
+
+func newBalancer(config *balanceConfig) *balancer {
+	return &balancer{config: config}
+}
+
+// balance returns the measurements derived from the reading, none if the reading isn't relevant
+func (b *balancer) balance(measure Measurement) []Measurement {
+	if b.config == nil || measure.Type != NumberValue || measure.Aggregate != "" {
+		return nil
+	}
+
+	code := measure.fullCode()
+	balanced := []Measurement{}
+	result := func(ident string, value float64, unit string) {
+		derived := Measurement{
+			Device: b.config.grid,
+			Prefix: "1-0",
+			Ident:  ident,
+			Suffix: "255",
+			Unit:   unit,
+			Type:   NumberValue,
+			Value:  value,
+			Time:   measure.Time,
+		}
+		if entry, ok := _obisCatalogue.lookup(&derived); ok {
+			derived.Name = entry.Name
+		}
+		debug("Balanced", &derived)
+		balanced = append(balanced, derived)
+	}
+	net := func(power float64) {
+		result(NetPower, power, "W")
+		result(NetImportPower, math.Max(power, 0), "W")
+		result(NetExportPower, math.Max(-power, 0), "W")
+	}
+
+	switch {
+	case measure.Device == b.config.grid && code == codeNetPower:
+		b.hasNetPower = true
+		net(toBaseUnit(measure.Value, measure.Unit, "W"))
+	case measure.Device == b.config.grid && (code == codeImportPower || code == codeExportPower) && !b.hasNetPower:
+		power := toBaseUnit(measure.Value, measure.Unit, "W")
+		if code == codeImportPower {
+			b.importPower = &power
+		} else {
+			b.exportPower = &power
+		}
+		if b.importPower != nil && b.exportPower != nil {
+			net(*b.importPower - *b.exportPower)
+		}
+	case measure.Device == b.config.grid && code == codeImportEnergy:
+		b.imported = countDaily(b.imported, measure)
+		result(DailyImport, b.imported.energy(), "Wh")
+	case measure.Device == b.config.grid && code == codeExportEnergy:
+		b.exported = countDaily(b.exported, measure)
+		result(DailyExport, b.exported.energy(), "Wh")
+	case b.config.pv != "" && measure.Device == b.config.pv && code == "1-0:"+b.config.pvCounter+"*255":
+		b.pv = countDaily(b.pv, measure)
+		result(DailyProduction, b.pv.energy(), "Wh")
+	default:
+		return nil
+	}
+
+	if code != codeImportEnergy && code != codeExportEnergy && measure.Device != b.config.pv {
+		return balanced
+	}
+	if b.imported == nil || b.exported == nil || b.pv == nil || !b.imported.day.Equal(b.pv.day) || !b.exported.day.Equal(b.pv.day) {
+		return balanced
+	}
+
+	// what's produced but not exported is consumed by the household itself
+	selfConsumption := math.Max(b.pv.energy()-b.exported.energy(), 0)
+	consumption := b.imported.energy() + selfConsumption
+	result(DailySelfConsumption, selfConsumption, "Wh")
+	result(DailyConsumption, consumption, "Wh")
+	if production := b.pv.energy(); production > 0 {
+		result(SelfConsumptionRatio, 100*selfConsumption/production, "%")
+	}
+	if consumption > 0 {
+		result(AutarkyRatio, 100*selfConsumption/consumption, "%")
+	}
+	return balanced
+}
+
+func countDaily(counter *dailyCounter, measure Measurement) *dailyCounter {
+	if counter == nil {
+		counter = &dailyCounter{}
+	}
+	counter.update(toBaseUnit(measure.Value, measure.Unit, "Wh"), measure.Time)
+	return counter
+}
+
+// toBaseUnit scales values like "1.2 kWh" to "1200 Wh", values without unit are taken as base unit
+func toBaseUnit(value float64, unit string, base string) float64 {
+	switch unit {
+	case "k" + base:
+		return value * 1000
+	case "M" + base:
+		return value * 1000000
+	default:
+		return value
+	}
+}
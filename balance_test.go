@@ -0,0 +1,162 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+var balanceMeters = []*meter{{name: "home"}, {name: "solar"}}
+
+func TestParseBalance(t *testing.T) {
+	// When
+	balance, err := parseBalance("grid=home pv=solar pv_counter=2.8.0", balanceMeters)
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.grid != "home" || balance.pv != "solar" || balance.pvCounter != "2.8.0" {
+		t.Errorf("Unexpected balance %+v", balance)
+	}
+
+	if balance, err := parseBalance("-", balanceMeters); balance != nil || err != nil {
+		t.Errorf("Expected no balance, got %+v %v", balance, err)
+	}
+	if balance, _ := parseBalance("grid=home", balanceMeters); balance.pv != "" || balance.pvCounter != "1.8.0" {
+		t.Errorf("Expected grid only balance, got %+v", balance)
+	}
+}
+
+func TestParseInvalidBalance(t *testing.T) {
+	for _, raw := range []string{"pv=solar", "grid=garage", "grid=home pv=garage", "grid=home pv=home", "grid=home pv_counter=1-0:1.8.0", "grid=home phases=3"} {
+		if _, err := parseBalance(raw, balanceMeters); err == nil {
+			t.Errorf("Expected '%s' to be invalid", raw)
+		}
+	}
+}
+
+func balanced(measurements []Measurement) map[string]float64 {
+	values := map[string]float64{}
+	for _, m := range measurements {
+		values[m.Ident] = m.Value
+	}
+	return values
+}
+
+func TestBalanceNetPower(t *testing.T) {
+	// Given
+	b := newBalancer(&balanceConfig{grid: "home"})
+	now := time.Now()
+
+	// When
+	exported := balanced(b.balance(Measurement{Device: "home", Prefix: "1-0", Ident: "16.7.0", Suffix: "255", Unit: "W", Type: NumberValue, Value: -1500, Time: now}))
+
+	// Then
+	if exported[NetPower] != -1500 || exported[NetImportPower] != 0 || exported[NetExportPower] != 1500 {
+		t.Errorf("Unexpected net power %v", exported)
+	}
+	if other := b.balance(Measurement{Device: "solar", Prefix: "1-0", Ident: "16.7.0", Suffix: "255", Type: NumberValue, Value: 1, Time: now}); len(other) != 0 {
+		t.Errorf("Expected other meters to be ignored, got %v", other)
+	}
+}
+
+func TestBalanceNetPowerOfImportAndExport(t *testing.T) {
+	// Given
+	b := newBalancer(&balanceConfig{grid: "home"})
+	now := time.Now()
+
+	// When
+	first := b.balance(Measurement{Device: "home", Ident: "1.7.0", Unit: "kW", Type: NumberValue, Value: 0.8, Time: now})
+	second := balanced(b.balance(Measurement{Device: "home", Ident: "2.7.0", Unit: "kW", Type: NumberValue, Value: 0.2, Time: now}))
+
+	// Then
+	if len(first) != 0 {
+		t.Errorf("Expected nothing until export power is known, got %v", first)
+	}
+	if math.Abs(second[NetPower]-600) > 1e-9 || math.Abs(second[NetImportPower]-600) > 1e-9 {
+		t.Errorf("Expected 600 W import, got %v", second)
+	}
+}
+
+func TestBalanceDaily(t *testing.T) {
+	// Given
+	b := newBalancer(&balanceConfig{grid: "home", pv: "solar", pvCounter: "1.8.0"})
+	morning := time.Date(2025, 6, 1, 6, 0, 0, 0, time.Local)
+	evening := morning.Add(12 * time.Hour)
+	reading := func(device string, ident string, value float64, at time.Time) []Measurement {
+		return b.balance(Measurement{Device: device, Prefix: "1-0", Ident: ident, Suffix: "255", Unit: "Wh", Type: NumberValue, Value: value, Time: at})
+	}
+	reading("home", "1.8.0", 100000, morning)
+	reading("home", "2.8.0", 50000, morning)
+	reading("solar", "1.8.0", 80000, morning)
+
+	// When
+	reading("home", "1.8.0", 104000, evening)
+	reading("home", "2.8.0", 56000, evening)
+	values := balanced(reading("solar", "1.8.0", 90000, evening))
+
+	// Then
+	expected := map[string]float64{
+		DailyProduction:      10000,
+		DailySelfConsumption: 4000,
+		DailyConsumption:     8000,
+		SelfConsumptionRatio: 40,
+		AutarkyRatio:         50,
+	}
+	for ident, value := range expected {
+		if math.Abs(values[ident]-value) > 1e-9 {
+			t.Errorf("Expected %s to be %f, got %f", ident, value, values[ident])
+		}
+	}
+}
+
+func TestBalanceNamed(t *testing.T) {
+	b := newBalancer(&balanceConfig{grid: "home"})
+	for _, m := range b.balance(Measurement{Device: "home", Ident: "1.8.0", Unit: "kWh", Type: NumberValue, Value: 1, Time: time.Now()}) {
+		if m.Name != "daily_import_energy" || m.Device != "home" || m.Unit != "Wh" {
+			t.Errorf("Unexpected daily import %+v", m)
+		}
+	}
+}
+
+func TestDailyCounter(t *testing.T) {
+	// Given
+	counter := &dailyCounter{}
+	day := time.Date(2025, 6, 1, 0, 0, 0, 0, time.Local)
+
+	// When
+	counter.update(1000, day.Add(8*time.Hour))
+	counter.update(1500, day.Add(23*time.Hour))
+	counter.update(1600, day.Add(25*time.Hour))
+
+	// Then
+	if counter.energy() != 100 {
+		t.Errorf("Expected energy since the previous day's last reading, got %f", counter.energy())
+	}
+
+	// When
+	counter.update(2000, day.Add(72*time.Hour))
+
+	// Then
+	if counter.energy() != 0 {
+		t.Errorf("Expected energy to restart after a gap of days, got %f", counter.energy())
+	}
+}
@@ -0,0 +1,164 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// captures raw SML transport frames, nil if disabled
+var _capture *rotatingFiles
+
+// rotatingFiles writes into size and time rotated files named like <name>-<time><extension>,
+// e.g. raw transport frames captured to be replayed later on
+type rotatingFiles struct {
+	mutex     sync.Mutex
+	dir       string
+	name      string
+	extension string
+	maxSize   int64
+	maxAge    time.Duration
+	keep      int
+	file      *os.File
+	size      int64
+	opened    time.Time
+	closed    bool
+}
+
+func newRotatingFiles(dir string, name string, extension string, maxSize int64, maxAge time.Duration, keep int) (*rotatingFiles, error) {
+	if err := os.MkdirAll(dir, fs.ModePerm); err != nil {
+		return nil, err
+	}
+	return &rotatingFiles{
+		dir:       dir,
+		name:      name,
+		extension: extension,
+		maxSize:   maxSize,
+		maxAge:    maxAge,
+		keep:      keep,
+	}, nil
+}
+
+func newFrameCapture(dir string, maxSize int64, maxAge time.Duration, keep int) (*rotatingFiles, error) {
+	return newRotatingFiles(dir, "capture", ".bin", maxSize, maxAge, keep)
+}
+
+func selectCapture(config map[string]string) *rotatingFiles {
+	enabled, err := strconv.ParseBool(config[Capture])
+	if err != nil {
+		printHelpAndExit(fmt.Sprintf("Illegal capture flag value %s: %s\n", config[Capture], err))
+	}
+	if !enabled {
+		return nil
+	}
+
+	maxSize, err := strconv.ParseInt(config[CaptureMaxSize], 10, 64)
+	if err != nil || maxSize <= 0 {
+		printHelpAndExit(fmt.Sprintf("Illegal capture max size %s\n", config[CaptureMaxSize]))
+	}
+	maxAge, err := time.ParseDuration(config[CaptureMaxAge])
+	if err != nil || maxAge <= 0 {
+		printHelpAndExit(fmt.Sprintf("Illegal capture max age %s\n", config[CaptureMaxAge]))
+	}
+	keep, err := strconv.Atoi(config[CaptureFiles])
+	if err != nil || keep <= 0 {
+		printHelpAndExit(fmt.Sprintf("Illegal number of capture files %s\n", config[CaptureFiles]))
+	}
+
+	dir := filepath.Join(config[CachePath], "capture")
+	fmt.Printf("Capture SML frames to %s\n", dir)
+	capture, err := newFrameCapture(dir, maxSize, maxAge, keep)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return capture
+}
+
+func (c *rotatingFiles) write(data []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// listeners are still running while stopping
+	if c.closed {
+		return
+	}
+	if c.file == nil || (c.size > 0 && c.size+int64(len(data)) > c.maxSize) || time.Since(c.opened) >= c.maxAge {
+		if err := c.rotate(); err != nil {
+			log.Printf("Failed to rotate %s: %s\n", c.name, err)
+			return
+		}
+	}
+
+	n, err := c.file.Write(data)
+	c.size += int64(n)
+	if err != nil {
+		log.Printf("Failed writing %s: %s\n", c.name, err)
+	}
+}
+
+func (c *rotatingFiles) rotate() error {
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+
+	c.opened = time.Now()
+	name := filepath.Join(c.dir, fmt.Sprintf("%s-%s%s", c.name, c.opened.Format("20060102-150405.000"), c.extension))
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	c.file = file
+	c.size = 0
+
+	// names sort by time, drop the oldest files, but never the current one sorting first if the clock went backwards
+	files, err := filepath.Glob(filepath.Join(c.dir, c.name+"-*"+c.extension))
+	if err != nil {
+		return err
+	}
+	slices.Sort(files)
+	files = slices.DeleteFunc(files, func(file string) bool { return file == name })
+	keep := c.keep - 1
+	for len(files) > keep {
+		fmt.Printf("Removing %s\n", files[0])
+		if err := os.Remove(files[0]); err != nil {
+			log.Printf("Failed to remove %s: %s\n", files[0], err)
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+func (c *rotatingFiles) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closed = true
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+}
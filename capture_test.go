@@ -0,0 +1,146 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCaptureRotatesBySize(t *testing.T) {
+	// Given
+	dir := t.TempDir()
+	frame := smlTestFrame(smlTestGetListResponse([]byte{0x0a, 0x01}, smlTestEnergy))
+	capture, err := newFrameCapture(dir, int64(2*len(frame)), time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// When
+	for range 5 {
+		capture.write(frame)
+		// file names have millisecond resolution
+		time.Sleep(2 * time.Millisecond)
+	}
+	capture.close()
+
+	// Then
+	captures, _ := filepath.Glob(filepath.Join(dir, "capture-*.bin"))
+	if len(captures) != 2 {
+		t.Fatalf("Expected 2 capture files, got %d", len(captures))
+	}
+	latest, _ := os.ReadFile(captures[1])
+	if !bytes.Equal(latest, frame) {
+		t.Errorf("Expected the last frame in the latest capture, got %x", latest)
+	}
+	previous, _ := os.ReadFile(captures[0])
+	if !bytes.Equal(previous, bytes.Repeat(frame, 2)) {
+		t.Errorf("Expected two frames in the previous capture, got %x", previous)
+	}
+}
+
+func TestCaptureRotatesByAge(t *testing.T) {
+	// Given
+	dir := t.TempDir()
+	capture, err := newFrameCapture(dir, 1024, 10*time.Millisecond, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// When
+	capture.write([]byte{0x01})
+	time.Sleep(20 * time.Millisecond)
+	capture.write([]byte{0x02})
+	capture.close()
+
+	// Then
+	captures, _ := filepath.Glob(filepath.Join(dir, "capture-*.bin"))
+	if len(captures) != 2 {
+		t.Errorf("Expected 2 capture files, got %d", len(captures))
+	}
+}
+
+func TestCaptureKeepsCurrentFileAfterClockWentBackwards(t *testing.T) {
+	// Given
+	dir := t.TempDir()
+	for _, future := range []string{"capture-20990101-000000.000.bin", "capture-20990102-000000.000.bin"} {
+		if err := os.WriteFile(filepath.Join(dir, future), []byte{0x00}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	capture, err := newFrameCapture(dir, 1024, time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// When
+	capture.write([]byte{0x01})
+	capture.write([]byte{0x02})
+	capture.close()
+
+	// Then
+	captures, _ := filepath.Glob(filepath.Join(dir, "capture-*.bin"))
+	if len(captures) != 2 || filepath.Base(captures[1]) != "capture-20990102-000000.000.bin" {
+		t.Fatalf("Expected the current and the latest other capture, got %v", captures)
+	}
+	current, _ := os.ReadFile(captures[0])
+	if !bytes.Equal(current, []byte{0x01, 0x02}) {
+		t.Errorf("Expected both frames in the current capture, got %x", current)
+	}
+}
+
+func TestCaptureDropsFramesOnceClosed(t *testing.T) {
+	// Given
+	dir := t.TempDir()
+	capture, _ := newFrameCapture(dir, 1024, time.Hour, 2)
+	capture.close()
+
+	// When
+	capture.write([]byte{0x01})
+
+	// Then
+	if captures, _ := filepath.Glob(filepath.Join(dir, "capture-*.bin")); len(captures) != 0 {
+		t.Errorf("Expected no capture once closed, got %v", captures)
+	}
+}
+
+func TestReplayCapture(t *testing.T) {
+	// Given
+	dir := t.TempDir()
+	capture, _ := newFrameCapture(dir, 1024, time.Hour, 1)
+	_capture = capture
+	stream := smlTestFrame(smlTestGetListResponse([]byte{0x0a, 0x01}, smlTestEnergy))
+	listenNative(&meter{}, bytes.NewReader(stream))
+	<-_messages
+	_capture = nil
+	capture.close()
+
+	// When
+	captures, _ := filepath.Glob(filepath.Join(dir, "capture-*.bin"))
+	replay(captures[0], 0, func(file *os.File) int {
+		return listenNative(&meter{}, file)
+	})
+
+	// Then
+	if energy := <-_messages; energy.Ident != "1.8.0" {
+		t.Errorf("Expected 1.8.0, got %s", energy.Ident)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	HostTime   = "host"
+	MeterTime  = "meter"
+	OffsetTime = "offset"
+)
+
+// where measurement times are taken from
+var _timeSource = HostTime
+
+// as SmlTimeType in samler.h
+const (
+	smlTimeNone           = 0
+	smlTimeSecIndex       = 1
+	smlTimeTimestamp      = 2
+	smlTimeLocalTimestamp = 3
+)
+
+// a deviation above that means the meter restarted or the clocks drifted apart
+const meterClockTolerance = 10 * time.Second
+
+type smlTime struct {
+	kind  int
+	value uint32
+}
+
+// meterClocks learn per meter the host time of its seconds index being zero
+type meterClocks struct {
+	mutex sync.Mutex
+	bases map[string]time.Time
+}
+
+var _meterClocks = meterClocks{bases: make(map[string]time.Time)}
+
+func selectTimeSource(config map[string]string) string {
+	source := config[TimeSource]
+	switch source {
+	case HostTime, MeterTime, OffsetTime:
+		return source
+	default:
+		printHelpAndExit(fmt.Sprintf("Unknown time source '%s', please select from [%s, %s, %s]\n", source, HostTime, MeterTime, OffsetTime))
+		return HostTime
+	}
+}
+
+// meterClock identifies the clock of a meter, as meters without server id are only told apart by their device
+func meterClock(device string, serverId string) string {
+	return device + "#" + serverId
+}
+
+// measurementTime determines the time of a measurement received at the given host time according to the time source
+func measurementTime(clock string, sensorTime smlTime, valueTime smlTime, received time.Time) time.Time {
+	// the time of the entry is more specific than the one of the list
+	times := []smlTime{valueTime, sensorTime}
+	switch _timeSource {
+	case MeterTime:
+		for _, t := range times {
+			if t.kind == smlTimeTimestamp || t.kind == smlTimeLocalTimestamp {
+				return time.Unix(int64(t.value), 0)
+			}
+		}
+	case OffsetTime:
+		for _, t := range times {
+			if t.kind == smlTimeSecIndex {
+				return _meterClocks.correct(clock, t.value, received)
+			}
+		}
+	}
+	return received
+}
+
+// correct maps the seconds index to host time using the learned offset, learning it on the way
+func (c *meterClocks) correct(clock string, secIndex uint32, received time.Time) time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elapsed := time.Duration(secIndex) * time.Second
+	candidate := received.Add(-elapsed)
+	base, known := c.bases[clock]
+	// the latency of reception only ever adds up, so the earliest base is the most accurate one
+	if !known || candidate.Before(base) || candidate.Sub(base) > meterClockTolerance {
+		base = candidate
+		c.bases[clock] = base
+	}
+	return base.Add(elapsed)
+}
@@ -0,0 +1,105 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func withTimeSource(source string) func() {
+	previous := _timeSource
+	_timeSource = source
+	return func() { _timeSource = previous }
+}
+
+func TestHostTime(t *testing.T) {
+	// Given
+	defer withTimeSource(HostTime)()
+	received := time.Now()
+
+	// When
+	result := measurementTime("0a01", smlTime{smlTimeTimestamp, 1700000000}, smlTime{}, received)
+
+	// Then
+	if !result.Equal(received) {
+		t.Errorf("Expected %s, got %s", received, result)
+	}
+}
+
+func TestMeterTime(t *testing.T) {
+	// Given
+	defer withTimeSource(MeterTime)()
+	received := time.Now()
+
+	// When && Then
+	if result := measurementTime("0a01", smlTime{smlTimeTimestamp, 1700000000}, smlTime{smlTimeLocalTimestamp, 1700000005}, received); result.Unix() != 1700000005 {
+		t.Errorf("Expected the value time, got %s", result)
+	}
+
+	if result := measurementTime("0a01", smlTime{smlTimeTimestamp, 1700000000}, smlTime{}, received); result.Unix() != 1700000000 {
+		t.Errorf("Expected the sensor time, got %s", result)
+	}
+
+	// a seconds index is no absolute time
+	if result := measurementTime("0a01", smlTime{smlTimeSecIndex, 4711}, smlTime{}, received); !result.Equal(received) {
+		t.Errorf("Expected the host time, got %s", result)
+	}
+}
+
+func TestOffsetTime(t *testing.T) {
+	// Given
+	defer withTimeSource(OffsetTime)()
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// When && Then
+	// learn on first reception
+	if result := measurementTime("offset", smlTime{smlTimeSecIndex, 1000}, smlTime{}, start.Add(300*time.Millisecond)); !result.Equal(start.Add(300 * time.Millisecond)) {
+		t.Errorf("Unexpected first time %s", result)
+	}
+
+	// later reception is corrected
+	if result := measurementTime("offset", smlTime{smlTimeSecIndex, 1001}, smlTime{}, start.Add(1900*time.Millisecond)); !result.Equal(start.Add(1300 * time.Millisecond)) {
+		t.Errorf("Expected latency to be corrected, got %s", result)
+	}
+
+	// earlier reception improves the offset
+	if result := measurementTime("offset", smlTime{smlTimeSecIndex, 1002}, smlTime{}, start.Add(2100*time.Millisecond)); !result.Equal(start.Add(2100 * time.Millisecond)) {
+		t.Errorf("Expected offset to be learned, got %s", result)
+	}
+
+	// restarted meter
+	if result := measurementTime("offset", smlTime{smlTimeSecIndex, 5}, smlTime{}, start.Add(time.Hour)); !result.Equal(start.Add(time.Hour)) {
+		t.Errorf("Expected offset to be relearned, got %s", result)
+	}
+}
+
+func TestOffsetTimePerDevice(t *testing.T) {
+	// Given
+	defer withTimeSource(OffsetTime)()
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	measurementTime(meterClock("home", ""), smlTime{smlTimeSecIndex, 1000}, smlTime{}, start)
+
+	// When
+	result := measurementTime(meterClock("heatpump", ""), smlTime{smlTimeSecIndex, 996}, smlTime{}, start.Add(time.Second))
+
+	// Then
+	if !result.Equal(start.Add(time.Second)) {
+		t.Errorf("Expected the clock of another meter without server id to be learned separately, got %s", result)
+	}
+}
@@ -0,0 +1,279 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IEC 62056-21 control characters
+const (
+	d0Stx = 0x02
+	d0Etx = 0x03
+	d0Ack = 0x06
+)
+
+const d0SignOn = "/?!\r\n"
+
+var errD0Checksum = errors.New("block check character mismatch")
+
+// baud rates of protocol mode C, as announced by the meter's identification and requested by the acknowledgement
+var d0BaudRates = map[byte]int{
+	'0': 300,
+	'1': 600,
+	'2': 1200,
+	'3': 2400,
+	'4': 4800,
+	'5': 9600,
+	'6': 19200,
+}
+
+// max time to wait for the next line from a meter
+var d0Timeout = 10 * time.Second
+
+// data lines like "1-0:1.8.0*255(012345.678*kWh)" or short "1.8.0(012345.678*kWh)", also "C.1.0(12345678)"
+var d0DataLine = regexp.MustCompile(`^(?:(\d+)-(\d+):)?([0-9A-Za-z]+\.[0-9A-Za-z]+(?:\.[0-9A-Za-z]+)?)(?:[*&](\d+))?\(([^()]*)\)`)
+
+// d0Link is the connection to a meter the readout is requested on
+type d0Link struct {
+	file     *os.File
+	baudRate int
+	// switches the speed of serial devices, nil if the connection doesn't support that
+	setBaudRate func(baudRate int) error
+}
+
+// d0Listener returns the blocking listener reading IEC 62056-21 (D0) datagrams from the device of the meter
+func d0Listener(m *meter) func() {
+	if path, isReplay := strings.CutPrefix(m.device, ReplayScheme); isReplay {
+		return func() {
+			replay(path, m.replayInterval, func(file *os.File) int {
+				return listenD0(m, file, nil)
+			})
+		}
+	}
+
+	if address, isSocket := strings.CutPrefix(m.device, SocketScheme); isSocket {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			printHelpAndExit(fmt.Sprintf("Illegal socket address %s: %s\n", m.device, err))
+		}
+		return func() {
+			listenToSocket(address, func(file *os.File) int {
+				return listenD0(m, file, &d0Link{file: file, baudRate: m.baudRate})
+			})
+		}
+	}
+
+	if err := checkSerialConfig(m.baudRate, m.mode); err != nil {
+		printHelpAndExit(fmt.Sprintf("Illegal configuration of device %s: %s\n", m.device, err))
+	}
+
+	return func() {
+		superviseDevice(m, func(path string) (*os.File, error) {
+			fmt.Printf("Listen to %s (%s)\n", path, m.name)
+			return openSerial(path, m.baudRate, m.mode)
+		}, func(file *os.File) int {
+			return listenD0(m, file, &d0Link{
+				file:     file,
+				baudRate: m.baudRate,
+				setBaudRate: func(baudRate int) error {
+					return setSerialBaudRate(file, baudRate)
+				},
+			})
+		})
+	}
+}
+
+// listenD0 reads datagrams until the reader ends or fails, requesting each readout with the
+// sign-on handshake of protocol mode C if a link is given, otherwise just listening like for push meters
+func listenD0(m *meter, reader io.Reader, link *d0Link) int {
+	buffered := bufio.NewReader(reader)
+	for {
+		if link != nil {
+			link.file.SetReadDeadline(time.Now().Add(d0Timeout))
+			if _, err := link.file.WriteString(d0SignOn); err != nil {
+				log.Printf("Failed to sign on to %s: %s\n", m.name, err)
+				return 0
+			}
+		}
+
+		ident, err := readD0Identification(buffered)
+		if err == nil && link != nil {
+			err = link.acknowledge(ident)
+		}
+		var datagram []byte
+		if err == nil {
+			datagram, err = readD0Datagram(buffered, link)
+		}
+		if link != nil && link.setBaudRate != nil {
+			// back to the speed of the sign-on, also if the readout failed
+			link.setBaudRate(link.baudRate)
+		}
+		if errors.Is(err, errD0Checksum) {
+			log.Printf("Skipped D0 datagram of %s: %s\n", m.name, err)
+			m.stats.count(CrcError)
+		} else if err != nil {
+			if err != io.EOF {
+				log.Printf("Failed reading D0 datagram of %s: %s\n", m.name, err)
+			}
+			return 0
+		} else {
+			m.stats.count(FrameOk)
+			if _capture != nil {
+				_capture.write(append([]byte(ident+"\r\n"), datagram...))
+			}
+			for _, line := range strings.Split(string(datagram), "\n") {
+				if measure, ok := parseD0Line(line); ok {
+					m.emit(measure)
+				}
+			}
+		}
+
+		if link != nil {
+			time.Sleep(m.pollInterval)
+		}
+	}
+}
+
+// readD0Identification skips everything up to the identification like "/LGZ4ZMF100AC.M23"
+func readD0Identification(reader *bufio.Reader) (string, error) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimSpace(line)
+		if start := strings.IndexByte(line, '/'); start >= 0 && len(line) >= start+5 {
+			return line[start:], nil
+		}
+	}
+}
+
+// acknowledge requests the data readout, switching to the speed announced by the meter if possible
+func (l *d0Link) acknowledge(ident string) error {
+	announced, isModeC := d0BaudRates[ident[4]]
+	if !isModeC {
+		// modes A and B send their data without acknowledgement
+		return nil
+	}
+
+	baudRate := l.baudRate
+	if l.setBaudRate != nil {
+		baudRate = announced
+	}
+	var speed byte
+	for char, rate := range d0BaudRates {
+		if rate == baudRate {
+			speed = char
+		}
+	}
+	if speed == 0 {
+		return fmt.Errorf("baud rate %d can't be requested", baudRate)
+	}
+
+	if _, err := l.file.Write([]byte{d0Ack, '0', speed, '0', '\r', '\n'}); err != nil {
+		return err
+	}
+	if baudRate != l.baudRate {
+		return l.setBaudRate(baudRate)
+	}
+	return nil
+}
+
+// readD0Datagram reads the data lines up to the end line "!", checking the block check character if framed by STX and ETX
+func readD0Datagram(reader *bufio.Reader, link *d0Link) ([]byte, error) {
+	var datagram bytes.Buffer
+	framed := false
+	for {
+		if link != nil {
+			link.file.SetReadDeadline(time.Now().Add(d0Timeout))
+		}
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+		if datagram.Len() == 0 && len(line) > 0 && line[0] == d0Stx {
+			framed = true
+			line = line[1:]
+		}
+		datagram.Write(line)
+		if bytes.HasPrefix(line, []byte("!")) {
+			break
+		}
+	}
+
+	if framed {
+		etx, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		bcc, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		// XOR of everything following STX up to and including ETX
+		check := etx
+		for _, b := range datagram.Bytes() {
+			check ^= b
+		}
+		if etx != d0Etx || check != bcc {
+			return nil, fmt.Errorf("%w: got %#02x, expected %#02x", errD0Checksum, bcc, check)
+		}
+	}
+	return datagram.Bytes(), nil
+}
+
+// parseD0Line parses a data line, values with unit like "012345.678*kWh" are numeric, others passed as text
+func parseD0Line(line string) (Measurement, bool) {
+	parts := d0DataLine.FindStringSubmatch(strings.TrimSpace(line))
+	if parts == nil {
+		return Measurement{}, false
+	}
+
+	measure := Measurement{
+		Ident:  parts[3],
+		Suffix: parts[4],
+		Time:   time.Now(),
+	}
+	if parts[1] != "" {
+		measure.Prefix = parts[1] + "-" + parts[2]
+	}
+
+	value, unit, _ := strings.Cut(parts[5], "*")
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		measure.Type = NumberValue
+		measure.Value = number
+		measure.Unit = unit
+	} else if value != "" {
+		measure.Type = StringValue
+		measure.Text = value
+	} else {
+		return Measurement{}, false
+	}
+	return measure, true
+}
@@ -0,0 +1,202 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const d0TestData = "1-0:0.0.0*255(12345678)\r\n" +
+	"1-0:1.8.0*255(012345.678*kWh)\r\n" +
+	"1.8.1(001234.5*kWh)\r\n" +
+	"C.90.1(F1A2)\r\n" +
+	"!\r\n"
+
+// d0TestFrame wraps the data lines in STX, ETX and the block check character
+func d0TestFrame(data string) []byte {
+	bcc := byte(d0Etx)
+	for _, b := range []byte(data) {
+		bcc ^= b
+	}
+	frame := append([]byte{d0Stx}, data...)
+	return append(frame, d0Etx, bcc)
+}
+
+func TestParseD0Line(t *testing.T) {
+	// When
+	measure, ok := parseD0Line("1-0:1.8.0*255(012345.678*kWh)\r\n")
+
+	// Then
+	if !ok || measure.Prefix != "1-0" || measure.Ident != "1.8.0" || measure.Suffix != "255" ||
+		measure.Type != NumberValue || measure.Value != 12345.678 || measure.Unit != "kWh" {
+		t.Errorf("Unexpected measurement %+v", measure)
+	}
+
+	// When
+	measure, ok = parseD0Line("16.7(-000.123*kW)")
+
+	// Then
+	if !ok || measure.Prefix != "" || measure.Ident != "16.7" || measure.Value != -0.123 || measure.Unit != "kW" {
+		t.Errorf("Unexpected measurement %+v", measure)
+	}
+
+	// When
+	measure, ok = parseD0Line("C.90.1(F1A2)")
+
+	// Then
+	if !ok || measure.Ident != "C.90.1" || measure.Type != StringValue || measure.Text != "F1A2" {
+		t.Errorf("Unexpected measurement %+v", measure)
+	}
+
+	for _, line := range []string{"", "!", "/LGZ5ZMF100AC.M23", "1.8.0()", "1.8.0(12"} {
+		if _, ok := parseD0Line(line); ok {
+			t.Errorf("Expected '%s' to be ignored", line)
+		}
+	}
+}
+
+func TestReadD0Datagram(t *testing.T) {
+	// When
+	datagram, err := readD0Datagram(bufio.NewReader(bytes.NewReader(d0TestFrame(d0TestData))), nil)
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(datagram) != d0TestData {
+		t.Errorf("Unexpected datagram %q", datagram)
+	}
+}
+
+func TestReadCorruptD0Datagram(t *testing.T) {
+	// Given
+	frame := d0TestFrame(d0TestData)
+	frame[10] ^= 0x01
+
+	// When
+	_, err := readD0Datagram(bufio.NewReader(bytes.NewReader(frame)), nil)
+
+	// Then
+	if err == nil {
+		t.Error("Expected block check to fail")
+	}
+}
+
+func TestListenD0Push(t *testing.T) {
+	// Given
+	stream := "/ESY5Q3DA1004 V3.02\r\n\r\n" + d0TestData + "/ESY5Q3DA1004 V3.02\r\n\r\n1.8.0(000001.0*kWh)\r\n!\r\n"
+
+	// When
+	exitCode := listenD0(&meter{name: "push"}, strings.NewReader(stream), nil)
+
+	// Then
+	if exitCode != 0 {
+		t.Error()
+	}
+	for _, ident := range []string{"0.0.0", "1.8.0", "1.8.1", "C.90.1", "1.8.0"} {
+		if measure := <-_messages; measure.Ident != ident || measure.Device != "push" {
+			t.Errorf("Expected %s of push, got %s of %s", ident, measure.Ident, measure.Device)
+		}
+	}
+}
+
+func TestListenD0SkipsCorrupt(t *testing.T) {
+	// Given
+	corrupt := d0TestFrame(d0TestData)
+	corrupt[10] ^= 0x01
+	stream := append([]byte("/LGZ5ZMF100AC.M23\r\n"), corrupt...)
+	stream = append(stream, "/LGZ5ZMF100AC.M23\r\n"...)
+	stream = append(stream, d0TestFrame("1.8.0(000001.0*kWh)\r\n!\r\n")...)
+	m := &meter{name: "corrupt"}
+
+	// When
+	listenD0(m, bytes.NewReader(stream), nil)
+
+	// Then
+	if measure := <-_messages; measure.Ident != "1.8.0" || measure.Value != 1 {
+		t.Errorf("Unexpected measurement %+v", measure)
+	}
+	if len(_messages) != 0 {
+		t.Error("Expected the corrupt datagram to be skipped")
+	}
+	if m.stats.crcErrors.Load() != 1 || m.stats.framesOk.Load() != 1 {
+		t.Errorf("Unexpected stats %s", &m.stats)
+	}
+}
+
+func TestListenD0ModeC(t *testing.T) {
+	// Given
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	acknowledged := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		if signOn, _ := reader.ReadString('\n'); signOn != d0SignOn {
+			return
+		}
+		conn.Write([]byte("/LGZ5ZMF100AC.M23\r\n"))
+		ack, _ := reader.ReadString('\n')
+		acknowledged <- ack
+		conn.Write(d0TestFrame(d0TestData))
+		// the next sign-on is answered by closing the connection
+		reader.ReadString('\n')
+	}()
+
+	file, err := dialSocket(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	// When
+	exitCode := listenD0(&meter{name: "modec", pollInterval: time.Millisecond}, file, &d0Link{file: file, baudRate: 300})
+
+	// Then
+	if exitCode != 0 {
+		t.Error()
+	}
+	// the speed can't be switched on a socket, so the current one is requested
+	if ack := <-acknowledged; ack != "\x06000\r\n" {
+		t.Errorf("Unexpected acknowledgement %q", ack)
+	}
+	for _, ident := range []string{"0.0.0", "1.8.0", "1.8.1", "C.90.1"} {
+		if measure := <-_messages; measure.Ident != ident || measure.Device != "modec" {
+			t.Errorf("Expected %s of modec, got %s of %s", ident, measure.Ident, measure.Device)
+		}
+	}
+}
+
+func TestReadD0IdentificationEnd(t *testing.T) {
+	if _, err := readD0Identification(bufio.NewReader(strings.NewReader("garbage\r\n"))); err != io.EOF {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sendPolicy decides which readings of a measurement are sent, unchanged ones are skipped
+type sendPolicy struct {
+	// values changing less than the deadband are taken as unchanged, relative in percent of the previous value
+	deadband float64
+	relative bool
+	// readings within the min interval after the last sent one are skipped, even if changed
+	minInterval time.Duration
+	// unchanged readings are sent again after the heartbeat interval, never if zero
+	heartbeat time.Duration
+	// sends every reading
+	always bool
+}
+
+var defaultSendPolicy = sendPolicy{heartbeat: 60 * time.Second}
+
+type sendRule struct {
+	filter identFilter
+	policy sendPolicy
+}
+
+// sendRules are checked in order, the first one matching a measurement applies
+type sendRules []sendRule
+
+var _sendRules sendRules
+
+func selectSendRules(config map[string]string) sendRules {
+	rules, err := parseSendRules(config[SendRules])
+	if err != nil {
+		printHelpAndExit(fmt.Sprintf("Illegal send rules: %s\n", err))
+	}
+	return rules
+}
+
+// parseSendRules parses rules like "16.7.0 deadband=5 min_interval=10s heartbeat=5m; 1.8.0 deadband=0.1%; 0.0.9 always",
+// options not set are taken from the default rule
+func parseSendRules(config string) (sendRules, error) {
+	rules, err := parseRules(config)
+	if err != nil {
+		return nil, err
+	}
+
+	fallback := defaultSendPolicy
+	if len(rules) > 0 && rules[len(rules)-1].isDefault() {
+		if fallback, err = parseSendPolicy(rules[len(rules)-1].options, fallback); err != nil {
+			return nil, fmt.Errorf("default rule: %s", err)
+		}
+	}
+
+	parsed := sendRules{}
+	for _, r := range rules {
+		policy, err := parseSendPolicy(r.options, fallback)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %s", r.filter, err)
+		}
+		parsed = append(parsed, sendRule{filter: r.filter, policy: policy})
+	}
+	return parsed, nil
+}
+
+func parseSendPolicy(options map[string]string, policy sendPolicy) (sendPolicy, error) {
+	var err error
+	for key, value := range options {
+		switch key {
+		case "deadband":
+			number, isRelative := strings.CutSuffix(value, "%")
+			policy.relative = isRelative
+			if policy.deadband, err = strconv.ParseFloat(number, 64); err != nil || policy.deadband < 0 {
+				return policy, fmt.Errorf("illegal deadband %s, expected a positive number like 5 or 0.5%%", value)
+			}
+		case "min_interval":
+			if policy.minInterval, err = time.ParseDuration(value); err != nil || policy.minInterval < 0 {
+				return policy, fmt.Errorf("illegal min_interval %s", value)
+			}
+		case "heartbeat":
+			if policy.heartbeat, err = time.ParseDuration(value); err != nil || policy.heartbeat < 0 {
+				return policy, fmt.Errorf("illegal heartbeat %s", value)
+			}
+		case "always":
+			if policy.always, err = strconv.ParseBool(value); err != nil {
+				return policy, fmt.Errorf("illegal always flag %s", value)
+			}
+		default:
+			return policy, fmt.Errorf("unknown option '%s', expected deadband, min_interval, heartbeat or always", key)
+		}
+	}
+	return policy, nil
+}
+
+// policyOf returns the policy of the first rule matching the measurement
+func (r sendRules) policyOf(measure *Measurement) sendPolicy {
+	for _, rule := range r {
+		if rule.filter.matches(measure) {
+			return rule.policy
+		}
+	}
+	return defaultSendPolicy
+}
+
+// shouldSend decides whether the reading is sent, given the previously sent one
+func (p sendPolicy) shouldSend(previous Measurement, measure Measurement) bool {
+	if p.always {
+		return true
+	}
+	elapsed := measure.Time.Sub(previous.Time)
+	if elapsed >= 0 && elapsed < p.minInterval {
+		return false
+	}
+	if previous.Text != measure.Text || previous.Status != measure.Status || p.changed(previous.Value, measure.Value) {
+		return true
+	}
+	return p.heartbeat > 0 && elapsed > p.heartbeat
+}
+
+func (p sendPolicy) changed(previous float64, value float64) bool {
+	deadband := p.deadband
+	if p.relative {
+		deadband = math.Abs(previous) * p.deadband / 100
+	}
+	difference := math.Abs(value - previous)
+	return difference != 0 && difference >= deadband
+}
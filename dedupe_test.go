@@ -0,0 +1,123 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSendRules(t *testing.T) {
+	// When
+	rules, err := parseSendRules("16.7.0 deadband=5 min_interval=10s; 1.8.0 deadband=0.5%; 0.0.9 always; default heartbeat=5m")
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	power := rules.policyOf(&Measurement{Ident: "16.7.0"})
+	if power.deadband != 5 || power.relative || power.minInterval != 10*time.Second || power.heartbeat != 5*time.Minute {
+		t.Errorf("Unexpected policy of 16.7.0: %+v", power)
+	}
+	energy := rules.policyOf(&Measurement{Ident: "1.8.0"})
+	if energy.deadband != 0.5 || !energy.relative || energy.heartbeat != 5*time.Minute {
+		t.Errorf("Unexpected policy of 1.8.0: %+v", energy)
+	}
+	if !rules.policyOf(&Measurement{Ident: "0.0.9"}).always {
+		t.Error("Expected 0.0.9 to be sent always")
+	}
+	if other := rules.policyOf(&Measurement{Ident: "2.8.0"}); other.heartbeat != 5*time.Minute || other.deadband != 0 {
+		t.Errorf("Expected default policy of 2.8.0, got %+v", other)
+	}
+}
+
+func TestDefaultSendRules(t *testing.T) {
+	rules, err := parseSendRules("-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy := rules.policyOf(&Measurement{Ident: "1.8.0"}); policy != defaultSendPolicy {
+		t.Errorf("Expected default policy, got %+v", policy)
+	}
+}
+
+func TestParseInvalidSendRules(t *testing.T) {
+	for _, raw := range []string{"1.8.0 deadband=-1", "1.8.0 deadband=x%", "1.8.0 heartbeat=soon", "1.8.0 min_interval=-1s", "1.8.0 always=maybe", "1.8.0 window=1m", "default burst"} {
+		if _, err := parseSendRules(raw); err == nil {
+			t.Errorf("Expected '%s' to be invalid", raw)
+		}
+	}
+}
+
+func TestSendPolicy(t *testing.T) {
+	start := time.Now()
+	previous := Measurement{Value: 1000, Time: start}
+	at := func(offset time.Duration, value float64) Measurement {
+		return Measurement{Value: value, Time: start.Add(offset)}
+	}
+
+	expectations := []struct {
+		policy   sendPolicy
+		measure  Measurement
+		expected bool
+	}{
+		{defaultSendPolicy, at(time.Second, 1000), false},
+		{defaultSendPolicy, at(time.Second, 1001), true},
+		{defaultSendPolicy, at(61*time.Second, 1000), true},
+		{defaultSendPolicy, Measurement{Value: 1000, Text: "on", Time: start.Add(time.Second)}, true},
+		{defaultSendPolicy, Measurement{Value: 1000, Status: 4, Time: start.Add(time.Second)}, true},
+		{sendPolicy{deadband: 5}, at(time.Second, 1004), false},
+		{sendPolicy{deadband: 5}, at(time.Second, 995), true},
+		{sendPolicy{deadband: 1, relative: true}, at(time.Second, 1009), false},
+		{sendPolicy{deadband: 1, relative: true}, at(time.Second, 990), true},
+		{sendPolicy{minInterval: 10 * time.Second}, at(5*time.Second, 2000), false},
+		{sendPolicy{minInterval: 10 * time.Second}, at(10*time.Second, 2000), true},
+		{sendPolicy{heartbeat: 5 * time.Minute}, at(time.Hour, 1000), true},
+		{sendPolicy{}, at(time.Hour, 1000), false},
+		{sendPolicy{always: true}, at(0, 1000), true},
+	}
+
+	for i, e := range expectations {
+		if sent := e.policy.shouldSend(previous, e.measure); sent != e.expected {
+			t.Errorf("Expected #%d with %+v to be sent: %t", i, e.policy, e.expected)
+		}
+	}
+}
+
+func TestShouldSendWithRules(t *testing.T) {
+	// Given
+	previous := _sendRules
+	defer func() { _sendRules = previous }()
+	rules, err := parseSendRules("16.7.0 deadband=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_sendRules = rules
+	now := time.Now()
+
+	// Then
+	if !shouldSendAndMemorize(Measurement{Device: "rules", Ident: "16.7.0", Value: 500, Time: now}, nil) {
+		t.Error("Expected first reading to be sent")
+	}
+	if shouldSendAndMemorize(Measurement{Device: "rules", Ident: "16.7.0", Value: 505, Time: now.Add(time.Second)}, nil) {
+		t.Error("Expected reading within deadband to be skipped")
+	}
+	if !shouldSendAndMemorize(Measurement{Device: "rules", Ident: "16.7.0", Value: 512, Time: now.Add(2 * time.Second)}, nil) {
+		t.Error("Expected reading beyond deadband to be sent")
+	}
+}
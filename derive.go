@@ -0,0 +1,174 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+type powerRule struct {
+	filter identFilter
+	// code of the derived measurement, prefix and suffix are kept from the counter if not given
+	prefix, ident, suffix string
+	// the power is averaged over at least this time
+	interval time.Duration
+	// counter readings further apart are not taken into account, e.g. after the meter was offline
+	maxGap time.Duration
+}
+
+// powerRules derive the average power of counters matching them, the first matching rule applies
+type powerRules []powerRule
+
+var _powerRules powerRules
+
+func selectPowerRules(config map[string]string) powerRules {
+	rules, err := parsePowerRules(config[DerivedPower])
+	if err != nil {
+		printHelpAndExit(fmt.Sprintf("Illegal derived power: %s\n", err))
+	}
+	return rules
+}
+
+// parsePowerRules parses rules like "1.8.0 ident=1.7.0 interval=1m max_gap=5m; 2.8.0 ident=2.7.0",
+// the ident is required as there's no default not colliding with values sent by some meters themselves
+func parsePowerRules(config string) (powerRules, error) {
+	rules, err := parseRules(config)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed := powerRules{}
+	for _, r := range rules {
+		if r.isDefault() {
+			return nil, fmt.Errorf("derived power needs a counter to be derived from")
+		}
+		rule := powerRule{filter: r.filter, interval: time.Minute, maxGap: 5 * time.Minute}
+		for key, value := range r.options {
+			switch key {
+			case "ident":
+				if strings.Contains(value, ":") {
+					rule.prefix, rule.ident, rule.suffix, err = parseObisCode(value)
+				} else if !obisPattern.MatchString(value) || strings.Contains(value, "*") {
+					err = fmt.Errorf("invalid ident '%s', expected like 1.7.0 or 1-0:1.7.0*255", value)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("rule %s: %s", r.filter, err)
+				}
+				if rule.ident == "" {
+					rule.ident = value
+				}
+			case "interval":
+				if rule.interval, err = time.ParseDuration(value); err != nil || rule.interval <= 0 {
+					return nil, fmt.Errorf("illegal interval %s of rule %s", value, r.filter)
+				}
+			case "max_gap":
+				if rule.maxGap, err = time.ParseDuration(value); err != nil || rule.maxGap <= 0 {
+					return nil, fmt.Errorf("illegal max_gap %s of rule %s", value, r.filter)
+				}
+			default:
+				return nil, fmt.Errorf("unknown option '%s' of rule %s, expected ident, interval or max_gap", key, r.filter)
+			}
+		}
+		if rule.ident == "" {
+			return nil, fmt.Errorf("missing ident of rule %s, e.g. ident=1.7.0 for 1.8.0", r.filter)
+		}
+		if rule.maxGap < rule.interval {
+			return nil, fmt.Errorf("max_gap of rule %s is shorter than its interval", r.filter)
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
+
+func (r powerRules) ruleOf(measure *Measurement) *powerRule {
+	if measure.Type != NumberValue || measure.Aggregate != "" {
+		return nil
+	}
+	for i := range r {
+		if r[i].filter.matches(measure) {
+			return &r[i]
+		}
+	}
+	return nil
+}
+
+// deriver calculates the average power from the deltas of successive counter readings
+type deriver struct {
+	rules powerRules
+	// reading the current interval started with, per counter
+	baselines map[string]Measurement
+}
+
+func newDeriver(rules powerRules) *deriver {
+	return &deriver{rules: rules, baselines: map[string]Measurement{}}
+}
+
+// derive returns the power since the baseline once the rule's interval passed,
+// counter resets and gaps start a new interval without deriving anything
+func (d *deriver) derive(measure Measurement) (Measurement, bool) {
+	rule := d.rules.ruleOf(&measure)
+	if rule == nil {
+		return Measurement{}, false
+	}
+
+	key := measure.key()
+	baseline, ok := d.baselines[key]
+	if !ok {
+		d.baselines[key] = measure
+		return Measurement{}, false
+	}
+
+	elapsed := measure.Time.Sub(baseline.Time)
+	delta := measure.Value - baseline.Value
+	switch {
+	case elapsed < 0 || elapsed > rule.maxGap:
+		debug("Gap of counter", &measure)
+		d.baselines[key] = measure
+		return Measurement{}, false
+	case delta < 0:
+		log.Printf("Counter %s of %s went back from %f to %f, deriving power anew\n", measure.Ident, measure.Device, baseline.Value, measure.Value)
+		d.baselines[key] = measure
+		return Measurement{}, false
+	case elapsed < rule.interval:
+		return Measurement{}, false
+	}
+	d.baselines[key] = measure
+
+	power := measure
+	power.Ident = rule.ident
+	if rule.prefix != "" {
+		power.Prefix, power.Suffix = rule.prefix, rule.suffix
+	}
+	power.Value = delta / elapsed.Hours()
+	power.Status, power.HasStatus = 0, false
+	// energy in Wh or kWh results in W or kW, volumes like m3 in m3/h
+	if unit, isEnergy := strings.CutSuffix(measure.Unit, "h"); isEnergy {
+		power.Unit = unit
+	} else if measure.Unit != "" {
+		power.Unit = measure.Unit + "/h"
+	}
+	power.Name = ""
+	if entry, ok := _obisCatalogue.lookup(&power); ok {
+		power.Name = entry.Name
+	}
+	debug("Derived", &power)
+	return power, true
+}
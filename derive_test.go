@@ -0,0 +1,150 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParsePowerRules(t *testing.T) {
+	// When
+	rules, err := parsePowerRules("1.8.0 ident=1.7.0; 2.8.* ident=1-0:2.7.0*255 interval=10s max_gap=1m; 7-0:3.0.0 ident=3.7.0")
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := rules[0]; r.ident != "1.7.0" || r.prefix != "" || r.interval != time.Minute || r.maxGap != 5*time.Minute {
+		t.Errorf("Unexpected rule with defaults %+v", r)
+	}
+	if r := rules[1]; r.ident != "2.7.0" || r.prefix != "1-0" || r.suffix != "255" || r.interval != 10*time.Second || r.maxGap != time.Minute {
+		t.Errorf("Unexpected configured rule %+v", r)
+	}
+	if r := rules[2]; r.ident != "3.7.0" {
+		t.Errorf("Unexpected gas rule %+v", r)
+	}
+}
+
+func TestParseInvalidPowerRules(t *testing.T) {
+	for _, raw := range []string{
+		"default interval=1m",
+		"*.8.0",
+		"1.8.0",
+		"7-0:3.0.0",
+		"1.8.0 ident=power",
+		"1.8.0 ident=1.7.0*255",
+		"1.8.0 ident=1.7.0 interval=0s",
+		"1.8.0 ident=1.7.0 interval=10m",
+		"1.8.0 ident=1.7.0 max_gap=soon",
+		"1.8.0 ident=1.7.0 scale=1000",
+	} {
+		if _, err := parsePowerRules(raw); err == nil {
+			t.Errorf("Expected '%s' to be invalid", raw)
+		}
+	}
+}
+
+func TestDerivePower(t *testing.T) {
+	// Given
+	rules, _ := parsePowerRules("1.8.0 ident=1.7.0 interval=1m")
+	deriver := newDeriver(rules)
+	start := time.Now()
+	counter := func(offset time.Duration, value float64) Measurement {
+		return Measurement{Device: "home", Prefix: "1-0", Ident: "1.8.0", Suffix: "255", Unit: "Wh", Type: NumberValue, Value: value, Time: start.Add(offset)}
+	}
+
+	// When
+	if _, ok := deriver.derive(counter(0, 10000)); ok {
+		t.Error("Expected first reading to be the baseline")
+	}
+	if _, ok := deriver.derive(counter(30*time.Second, 10005)); ok {
+		t.Error("Expected nothing derived within interval")
+	}
+	power, ok := deriver.derive(counter(time.Minute, 10020))
+
+	// Then
+	if !ok || power.Ident != "1.7.0" || power.Prefix != "1-0" || power.Unit != "W" || math.Abs(power.Value-1200) > 1e-9 {
+		t.Errorf("Expected 1200 W as 1.7.0, got %+v", power)
+	}
+	if power.Name != "power_import" || power.Device != "home" || !power.Time.Equal(start.Add(time.Minute)) {
+		t.Errorf("Unexpected name, device or time %+v", power)
+	}
+}
+
+func TestDerivePowerOfResetCounter(t *testing.T) {
+	// Given
+	rules, _ := parsePowerRules("1.8.0 ident=1.7.0 interval=10s")
+	deriver := newDeriver(rules)
+	start := time.Now()
+	counter := func(offset time.Duration, value float64) Measurement {
+		return Measurement{Ident: "1.8.0", Unit: "kWh", Type: NumberValue, Value: value, Time: start.Add(offset)}
+	}
+	deriver.derive(counter(0, 500))
+
+	// When
+	_, afterReset := deriver.derive(counter(10*time.Second, 2))
+	power, ok := deriver.derive(counter(20*time.Second, 2.01))
+
+	// Then
+	if afterReset {
+		t.Error("Expected nothing derived of a reset counter")
+	}
+	if !ok || power.Unit != "kW" || math.Abs(power.Value-3.6) > 1e-9 {
+		t.Errorf("Expected 3.6 kW after reset, got %+v", power)
+	}
+}
+
+func TestDerivePowerAfterGap(t *testing.T) {
+	// Given
+	rules, _ := parsePowerRules("7-0:3.0.0 ident=3.7.0 interval=1m max_gap=10m")
+	deriver := newDeriver(rules)
+	start := time.Now()
+	counter := func(offset time.Duration, value float64) Measurement {
+		return Measurement{Prefix: "7-0", Ident: "3.0.0", Suffix: "255", Unit: "m3", Type: NumberValue, Value: value, Time: start.Add(offset)}
+	}
+	deriver.derive(counter(0, 100))
+
+	// When
+	_, afterGap := deriver.derive(counter(time.Hour, 101))
+	flow, ok := deriver.derive(counter(time.Hour+6*time.Minute, 101.1))
+
+	// Then
+	if afterGap {
+		t.Error("Expected nothing derived after a gap")
+	}
+	if !ok || flow.Ident != "3.7.0" || flow.Unit != "m3/h" || math.Abs(flow.Value-1) > 1e-9 {
+		t.Errorf("Expected 1 m3/h, got %+v", flow)
+	}
+}
+
+func TestDeriveIgnoresOtherMeasurements(t *testing.T) {
+	rules, _ := parsePowerRules("1.8.0 ident=1.7.0")
+	deriver := newDeriver(rules)
+	for _, m := range []Measurement{
+		{Ident: "2.8.0", Type: NumberValue, Time: time.Now()},
+		{Ident: "1.8.0", Type: StringValue, Time: time.Now()},
+		{Ident: "1.8.0", Type: NumberValue, Aggregate: AggregateMean, Time: time.Now()},
+	} {
+		deriver.derive(m)
+	}
+	if len(deriver.baselines) != 0 {
+		t.Errorf("Expected no baselines, got %v", deriver.baselines)
+	}
+}
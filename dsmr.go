@@ -0,0 +1,253 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var errDsmrChecksum = errors.New("checksum mismatch")
+
+// lines like "1-0:1.8.1(123456.789*kWh)" or "0-1:24.2.1(101209112500W)(12785.123*m3)"
+var dsmrLine = regexp.MustCompile(`^(\d+)-(\d+):(\d+\.\d+\.\d+)(?:\*(\d+))?((?:\([^()]*\))+)$`)
+
+// DSMR timestamps are local dutch time, flagged as summer (S) or winter (W) time
+var dsmrTimeZones = map[byte]*time.Location{
+	'S': time.FixedZone("CEST", 2*60*60),
+	'W': time.FixedZone("CET", 60*60),
+}
+
+// dsmrListener returns the blocking listener reading DSMR P1 telegrams from the device of the meter
+func dsmrListener(m *meter) func() {
+	listenToFile := func(file *os.File) int {
+		return listenDsmr(m, file)
+	}
+
+	if path, isReplay := strings.CutPrefix(m.device, ReplayScheme); isReplay {
+		return func() {
+			replay(path, m.replayInterval, listenToFile)
+		}
+	}
+
+	if address, isSocket := strings.CutPrefix(m.device, SocketScheme); isSocket {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			printHelpAndExit(fmt.Sprintf("Illegal socket address %s: %s\n", m.device, err))
+		}
+		return func() {
+			listenToSocket(address, listenToFile)
+		}
+	}
+
+	if err := checkSerialConfig(m.baudRate, m.mode); err != nil {
+		printHelpAndExit(fmt.Sprintf("Illegal configuration of device %s: %s\n", m.device, err))
+	}
+
+	return func() {
+		superviseDevice(m, func(path string) (*os.File, error) {
+			fmt.Printf("Listen to %s (%s)\n", path, m.name)
+			return openSerial(path, m.baudRate, m.mode)
+		}, listenToFile)
+	}
+}
+
+// listenDsmr reads telegrams until the reader ends or fails, telegrams failing the checksum are skipped
+func listenDsmr(m *meter, reader io.Reader) int {
+	buffered := bufio.NewReader(reader)
+	for {
+		telegram, err := readDsmrTelegram(buffered)
+		if errors.Is(err, errDsmrChecksum) {
+			log.Printf("Skipped DSMR telegram of %s: %s\n", m.name, err)
+			m.stats.count(CrcError)
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Failed reading DSMR telegram of %s: %s\n", m.name, err)
+			}
+			return 0
+		}
+
+		m.stats.count(FrameOk)
+		if _capture != nil {
+			_capture.write(telegram)
+		}
+		for _, measure := range parseDsmrTelegram(telegram, time.Now()) {
+			m.emit(measure)
+		}
+	}
+}
+
+// readDsmrTelegram reads from the header like "/ISK5\2M550T-1012" up to the footer "!EF2F",
+// validating the CRC of DSMR 4 and later, earlier versions don't send one
+func readDsmrTelegram(reader *bufio.Reader) ([]byte, error) {
+	var telegram bytes.Buffer
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+		if telegram.Len() == 0 {
+			start := bytes.IndexByte(line, '/')
+			if start < 0 {
+				continue
+			}
+			line = line[start:]
+		}
+		telegram.Write(line)
+
+		if footer, isEnd := bytes.CutPrefix(line, []byte("!")); isEnd {
+			crc := strings.TrimSpace(string(footer))
+			if crc == "" {
+				return telegram.Bytes(), nil
+			}
+			// the CRC covers everything from '/' up to and including '!'
+			data := telegram.Bytes()[:telegram.Len()-len(footer)]
+			if expected := fmt.Sprintf("%04X", dsmrCrc16(data)); !strings.EqualFold(crc, expected) {
+				return nil, fmt.Errorf("%w: got %s, expected %s", errDsmrChecksum, crc, expected)
+			}
+			return telegram.Bytes(), nil
+		}
+	}
+}
+
+// dsmrCrc16 is CRC-16/ARC, polynomial 0x8005 reflected with zero init
+func dsmrCrc16(data []byte) uint16 {
+	crc := uint16(0)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for range 8 {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// parseDsmrTelegram parses the value lines of a telegram, M-Bus values like gas and water are stamped
+// with their own capture time, all others with the telegram's time if meter time is configured
+func parseDsmrTelegram(telegram []byte, received time.Time) []Measurement {
+	lines := strings.Split(string(telegram), "\n")
+
+	measured := received
+	for _, line := range lines {
+		if value, isTime := strings.CutPrefix(strings.TrimSpace(line), "0-0:1.0.0("); isTime && _timeSource == MeterTime {
+			if telegramTime, ok := parseDsmrTime(strings.TrimSuffix(value, ")")); ok {
+				measured = telegramTime
+			}
+		}
+	}
+
+	measurements := []Measurement{}
+	for _, line := range lines {
+		if measure, ok := parseDsmrLine(strings.TrimSpace(line), measured); ok {
+			measurements = append(measurements, measure)
+		}
+	}
+	return measurements
+}
+
+func parseDsmrLine(line string, measured time.Time) (Measurement, bool) {
+	parts := dsmrLine.FindStringSubmatch(line)
+	if parts == nil {
+		return Measurement{}, false
+	}
+
+	measure := Measurement{
+		Prefix: parts[1] + "-" + parts[2],
+		Ident:  parts[3],
+		Suffix: parts[4],
+		Time:   measured,
+	}
+	if measure.Suffix == "" {
+		measure.Suffix = "255"
+	}
+
+	values := strings.Split(strings.Trim(parts[5], "()"), ")(")
+	switch {
+	case len(values) == 2:
+		// M-Bus values like "(101209112500W)(12785.123*m3)" come with their capture time
+		capture, ok := parseDsmrTime(values[0])
+		if !ok {
+			return Measurement{}, false
+		}
+		measure.Time = capture
+	case len(values) == 1:
+		if _, isTime := parseDsmrTime(values[0]); isTime {
+			return Measurement{}, false
+		}
+	default:
+		// logs like the power failure event log aren't forwarded
+		return Measurement{}, false
+	}
+
+	value, unit, _ := strings.Cut(values[len(values)-1], "*")
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		measure.Type = NumberValue
+		measure.Value = number
+		measure.Unit = unit
+	} else if value != "" {
+		measure.Type = StringValue
+		measure.Text = decodeDsmrText(value)
+	} else {
+		return Measurement{}, false
+	}
+	return measure, true
+}
+
+// parseDsmrTime parses timestamps like "101209113020W"
+func parseDsmrTime(value string) (time.Time, bool) {
+	if len(value) != 13 {
+		return time.Time{}, false
+	}
+	location, ok := dsmrTimeZones[value[12]]
+	if !ok {
+		return time.Time{}, false
+	}
+	parsed, err := time.ParseInLocation("060102150405", value[:12], location)
+	return parsed, err == nil
+}
+
+// decodeDsmrText decodes the hex encoded texts like the equipment identifier, others are passed as they are
+func decodeDsmrText(value string) string {
+	decoded, err := hex.DecodeString(value)
+	if err != nil {
+		return value
+	}
+	for _, r := range string(decoded) {
+		if r > unicode.MaxASCII || !unicode.IsPrint(r) {
+			return value
+		}
+	}
+	return string(decoded)
+}
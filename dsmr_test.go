@@ -0,0 +1,189 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+const dsmrTestBody = "/ISK5\\2M550T-1012\r\n" +
+	"\r\n" +
+	"1-3:0.2.8(50)\r\n" +
+	"0-0:1.0.0(101209113020W)\r\n" +
+	"0-0:96.1.1(4B384547303034303436333935353037)\r\n" +
+	"1-0:1.8.1(123456.789*kWh)\r\n" +
+	"1-0:1.8.2(123456.789*kWh)\r\n" +
+	"1-0:2.8.1(000012.345*kWh)\r\n" +
+	"1-0:2.8.2(000023.456*kWh)\r\n" +
+	"0-0:96.14.0(0002)\r\n" +
+	"1-0:1.7.0(01.193*kW)\r\n" +
+	"1-0:2.7.0(00.000*kW)\r\n" +
+	"0-0:96.7.21(00004)\r\n" +
+	"1-0:99.97.0(2)(0-0:96.7.19)(101208152415W)(0000000240*s)(101208151004W)(0000000301*s)\r\n" +
+	"1-0:21.7.0(00.111*kW)\r\n" +
+	"1-0:41.7.0(00.222*kW)\r\n" +
+	"1-0:61.7.0(00.860*kW)\r\n" +
+	"0-1:24.1.0(003)\r\n" +
+	"0-1:24.2.1(101209112500W)(12785.123*m3)\r\n" +
+	"!"
+
+// dsmrTestTelegram appends the CRC to the telegram
+func dsmrTestTelegram(body string) string {
+	return fmt.Sprintf("%s%04X\r\n", body, dsmrCrc16([]byte(body)))
+}
+
+func TestDsmrCrc16(t *testing.T) {
+	if crc := dsmrCrc16([]byte("123456789")); crc != 0xbb3d {
+		t.Errorf("Expected 0xbb3d, got %#04x", crc)
+	}
+}
+
+func TestReadDsmrTelegram(t *testing.T) {
+	// Given
+	telegram := dsmrTestTelegram(dsmrTestBody)
+
+	// When
+	read, err := readDsmrTelegram(bufio.NewReader(strings.NewReader("garbage\r\n" + telegram)))
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(read) != telegram {
+		t.Errorf("Unexpected telegram %q", read)
+	}
+}
+
+func TestReadCorruptDsmrTelegram(t *testing.T) {
+	// Given
+	telegram := strings.Replace(dsmrTestTelegram(dsmrTestBody), "1.193", "9.193", 1)
+
+	// When
+	_, err := readDsmrTelegram(bufio.NewReader(strings.NewReader(telegram)))
+
+	// Then
+	if err == nil {
+		t.Error("Expected checksum to fail")
+	}
+}
+
+func TestReadDsmrTelegramWithoutCrc(t *testing.T) {
+	// DSMR before version 4 doesn't send a CRC
+	if _, err := readDsmrTelegram(bufio.NewReader(strings.NewReader(dsmrTestBody + "\r\n"))); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseDsmrTelegram(t *testing.T) {
+	// Given
+	received := time.Now()
+
+	// When
+	measurements := parseDsmrTelegram([]byte(dsmrTestTelegram(dsmrTestBody)), received)
+
+	// Then
+	byKey := map[string]Measurement{}
+	for _, measure := range measurements {
+		byKey[measure.Prefix+":"+measure.Ident+"*"+measure.Suffix] = measure
+	}
+	if len(byKey) != 15 {
+		t.Errorf("Expected 15 measurements, got %d", len(byKey))
+	}
+	if _, ok := byKey["0-0:1.0.0*255"]; ok {
+		t.Error("Expected telegram time not to be forwarded")
+	}
+	if _, ok := byKey["1-0:99.97.0*255"]; ok {
+		t.Error("Expected power failure log not to be forwarded")
+	}
+
+	tariff2 := byKey["1-0:1.8.2*255"]
+	if tariff2.Value != 123456.789 || tariff2.Unit != "kWh" || !tariff2.Time.Equal(received) {
+		t.Errorf("Unexpected tariff 2 %+v", tariff2)
+	}
+	l3 := byKey["1-0:61.7.0*255"]
+	if l3.Value != 0.86 || l3.Unit != "kW" {
+		t.Errorf("Unexpected power of L3 %+v", l3)
+	}
+	equipment := byKey["0-0:96.1.1*255"]
+	if equipment.Type != StringValue || equipment.Text != "K8EG004046395507" {
+		t.Errorf("Unexpected equipment identifier %+v", equipment)
+	}
+
+	gas := byKey["0-1:24.2.1*255"]
+	captured := time.Date(2010, 12, 9, 11, 25, 0, 0, time.FixedZone("CET", 60*60))
+	if gas.Value != 12785.123 || gas.Unit != "m3" || !gas.Time.Equal(captured) {
+		t.Errorf("Unexpected gas %+v", gas)
+	}
+}
+
+func TestParseDsmrTelegramWithMeterTime(t *testing.T) {
+	// Given
+	defer withTimeSource(MeterTime)()
+
+	// When
+	measurements := parseDsmrTelegram([]byte(dsmrTestTelegram(dsmrTestBody)), time.Now())
+
+	// Then
+	telegramTime := time.Date(2010, 12, 9, 11, 30, 20, 0, time.FixedZone("CET", 60*60))
+	if !measurements[0].Time.Equal(telegramTime) {
+		t.Errorf("Expected the telegram time, got %s", measurements[0].Time)
+	}
+}
+
+func TestParseDsmrTime(t *testing.T) {
+	summer, ok := parseDsmrTime("230701120000S")
+	if !ok || !summer.Equal(time.Date(2023, 7, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected summer time %s", summer)
+	}
+
+	for _, value := range []string{"", "230701120000", "230701120000X", "231301120000W"} {
+		if _, ok := parseDsmrTime(value); ok {
+			t.Errorf("Expected '%s' to be invalid", value)
+		}
+	}
+}
+
+func TestListenDsmr(t *testing.T) {
+	// Given
+	corrupt := strings.Replace(dsmrTestTelegram(dsmrTestBody), "1.193", "9.193", 1)
+	stream := corrupt + dsmrTestTelegram("/ISK5\\2M550T-1012\r\n\r\n1-0:1.7.0(01.193*kW)\r\n!")
+
+	m := &meter{name: "p1"}
+
+	// When
+	exitCode := listenDsmr(m, bytes.NewReader([]byte(stream)))
+
+	// Then
+	if exitCode != 0 {
+		t.Error()
+	}
+	if measure := <-_messages; measure.Ident != "1.7.0" || measure.Value != 1.193 || measure.Device != "p1" {
+		t.Errorf("Unexpected measurement %+v", measure)
+	}
+	if len(_messages) != 0 {
+		t.Error("Expected the corrupt telegram to be skipped")
+	}
+	if m.stats.crcErrors.Load() != 1 || m.stats.framesOk.Load() != 1 {
+		t.Errorf("Unexpected stats %s", &m.stats)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// OBIS patterns like "1-0:1.8.0*255", "1.8.0", "1-0:*.8.*" or "96.*.*"
+var obisPattern = regexp.MustCompile(`^(?:(\d+|\*)-(\d+|\*):)?([0-9A-Za-z]+|\*)\.([0-9A-Za-z]+|\*)\.([0-9A-Za-z]+|\*)(?:\*(\d+|\*))?$`)
+
+// name patterns like "power_active" or "energy_*"
+var namePattern = regexp.MustCompile(`^[0-9A-Za-z_*]*[A-Za-z_][0-9A-Za-z_*]*$`)
+
+// filterRule matches a single pattern of the ident filter
+type filterRule struct {
+	pattern string
+	exclude bool
+	// matched against the full OBIS code "A-B:C.D.E*F"
+	code *regexp.Regexp
+	// matched against the catalogued name
+	name *regexp.Regexp
+}
+
+// identFilter forwards measurements matching any of its including rules, or all if there are none,
+// unless they match an excluding one
+type identFilter []filterRule
+
+// parseIdentFilter parses comma separated patterns, each of them one of
+//
+//	1.8.0            ident of any prefix and suffix
+//	1-0:1.8.0*255    full OBIS code, without suffix for any suffix
+//	1-0:*.8.*        '*' matching any value of a group
+//	power_active     name of the OBIS catalogue, '*' matching any characters
+//	~^1-0:[12]\.8\.  regular expression matched against the full code and the name
+//
+// patterns prefixed by '!' exclude the measurements they match
+func parseIdentFilter(filter string) (identFilter, error) {
+	rules := identFilter{}
+	for _, pattern := range splitFilterPatterns(filter) {
+		rule, err := parseFilterRule(pattern)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// splitFilterPatterns splits at commas like toFilterList, except for escaped ones and those within
+// the braces or brackets of a regular expression, like in ~^1-0:[12]\.8\.[0-9]{1,2}
+func splitFilterPatterns(filter string) []string {
+	patterns := []string{}
+	add := func(pattern string) {
+		if pattern = strings.TrimSpace(pattern); pattern != "" && pattern != "-" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	start, depth := 0, 0
+	for i := 0; i < len(filter); i++ {
+		switch filter[i] {
+		case '\\':
+			i++
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth = max(depth-1, 0)
+		case ',':
+			if depth == 0 {
+				add(filter[start:i])
+				start = i + 1
+			}
+		}
+	}
+	add(filter[start:])
+	return patterns
+}
+
+func parseFilterRule(pattern string) (filterRule, error) {
+	rule := filterRule{pattern: pattern}
+	pattern, rule.exclude = strings.CutPrefix(pattern, "!")
+
+	if expression, isRegexp := strings.CutPrefix(pattern, "~"); isRegexp {
+		compiled, err := regexp.Compile(expression)
+		if err != nil {
+			return filterRule{}, fmt.Errorf("invalid regular expression '%s': %s", rule.pattern, err)
+		}
+		rule.code = compiled
+		rule.name = compiled
+		return rule, nil
+	}
+
+	if groups := obisPattern.FindStringSubmatch(pattern); groups != nil {
+		expression := "^"
+		if groups[1] == "" {
+			expression += `[^:]+`
+		} else {
+			expression += globGroup(groups[1]) + "-" + globGroup(groups[2])
+		}
+		expression += ":" + globGroup(groups[3]) + `\.` + globGroup(groups[4]) + `\.` + globGroup(groups[5])
+		if groups[6] == "" {
+			expression += `\*[^*]+`
+		} else {
+			expression += `\*` + globGroup(groups[6])
+		}
+		rule.code = regexp.MustCompile(expression + "$")
+		return rule, nil
+	}
+
+	if namePattern.MatchString(pattern) {
+		rule.name = regexp.MustCompile("^" + strings.ReplaceAll(pattern, "*", ".*") + "$")
+		return rule, nil
+	}
+
+	return filterRule{}, fmt.Errorf("invalid filter pattern '%s', expected an OBIS code like 1-0:1.8.0*255 or 1.8.*, a name like power_active or a regular expression like ~^1-0:1\\.8", rule.pattern)
+}
+
+// globGroup matches any value of a group for '*', the literal value otherwise
+func globGroup(group string) string {
+	if group == "*" {
+		return `[^-:.*]+`
+	}
+	return regexp.QuoteMeta(group)
+}
+
+func (r filterRule) matches(measure *Measurement) bool {
+	return r.code != nil && r.code.MatchString(measure.fullCode()) ||
+		r.name != nil && measure.Name != "" && r.name.MatchString(measure.Name)
+}
+
+// matches tells whether the measurement is relevant
+func (f identFilter) matches(measure *Measurement) bool {
+	included, hasIncludes := false, false
+	for _, rule := range f {
+		if rule.exclude {
+			if rule.matches(measure) {
+				return false
+			}
+			continue
+		}
+		hasIncludes = true
+		included = included || rule.matches(measure)
+	}
+	return included || !hasIncludes
+}
+
+// String lists the patterns like configured
+func (f identFilter) String() string {
+	patterns := make([]string, len(f))
+	for i, rule := range f {
+		patterns[i] = rule.pattern
+	}
+	return strings.Join(patterns, ",")
+}
@@ -0,0 +1,127 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func mustParseIdentFilter(t *testing.T, filter string) identFilter {
+	t.Helper()
+	parsed, err := parseIdentFilter(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestIdentFilterWithIdents(t *testing.T) {
+	// Given
+	filter := mustParseIdentFilter(t, "1.8.1, 2.4.1")
+
+	// When && Then
+	for ident, expected := range map[string]bool{"2.8.1": false, "1.8": false, "1.8.1": true, "2.4.1": true} {
+		if filter.matches(&Measurement{Prefix: "1-0", Ident: ident, Suffix: "255"}) != expected {
+			t.Errorf("Expected %s to match: %t", ident, expected)
+		}
+	}
+}
+
+func TestEmptyIdentFilter(t *testing.T) {
+	for _, raw := range []string{"", "-"} {
+		if !mustParseIdentFilter(t, raw).matches(&Measurement{Ident: "1.2.3"}) {
+			t.Errorf("Expected '%s' to match everything", raw)
+		}
+	}
+	var unset identFilter
+	if !unset.matches(&Measurement{Ident: "1.2.3"}) {
+		t.Error("Expected nil filter to match everything")
+	}
+}
+
+func TestIdentFilterPatterns(t *testing.T) {
+	importTotal := Measurement{Prefix: "1-0", Ident: "1.8.0", Suffix: "255", Name: "energy_import_total"}
+	importBilling := Measurement{Prefix: "1-0", Ident: "1.8.0", Suffix: "1"}
+	exportTariff := Measurement{Prefix: "1-0", Ident: "2.8.1", Suffix: "255", Name: "energy_export_tariff1"}
+	power := Measurement{Prefix: "1-0", Ident: "16.7.0", Suffix: "255", Name: "power_active"}
+	d0Import := Measurement{Ident: "1.8.0"}
+	gas := Measurement{Prefix: "0-1", Ident: "24.2.1", Suffix: "255"}
+	equipment := Measurement{Prefix: "0-0", Ident: "96.1.1", Suffix: "255"}
+
+	expectations := []struct {
+		filter  string
+		matches []Measurement
+		skips   []Measurement
+	}{
+		{"1.8.0", []Measurement{importTotal, importBilling, d0Import}, []Measurement{exportTariff, power}},
+		{"1-0:1.8.0*255", []Measurement{importTotal, d0Import}, []Measurement{importBilling, exportTariff}},
+		{"1-0:1.8.0", []Measurement{importTotal, importBilling}, []Measurement{gas}},
+		{"1-0:1.8.0**", []Measurement{importTotal, importBilling}, []Measurement{exportTariff}},
+		{"1-0:*.8.*", []Measurement{importTotal, importBilling, exportTariff}, []Measurement{power}},
+		{"*-1:*.*.*", []Measurement{gas}, []Measurement{importTotal, equipment}},
+		{"!96.*.*", []Measurement{importTotal, gas, power}, []Measurement{equipment}},
+		{"*.8.*, !2.8.*", []Measurement{importTotal, importBilling}, []Measurement{exportTariff, power}},
+		{"power_active", []Measurement{power}, []Measurement{importTotal, importBilling}},
+		{"energy_*", []Measurement{importTotal, exportTariff}, []Measurement{importBilling, power}},
+		{"!energy_export_*", []Measurement{importTotal, power, gas}, []Measurement{exportTariff}},
+		{`~^1-0:[12]\.8\.`, []Measurement{importTotal, exportTariff}, []Measurement{power, gas}},
+		{`~^power_`, []Measurement{power}, []Measurement{importTotal}},
+		{`~^1-0:1\.8\.[0-9]{1,2}\*255$, power_*`, []Measurement{importTotal, power}, []Measurement{importBilling, exportTariff}},
+		{`~^0-[0-9]:(24\.2\.1|96\.1\.1)\*, ~energy_[a-z]+\,?export`, []Measurement{gas, equipment}, []Measurement{importTotal, exportTariff}},
+	}
+
+	for _, e := range expectations {
+		// Given
+		filter := mustParseIdentFilter(t, e.filter)
+
+		// When && Then
+		for _, m := range e.matches {
+			if !filter.matches(&m) {
+				t.Errorf("Expected '%s' to match %s", e.filter, m.fullCode())
+			}
+		}
+		for _, m := range e.skips {
+			if filter.matches(&m) {
+				t.Errorf("Expected '%s' not to match %s", e.filter, m.fullCode())
+			}
+		}
+	}
+}
+
+func TestInvalidIdentFilter(t *testing.T) {
+	for _, raw := range []string{"1.8", "1-0:1.8.0*", "1-0:1.8.0*a", "1-0:1.8*.0", "1:1.8.0", "!", "~[", "energy-import", "1.8.0,*"} {
+		if _, err := parseIdentFilter(raw); err == nil {
+			t.Errorf("Expected '%s' to be invalid", raw)
+		}
+	}
+}
+
+func TestSplitFilterPatterns(t *testing.T) {
+	for filter, expected := range map[string][]string{
+		"1.8.0, ,2.8.0":        {"1.8.0", "2.8.0"},
+		"-":                    {},
+		`~[0-9]{1,2}, 1.8.0`:   {`~[0-9]{1,2}`, "1.8.0"},
+		`~a[,;]b,~c\,d , !e_*`: {`~a[,;]b`, `~c\,d`, "!e_*"},
+		`~\[,1.8.0`:            {`~\[`, "1.8.0"},
+	} {
+		if patterns := splitFilterPatterns(filter); !slices.Equal(patterns, expected) {
+			t.Errorf("Expected '%s' to be split into %q, got %q", filter, expected, patterns)
+		}
+	}
+}
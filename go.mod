@@ -5,8 +5,10 @@ go 1.26
 require (
 	github.com/go-sql-driver/mysql v1.10.0
 	github.com/influxdata/influxdb-client-go/v2 v2.14.0
+	github.com/lib/pq v1.10.9
 	github.com/nsqio/go-diskqueue v1.1.1-0.20211017194114-cc41549f81d5
 	github.com/testcontainers/testcontainers-go v0.42.0
+	golang.org/x/sys v0.44.0
 )
 
 require (
@@ -63,6 +65,5 @@ require (
 	go.opentelemetry.io/otel/trace v1.41.0 // indirect
 	golang.org/x/crypto v0.51.0 // indirect
 	golang.org/x/net v0.54.0 // indirect
-	golang.org/x/sys v0.44.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
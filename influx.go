@@ -21,42 +21,109 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"sync/atomic"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
 	"github.com/influxdata/influxdb-client-go/v2/api/write"
 )
 
+type influxBackend struct {
+	client      influxdb2.Client
+	writeAPI    api.WriteAPIBlocking
+	measurement string
+	healthy     atomic.Bool
+}
+
 func InitializeInflux(
 	influxUrl string,
 	influxToken string,
 	influxOrg string,
 	influxBucket string,
 	influxMeasurement string,
-) func(measurement Measurement) bool {
+) *influxBackend {
 	fmt.Printf("Init Influx for %s at %s\n", influxOrg, influxUrl)
 
 	influxClient := influxdb2.NewClient(influxUrl, influxToken)
-	writeAPI := influxClient.WriteAPIBlocking(influxOrg, influxBucket)
-
-	sender := func(measurement Measurement) bool {
-		tags := map[string]string{
-			"ident":  measurement.Ident,
-			"unit":   measurement.Unit,
-			"prefix": measurement.Prefix,
-			"suffix": measurement.Suffix,
-		}
-		fields := map[string]any{
-			"value": measurement.Value,
-		}
-		debug("Sending to influx", &measurement)
-		point := write.NewPoint(influxMeasurement, tags, fields, measurement.Time)
-		err := writeAPI.WritePoint(context.Background(), point)
-		if err != nil {
-			log.Printf("Failed sending to influx %s\n", err)
-			return false
-		}
-		return true
-	}
-
-	return sender
+	return &influxBackend{
+		client:      influxClient,
+		writeAPI:    influxClient.WriteAPIBlocking(influxOrg, influxBucket),
+		measurement: influxMeasurement,
+	}
+}
+
+func (b *influxBackend) Name() string {
+	return Influx
+}
+
+// Init does nothing, as the client connects on writing
+func (b *influxBackend) Init() error {
+	return nil
+}
+
+func (b *influxBackend) Send(measurement Measurement) bool {
+	return b.SendBatch([]Measurement{measurement})
+}
+
+// SendBatch writes all points with a single request
+func (b *influxBackend) SendBatch(measurements []Measurement) bool {
+	points := make([]*write.Point, len(measurements))
+	for i := range measurements {
+		debug("Sending to influx", &measurements[i])
+		points[i] = b.point(measurements[i])
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	err := b.writeAPI.WritePoint(ctx, points...)
+	b.healthy.Store(err == nil)
+	if err != nil {
+		log.Printf("Failed sending to influx %s\n", err)
+		return false
+	}
+	return true
+}
+
+func (b *influxBackend) Healthy() bool {
+	return b.healthy.Load()
+}
+
+func (b *influxBackend) Close() {
+	b.client.Close()
+}
+
+func (b *influxBackend) point(measurement Measurement) *write.Point {
+	tags := map[string]string{
+		"ident":  measurement.Ident,
+		"unit":   measurement.Unit,
+		"prefix": measurement.Prefix,
+		"suffix": measurement.Suffix,
+	}
+	if measurement.ServerId != "" {
+		tags["server_id"] = measurement.ServerId
+	}
+	if measurement.Device != "" {
+		tags["device"] = measurement.Device
+	}
+	if measurement.Name != "" {
+		tags["obis_name"] = measurement.Name
+	}
+	// separate fields per type, as a field can't hold different types
+	fields := map[string]any{}
+	switch measurement.Type {
+	case StringValue:
+		fields["text"] = measurement.Text
+	case BoolValue:
+		fields["flag"] = measurement.Value != 0
+	default:
+		fields["value"] = measurement.Value
+	}
+	// statistics of an aggregated window are merged into one point of separate fields like "mean" and "max"
+	if measurement.Aggregate != "" {
+		delete(fields, "value")
+		fields[measurement.Aggregate] = measurement.Value
+	}
+	if measurement.HasStatus {
+		fields["status"] = measurement.Status
+	}
+	return write.NewPoint(b.measurement, tags, fields, measurement.Time)
 }
@@ -34,7 +34,7 @@ func TestFailingInfluxSend(t *testing.T) {
 	m := Measurement{}
 
 	// When
-	success := sender(m)
+	success := sender.Send(m)
 
 	// Then
 	if success != false {
@@ -71,26 +71,27 @@ func TestSuccessfulInfluxSend(t *testing.T) {
 
 	// Given
 	influxUrl := fmt.Sprintf("http://%s:%d", host, port.Num())
-	sender := selectBackend(map[string]string{
-		Backend:           "influx",
+	sender := selectBackends(map[string]string{
+		Backends:          "influx",
 		InfluxUrl:         influxUrl,
 		InfluxToken:       token,
 		InfluxOrg:         "samler",
 		InfluxBucket:      "home",
 		InfluxMeasurement: "power",
-	})
+	})[0]
 
 	m := Measurement{
-		Time:   time.Now(),
-		Value:  42.5,
-		Unit:   "°",
-		Ident:  "0.8.15",
-		Prefix: "1-2",
-		Suffix: "667",
+		Time:     time.Now(),
+		Value:    42.5,
+		Unit:     "°",
+		Ident:    "0.8.15",
+		Prefix:   "1-2",
+		Suffix:   "667",
+		ServerId: "0a01",
 	}
 
 	// When
-	success := sender(m)
+	success := sender.Send(m)
 
 	// Then
 	if !success {
@@ -118,4 +119,7 @@ func TestSuccessfulInfluxSend(t *testing.T) {
 	if resultValue != 42.5 {
 		t.Fatal()
 	}
+	if result.Record().ValueByKey("server_id") != "0a01" {
+		t.Fatal()
+	}
 }
@@ -0,0 +1,200 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+/*
+#cgo CFLAGS: -Ilibsml/sml/include/ -g -std=c99 -Wall -Wextra -pedantic
+#cgo LDFLAGS: libsml/sml/lib/libsml.a -lm -luuid
+#include <stdlib.h>
+#include "samler.h"
+*/
+import "C"
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"unsafe"
+)
+
+const libsmlAvailable = true
+const defaultSmlParser = Libsml
+
+//export onSmlMessage
+func onSmlMessage(msg C.struct_SmlData) {
+	value := msg.value
+
+	// fmt.Printf("%s Ident: %s, Value: %s %s\n", time.Now().Format("2006.01.02 15:04:05"), C.GoString(value.ident), C.GoString(value.value), C.GoString(value.unit))
+
+	if measure, ok := toMeasurement(
+		ValueType(value._type),
+		C.GoString(value.value),
+		C.GoString(value.unit),
+		C.GoString(value.prefix),
+		C.GoString(value.ident),
+		C.GoString(value.suffix),
+		C.GoString(msg.serverId),
+	); ok {
+		measure.Status, measure.HasStatus = uint64(value.status), value.hasStatus != 0
+		m := meterById(int(msg.device))
+		measure.Time = measurementTime(meterClock(m.name, measure.ServerId), toSmlTime(msg.sensorTime), toSmlTime(msg.valueTime), measure.Time)
+		m.emit(measure)
+	}
+}
+
+func toSmlTime(t C.struct_SmlTime) smlTime {
+	return smlTime{
+		kind:  int(t._type),
+		value: uint32(t.value),
+	}
+}
+
+//export onSmlFrame
+func onSmlFrame(device C.int, buffer *C.uchar, length C.size_t) {
+	_capture.write(C.GoBytes(unsafe.Pointer(buffer), C.int(length)))
+}
+
+//export onSmlStat
+func onSmlStat(device C.int, stat C.int) {
+	meterById(int(device)).stats.count(int(stat))
+}
+
+// libsmlListener returns the blocking listener using libsml for the device of the meter
+func libsmlListener(m *meter) func() {
+	// callback
+	callbacks := C.Callbacks{}
+	callbacks.event = C.SmlEvent(C.propagateEvent)
+	callbacks.stat = C.SmlStatEvent(C.propagateStat)
+	if _capture != nil {
+		callbacks.frame = C.SmlFrameEvent(C.propagateFrame)
+	}
+
+	listenToFile := func(file *os.File) int {
+		return int(C.listen_to_fd(C.int(file.Fd()), C.int(m.id), callbacks))
+	}
+
+	if path, isReplay := strings.CutPrefix(m.device, ReplayScheme); isReplay {
+		return func() {
+			replay(path, m.replayInterval, listenToFile)
+		}
+	}
+
+	// device config
+	name := C.CString(m.device)
+	mode := C.CString(m.mode)
+
+	deviceConfig := C.struct_DeviceConfig{
+		name:     name,
+		baudRate: C.int(m.baudRate),
+		mode:     mode,
+	}
+
+	socketAddress, isSocket := strings.CutPrefix(m.device, SocketScheme)
+	if isSocket {
+		if _, _, err := net.SplitHostPort(socketAddress); err != nil {
+			printHelpAndExit(fmt.Sprintf("Illegal socket address %s: %s\n", m.device, err))
+		}
+	} else if err := checkDeviceConfig(deviceConfig); err != nil {
+		printHelpAndExit(fmt.Sprintf("Illegal configuration of device %s: %s\n", m.device, err))
+	}
+
+	return func() {
+		defer C.free(unsafe.Pointer(name))
+		defer C.free(unsafe.Pointer(mode))
+
+		if isSocket {
+			listenToSocket(socketAddress, listenToFile)
+		}
+
+		superviseDevice(m, func(path string) (*os.File, error) {
+			fmt.Printf("Listen to %s (%s)\n", path, m.name)
+			config := deviceConfig
+			config.name = C.CString(path)
+			defer C.free(unsafe.Pointer(config.name))
+
+			fd := int(C.open_device(config))
+			if fd < 0 {
+				return nil, fmt.Errorf("failed to open %s (%d)", path, fd)
+			}
+			return os.NewFile(uintptr(fd), path), nil
+		}, listenToFile)
+	}
+}
+
+func checkDeviceConfig(deviceConfig C.struct_DeviceConfig) error {
+	switch C.check_device_config(deviceConfig) {
+	case C.DEVICE_CONFIG_OK:
+		return nil
+	case C.DEVICE_CONFIG_INVALID_BAUD_RATE:
+		return fmt.Errorf("unsupported baud rate %d", int(deviceConfig.baudRate))
+	case C.DEVICE_CONFIG_INVALID_MODE:
+		return fmt.Errorf("unsupported mode '%s', expected <databits 5-8>-<parity N/E/O>-<stopbits 1/2> like 8-N-1", C.GoString(deviceConfig.mode))
+	default:
+		return fmt.Errorf("invalid device configuration")
+	}
+}
+
+// to be used in tests, free releases the C strings of the config
+func buildCDeviceConfig(baudRate int, mode string) (config C.struct_DeviceConfig, free func()) {
+	config = C.struct_DeviceConfig{
+		name:     C.CString("/dev/null"),
+		baudRate: C.int(baudRate),
+		mode:     C.CString(mode),
+	}
+	return config, func() {
+		C.free(unsafe.Pointer(config.name))
+		C.free(unsafe.Pointer(config.mode))
+	}
+}
+
+// to be used in tests
+func buildCSmlData(
+	value string,
+	unit string,
+	prefix string,
+	ident string,
+	suffix string,
+	serverId string,
+) C.struct_SmlData {
+	return C.struct_SmlData{
+		value: C.struct_SmlValue{
+			value:  C.CString(value),
+			unit:   C.CString(unit),
+			prefix: C.CString(prefix),
+			ident:  C.CString(ident),
+			suffix: C.CString(suffix),
+		},
+		serverId: C.CString(serverId),
+	}
+}
+
+// to be used in tests
+func buildCSmlTime(kind int, value uint32) C.struct_SmlTime {
+	return C.struct_SmlTime{
+		_type: C.int(kind),
+		value: C.uint32_t(value),
+	}
+}
+
+// to be used in tests
+func withCSmlStatus(data C.struct_SmlData, valueType ValueType, status uint64) C.struct_SmlData {
+	data.value._type = C.int(valueType)
+	data.value.hasStatus = 1
+	data.value.status = C.uint64_t(status)
+	return data
+}
@@ -0,0 +1,146 @@
+//go:build cgo
+
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOnSmlMessage(t *testing.T) {
+	// Given
+	smlData := buildCSmlData(
+		"23.5", "Tt", "pfx", "667", "sfx", "0a01",
+	)
+
+	// When
+	onSmlMessage(smlData)
+
+	// Then
+	measurement := <-_messages
+	if measurement.Value != 23.5 {
+		t.Error()
+	}
+	if measurement.Unit != "Tt" {
+		t.Error()
+	}
+	if measurement.Prefix != "pfx" {
+		t.Error()
+	}
+	if measurement.Ident != "667" {
+		t.Error()
+	}
+	if measurement.Suffix != "sfx" {
+		t.Error()
+	}
+	if measurement.ServerId != "0a01" {
+		t.Error()
+	}
+}
+
+func TestCheckValidDeviceConfig(t *testing.T) {
+	valid := map[int]string{
+		300:    "7-E-1",
+		2400:   "8-N-1",
+		9600:   "8-N-1",
+		19200:  "7-O-2",
+		115200: "5-n-1",
+	}
+
+	for rate, mode := range valid {
+		config, free := buildCDeviceConfig(rate, mode)
+		if err := checkDeviceConfig(config); err != nil {
+			t.Errorf("Expected %d %s to be valid, got %s", rate, mode, err)
+		}
+		free()
+	}
+}
+
+func TestCheckInvalidDeviceConfig(t *testing.T) {
+	// unsupported baud rate
+	config, free := buildCDeviceConfig(9601, "8-N-1")
+	defer free()
+	if err := checkDeviceConfig(config); err == nil {
+		t.Error()
+	}
+
+	// unsupported modes
+	for _, mode := range []string{"", "8N1", "9-N-1", "4-N-1", "8-X-1", "8-N-3", "8-N-1-", "8_N_1"} {
+		config, free := buildCDeviceConfig(9600, mode)
+		if err := checkDeviceConfig(config); err == nil {
+			t.Errorf("Expected mode '%s' to be invalid", mode)
+		}
+		free()
+	}
+}
+
+func TestOnSmlMessageWithMeterTime(t *testing.T) {
+	// Given
+	defer withTimeSource(MeterTime)()
+	smlData := buildCSmlData(
+		"23.5", "Tt", "pfx", "667", "sfx", "0a01",
+	)
+	smlData.sensorTime = buildCSmlTime(smlTimeTimestamp, 1700000000)
+
+	// When
+	onSmlMessage(smlData)
+
+	// Then
+	measurement := <-_messages
+	if !measurement.Time.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("Expected the meter time, got %s", measurement.Time)
+	}
+}
+
+func TestOnSmlStringMessage(t *testing.T) {
+	// Given
+	smlData := withCSmlStatus(buildCSmlData(
+		"EMH", "", "129-129", "199.130.3", "255", "0a01",
+	), StringValue, 0x0182)
+
+	// When
+	onSmlMessage(smlData)
+
+	// Then
+	measurement := <-_messages
+	if measurement.Type != StringValue || measurement.Text != "EMH" {
+		t.Errorf("Unexpected value %+v", measurement)
+	}
+	if !measurement.HasStatus || measurement.Status != 0x0182 {
+		t.Errorf("Unexpected status %+v", measurement)
+	}
+}
+
+func TestOnSmlMessageOfMeter(t *testing.T) {
+	// Given
+	defer func(meters []*meter) { _meters = meters }(_meters)
+	_meters = []*meter{{id: 0, name: "home"}}
+
+	// When
+	onSmlMessage(buildCSmlData(
+		"23.5", "Tt", "pfx", "667", "sfx", "0a01",
+	))
+
+	// Then
+	if measurement := <-_messages; measurement.Device != "home" {
+		t.Errorf("Expected measurement of home, got %s", measurement.Device)
+	}
+}
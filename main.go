@@ -17,21 +17,15 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 */
 package main
 
-/*
-#cgo CFLAGS: -Ilibsml/sml/include/ -g -std=c99 -Wall -Wextra -pedantic
-#cgo LDFLAGS: libsml/sml/lib/libsml.a -lm -luuid
-#include <stdlib.h>
-#include "samler.h"
-*/
-import "C"
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
-	"time"
-	"unsafe"
+	"syscall"
 
 	diskqueue "github.com/nsqio/go-diskqueue"
 )
@@ -45,67 +39,99 @@ This is free software, and you are welcome to redistribute it under certain cond
 var debugFlag bool
 var _messages = make(chan Measurement, 5000)
 
-//export onSmlMessage
-func onSmlMessage(msg C.struct_SmlData) {
-	value := msg.value
-
-	// fmt.Printf("%s Ident: %s, Value: %s %s\n", time.Now().Format("2006.01.02 15:04:05"), C.GoString(value.ident), C.GoString(value.value), C.GoString(value.unit))
-
-	if val, err := strconv.ParseFloat(C.GoString(value.value), 32); err == nil {
-		measure := Measurement{
-			Ident:  C.GoString(value.ident),
-			Unit:   C.GoString(value.unit),
-			Prefix: C.GoString(value.prefix),
-			Suffix: C.GoString(value.suffix),
-			Value:  val,
-			Time:   time.Now(),
-		}
-		debug("Sending to channel", &measure)
-		_messages <- measure
-	}
-}
-
 func dqLog(lvl diskqueue.LogLevel, f string, args ...interface{}) {
 	log.Printf(lvl.String()+": "+f, args...)
 }
 
 const (
-	Device            = "SAMLER_DEVICE"
-	DeviceBaudRate    = "SAMLER_DEVICE_BAUD_RATE"
-	DeviceMode        = "SAMLER_DEVICE_MODE"
-	Debug             = "SAMLER_DEBUG"
-	CachePath         = "SAMLER_CACHE_PATH"
-	Backend           = "SAMLER_BACKEND"
-	InfluxUrl         = "SAMLER_INFLUX_URL"
-	InfluxToken       = "SAMLER_INFLUX_TOKEN"
-	InfluxOrg         = "SAMLER_INFLUX_ORG"
-	InfluxBucket      = "SAMLER_INFLUX_BUCKET"
-	InfluxMeasurement = "SAMLER_INFLUX_MEASUREMENT"
-	MySqlDSN          = "SAMLER_MYSQL_DSN"
-	MySqlTable        = "SAMLER_MYSQL_TABLE"
-	IdentFilter       = "SAMLER_IDENT_FILTER"
+	Device                = "SAMLER_DEVICE"
+	DeviceBaudRate        = "SAMLER_DEVICE_BAUD_RATE"
+	DeviceMode            = "SAMLER_DEVICE_MODE"
+	SmlParser             = "SAMLER_SML_PARSER"
+	TimeSource            = "SAMLER_TIME_SOURCE"
+	ReplayInterval        = "SAMLER_REPLAY_INTERVAL"
+	Capture               = "SAMLER_CAPTURE"
+	CaptureMaxSize        = "SAMLER_CAPTURE_MAX_SIZE"
+	CaptureMaxAge         = "SAMLER_CAPTURE_MAX_AGE"
+	CaptureFiles          = "SAMLER_CAPTURE_FILES"
+	Debug                 = "SAMLER_DEBUG"
+	CachePath             = "SAMLER_CACHE_PATH"
+	Backends              = "SAMLER_BACKEND"
+	InfluxUrl             = "SAMLER_INFLUX_URL"
+	InfluxToken           = "SAMLER_INFLUX_TOKEN"
+	InfluxOrg             = "SAMLER_INFLUX_ORG"
+	InfluxBucket          = "SAMLER_INFLUX_BUCKET"
+	InfluxMeasurement     = "SAMLER_INFLUX_MEASUREMENT"
+	MySqlDSN              = "SAMLER_MYSQL_DSN"
+	MySqlTable            = "SAMLER_MYSQL_TABLE"
+	PostgresDSN           = "SAMLER_POSTGRES_DSN"
+	PostgresTable         = "SAMLER_POSTGRES_TABLE"
+	PostgresSslMode       = "SAMLER_POSTGRES_SSL_MODE"
+	PostgresSslRootCert   = "SAMLER_POSTGRES_SSL_ROOT_CERT"
+	PostgresSslCert       = "SAMLER_POSTGRES_SSL_CERT"
+	PostgresSslKey        = "SAMLER_POSTGRES_SSL_KEY"
+	PostgresTimescale     = "SAMLER_POSTGRES_TIMESCALE"
+	PostgresCompressAfter = "SAMLER_POSTGRES_COMPRESS_AFTER"
+	IdentFilter           = "SAMLER_IDENT_FILTER"
+	ObisCatalogue         = "SAMLER_OBIS_CATALOGUE"
+	SendRules             = "SAMLER_SEND_RULES"
+	Aggregation           = "SAMLER_AGGREGATION"
+	DerivedPower          = "SAMLER_DERIVED_POWER"
+	Balance               = "SAMLER_BALANCE"
+	Plausibility          = "SAMLER_PLAUSIBILITY"
+	BatchSize             = "SAMLER_BATCH_SIZE"
+	BatchLatency          = "SAMLER_BATCH_LATENCY"
+)
+
+const (
+	Influx   = "influx"
+	MySql    = "mysql"
+	Postgres = "postgres"
 )
 
 const (
-	Influx = "influx"
-	MySql  = "mysql"
+	Libsml = "libsml"
+	Native = "native"
 )
 
 var configOptions = map[string][]string{
-	Device:            {"/dev/ttyUSB0"},
-	DeviceBaudRate:    {"9600"},
-	DeviceMode:        {"8-N-1"},
-	Debug:             {"false"},
-	CachePath:         {getUserHome() + "/.samler"},
-	Backend:           {Influx, MySql},
-	InfluxUrl:         {"-"},
-	InfluxToken:       {"-"},
-	InfluxOrg:         {"-"},
-	InfluxBucket:      {"home"},
-	InfluxMeasurement: {"power"},
-	MySqlDSN:          {"-"},
-	MySqlTable:        {"home_power"},
-	IdentFilter:       {"-"},
+	Device:                {"/dev/ttyUSB0"},
+	DeviceBaudRate:        {"9600"},
+	DeviceMode:            {"8-N-1"},
+	SmlParser:             {defaultSmlParser},
+	TimeSource:            {HostTime},
+	ReplayInterval:        {"1s"},
+	Capture:               {"false"},
+	CaptureMaxSize:        {"10485760"},
+	CaptureMaxAge:         {"24h"},
+	CaptureFiles:          {"10"},
+	Debug:                 {"false"},
+	CachePath:             {getUserHome() + "/.samler"},
+	Backends:              {Influx, MySql, Postgres},
+	InfluxUrl:             {"-"},
+	InfluxToken:           {"-"},
+	InfluxOrg:             {"-"},
+	InfluxBucket:          {"home"},
+	InfluxMeasurement:     {"power"},
+	MySqlDSN:              {"-"},
+	MySqlTable:            {"home_power"},
+	PostgresDSN:           {"-"},
+	PostgresTable:         {"home_power"},
+	PostgresSslMode:       {"-"},
+	PostgresSslRootCert:   {"-"},
+	PostgresSslCert:       {"-"},
+	PostgresSslKey:        {"-"},
+	PostgresTimescale:     {"false"},
+	PostgresCompressAfter: {"-"},
+	IdentFilter:           {"-"},
+	ObisCatalogue:         {"-"},
+	SendRules:             {"-"},
+	Aggregation:           {"-"},
+	DerivedPower:          {"-"},
+	Balance:               {"-"},
+	Plausibility:          {"-"},
+	BatchSize:             {"1000"},
+	BatchLatency:          {"0s"},
 }
 
 func getUserHome() string {
@@ -154,52 +180,133 @@ func main() {
 		printHelpAndExit(fmt.Sprintf("Illegal debug flag value %s: %s\n", config[Debug], err))
 	}
 
-	sendToBackend := selectBackend(config)
+	_timeSource = selectTimeSource(config)
+	_obisCatalogue = selectObisCatalogue(config)
+	_sendRules = selectSendRules(config)
+	_aggregationRules = selectAggregationRules(config)
+	_powerRules = selectPowerRules(config)
+	_plausibilityRules = selectPlausibilityRules(config)
+	_batching = selectBatching(config)
+	backends := selectBackends(config)
+	_capture = selectCapture(config)
+	listen := selectParser(config)
+	_balance = selectBalance(config, _meters)
+
+	fmt.Println("Start Samler")
+	stop := RunSamler(_messages, backends, config[CachePath], selectIdentFilter(config))
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	listenUntilDone(ctx, listen)
+
+	// pending aggregations, queued measurements and batches are flushed to the backends or their disk queues
+	stop()
+	if _capture != nil {
+		_capture.close()
+	}
+}
 
-	// device config
-	name := C.CString(config[Device])
-	defer C.free(unsafe.Pointer(name))
+// listenUntilDone returns once the listener ends, what only finite sources like replayed captures do,
+// or the context is done, e.g. by SIGTERM
+func listenUntilDone(ctx context.Context, listen func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		listen()
+	}()
 
-	mode := C.CString(config[DeviceMode])
-	defer C.free(unsafe.Pointer(mode))
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("Stop Samler")
+	}
+}
 
-	rate, err := strconv.Atoi(config[DeviceBaudRate])
+// selectParser returns the blocking listener reading from all configured devices
+func selectParser(config map[string]string) func() {
+	meters, err := parseMeters(config)
 	if err != nil {
-		printHelpAndExit(fmt.Sprintf("Illegal baud rate value %s: %s\n", config[DeviceBaudRate], err))
+		printHelpAndExit(fmt.Sprintf("Illegal device configuration: %s\n", err))
 	}
-	baudRate := C.int(rate)
+	_meters = meters
 
-	deviceConfig := C.struct_DeviceConfig{
-		name:     name,
-		baudRate: baudRate,
-		mode:     mode,
+	var listenerOf func(m *meter) func()
+	parser := config[SmlParser]
+	switch parser {
+	case Libsml:
+		if !libsmlAvailable {
+			printHelpAndExit(fmt.Sprintf("Parser '%s' is not available in this build, please use '%s'\n", Libsml, Native))
+		}
+		listenerOf = libsmlListener
+	case Native:
+		listenerOf = nativeListener
+	default:
+		printHelpAndExit(fmt.Sprintf("Unknown SML parser '%s', please select from [%s, %s]\n", parser, Libsml, Native))
+		return func() {}
+	}
+
+	listeners := make([]func(), len(meters))
+	for i, m := range meters {
+		switch m.protocol {
+		case D0:
+			listeners[i] = d0Listener(m)
+		case Dsmr:
+			listeners[i] = dsmrListener(m)
+		case Modbus:
+			listeners[i] = modbusListener(m)
+		default:
+			listeners[i] = listenerOf(m)
+		}
+	}
+	return func() {
+		go reportStats(meters)
+		listenAll(listeners)
 	}
+}
 
-	// callback
-	callbacks := C.Callbacks{}
-	callbacks.event = C.SmlEvent(C.propagateEvent)
+func selectIdentFilter(config map[string]string) identFilter {
+	filter, err := parseIdentFilter(config[IdentFilter])
+	if err != nil {
+		printHelpAndExit(fmt.Sprintf("Illegal ident filter: %s\n", err))
+	}
+	return filter
+}
 
-	fmt.Println("Start Samler")
-	RunSamler(_messages, sendToBackend, config[CachePath], config[IdentFilter])
-
-	for {
-		fmt.Printf("Listen to %s\n", config[Device])
-		exitCode := int(C.listen_to_device(deviceConfig, callbacks))
-		fmt.Printf("libsml exit: %d\n", exitCode)
-		if exitCode != 0 {
-			os.Exit(abs(exitCode))
+// selectBackends returns the comma separated backends like "mysql,influx", all of them receive all measurements
+func selectBackends(config map[string]string) []Backend {
+	backends := []Backend{}
+	for _, name := range toFilterList(config[Backends]) {
+		backend := selectBackend(name, config)
+		for _, other := range backends {
+			if other.Name() == backend.Name() {
+				printHelpAndExit(fmt.Sprintf("Backend '%s' is configured twice\n", name))
+			}
 		}
+		if err := backend.Init(); err != nil {
+			// retried on sending
+			log.Printf("Failed to init %s: %s\n", backend.Name(), err)
+		}
+		backends = append(backends, backend)
+	}
+	if len(backends) == 0 {
+		printHelpAndExit(fmt.Sprintf("No backend configured, please select from [%s, %s, %s]\n", Influx, MySql, Postgres))
 	}
+	return backends
 }
 
-func selectBackend(config map[string]string) func(measurement Measurement) bool {
-	backend := config[Backend]
+func selectBackend(backend string, config map[string]string) Backend {
 	switch backend {
 	case MySql:
 		return InitializeMySQL(
 			config[MySqlDSN],
 			config[MySqlTable],
 		)
+	case Postgres:
+		return InitializePostgres(
+			selectPostgresDSN(config),
+			config[PostgresTable],
+			selectTimescale(config),
+		)
 	case Influx:
 		return InitializeInflux(
 			config[InfluxUrl],
@@ -209,33 +316,7 @@ func selectBackend(config map[string]string) func(measurement Measurement) bool
 			config[InfluxMeasurement],
 		)
 	default:
-		printHelpAndExit(fmt.Sprintf("Unknown backend '%s', please select from [%s, %s]\n", backend, Influx, MySql))
-		return func(m Measurement) bool { return false }
-	}
-}
-
-func abs(x int) int {
-	if x < 0 {
-		return -x
-	}
-	return x
-}
-
-// to be used in tests
-func buildCSmlData(
-	value string,
-	unit string,
-	prefix string,
-	ident string,
-	suffix string,
-) C.struct_SmlData {
-	return C.struct_SmlData{
-		value: C.struct_SmlValue{
-			value:  C.CString(value),
-			unit:   C.CString(unit),
-			prefix: C.CString(prefix),
-			ident:  C.CString(ident),
-			suffix: C.CString(suffix),
-		},
+		printHelpAndExit(fmt.Sprintf("Unknown backend '%s', please select from [%s, %s, %s]\n", backend, Influx, MySql, Postgres))
+		return nil
 	}
 }
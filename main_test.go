@@ -18,59 +18,20 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package main
 
 import (
+	"context"
 	"os"
 	"testing"
+	"time"
 )
 
-func TestAbs(t *testing.T) {
-	if abs(-1) != 1 {
-		t.Error()
-	}
-
-	if abs(0) != 0 {
-		t.Error()
-	}
-
-	if abs(1) != 1 {
-		t.Error()
-	}
-}
-
-func TestOnSmlMessage(t *testing.T) {
-	// Given
-	smlData := buildCSmlData(
-		"23.5", "Tt", "pfx", "667", "sfx",
-	)
-
-	// When
-	onSmlMessage(smlData)
-
-	// Then
-	measurement := <-_messages
-	if measurement.Value != 23.5 {
-		t.Error()
-	}
-	if measurement.Unit != "Tt" {
-		t.Error()
-	}
-	if measurement.Prefix != "pfx" {
-		t.Error()
-	}
-	if measurement.Ident != "667" {
-		t.Error()
-	}
-	if measurement.Suffix != "sfx" {
-		t.Error()
-	}
-}
-
 func TestReadOverriddenConfig(t *testing.T) {
 	// Given
 	os.Setenv(Device, "Device")
 	os.Setenv(DeviceBaudRate, "DeviceBaudRate")
 	os.Setenv(DeviceMode, "DeviceMode")
+	os.Setenv(SmlParser, "SmlParser")
 	os.Setenv(Debug, "Debug")
-	os.Setenv(Backend, "Influx")
+	os.Setenv(Backends, "Influx")
 	os.Setenv(CachePath, "CachePath")
 	os.Setenv(InfluxUrl, "InfluxUrl")
 	os.Setenv(InfluxToken, "InfluxToken")
@@ -94,10 +55,13 @@ func TestReadOverriddenConfig(t *testing.T) {
 	if config[DeviceMode] != "DeviceMode" {
 		t.Fatal()
 	}
+	if config[SmlParser] != "SmlParser" {
+		t.Fatal()
+	}
 	if config[Debug] != "Debug" {
 		t.Fatal()
 	}
-	if config[Backend] != "Influx" {
+	if config[Backends] != "Influx" {
 		t.Fatal()
 	}
 	if config[CachePath] != "CachePath" {
@@ -128,3 +92,28 @@ func TestReadOverriddenConfig(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestListenUntilDone(t *testing.T) {
+	// Given
+	ctx, cancel := context.WithCancel(context.Background())
+	blocking := make(chan struct{})
+	defer close(blocking)
+	returned := make(chan struct{})
+
+	// When
+	go func() {
+		listenUntilDone(ctx, func() { <-blocking })
+		close(returned)
+	}()
+	cancel()
+
+	// Then
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Error("Expected to return once signalled")
+	}
+
+	// When && Then
+	listenUntilDone(context.Background(), func() {})
+}
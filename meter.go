@@ -0,0 +1,203 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	Sml    = "sml"
+	D0     = "d0"
+	Dsmr   = "dsmr"
+	Modbus = "modbus"
+)
+
+var protocols = []string{Sml, D0, Dsmr, Modbus}
+
+// meter is a single configured device, all meters share the same queue and backends
+type meter struct {
+	id       int
+	name     string
+	device   string
+	protocol string
+	baudRate int
+	mode     string
+	// idents to forward from this meter, on top of the global ident filter
+	identFilter    identFilter
+	replayInterval time.Duration
+	// interval of requesting readouts from D0 and Modbus meters
+	pollInterval time.Duration
+	// Modbus slave address and register map
+	slave       int
+	registerMap string
+	stats       frameStats
+}
+
+var _meters []*meter
+
+// parseMeters reads the whitespace separated device list like
+// "/dev/ttyUSB0?name=home /dev/ttyUSB1?name=heatpump&protocol=d0&baud=300&mode=7-E-1&filter=1.8.0&interval=30s",
+// options not given per device are taken from the global configuration
+func parseMeters(config map[string]string) ([]*meter, error) {
+	specs := strings.Fields(config[Device])
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("no device configured")
+	}
+
+	meters := make([]*meter, len(specs))
+	names := make(map[string]bool)
+	for i, spec := range specs {
+		m, err := parseMeter(i, spec, config)
+		if err != nil {
+			return nil, err
+		}
+		if names[m.name] {
+			return nil, fmt.Errorf("duplicate device name '%s', please set unique names using ?name=", m.name)
+		}
+		names[m.name] = true
+		meters[i] = m
+	}
+	return meters, nil
+}
+
+func parseMeter(id int, spec string, config map[string]string) (*meter, error) {
+	device, rawOptions, _ := strings.Cut(spec, "?")
+	options, err := url.ParseQuery(rawOptions)
+	if err != nil {
+		return nil, fmt.Errorf("illegal options of device %s: %s", device, err)
+	}
+
+	m := &meter{
+		id:             id,
+		name:           defaultMeterName(device),
+		device:         device,
+		protocol:       Sml,
+		mode:           config[DeviceMode],
+		replayInterval: parseReplayInterval(config[ReplayInterval]),
+		pollInterval:   10 * time.Second,
+		slave:          1,
+	}
+	baudRate := config[DeviceBaudRate]
+
+	// unless configured otherwise D0 meters usually start talking at 300 baud 7-E-1,
+	// DSMR P1 ports since version 4 send at 115200 baud 8-N-1
+	switch options.Get("protocol") {
+	case D0:
+		baudRate = "300"
+		m.mode = "7-E-1"
+	case Dsmr:
+		baudRate = "115200"
+		m.mode = "8-N-1"
+	}
+
+	for key, values := range options {
+		value := values[len(values)-1]
+		switch key {
+		case "name":
+			m.name = value
+		case "baud":
+			baudRate = value
+		case "mode":
+			m.mode = value
+		case "filter":
+			if m.identFilter, err = parseIdentFilter(value); err != nil {
+				return nil, fmt.Errorf("illegal filter of device %s: %s", device, err)
+			}
+		case "interval":
+			if m.pollInterval, err = time.ParseDuration(value); err != nil || m.pollInterval <= 0 {
+				return nil, fmt.Errorf("illegal interval %s of device %s", value, device)
+			}
+		case "slave":
+			if m.slave, err = strconv.Atoi(value); err != nil || m.slave < 1 || m.slave > 247 {
+				// 0 is the broadcast address, not answered by any slave
+				return nil, fmt.Errorf("illegal slave address %s of device %s, expected 1-247", value, device)
+			}
+		case "map":
+			m.registerMap = value
+		case "protocol":
+			if !slices.Contains(protocols, value) {
+				return nil, fmt.Errorf("unknown protocol '%s' of device %s, expected one of %s", value, device, strings.Join(protocols, ", "))
+			}
+			m.protocol = value
+		default:
+			return nil, fmt.Errorf("unknown option '%s' of device %s, expected name, protocol, baud, mode, filter, interval, slave or map", key, device)
+		}
+	}
+
+	if m.baudRate, err = strconv.Atoi(baudRate); err != nil {
+		return nil, fmt.Errorf("illegal baud rate value %s of device %s: %s", baudRate, device, err)
+	}
+	return m, nil
+}
+
+// defaultMeterName is the socket address or the file name of the device
+func defaultMeterName(device string) string {
+	if address, isSocket := strings.CutPrefix(device, SocketScheme); isSocket {
+		return address
+	}
+	return filepath.Base(strings.TrimPrefix(device, ReplayScheme))
+}
+
+// meterFilterOf returns the filter configured for the named meter, nil matching everything if there's none
+func meterFilterOf(device string) identFilter {
+	for _, m := range _meters {
+		if m.name == device {
+			return m.identFilter
+		}
+	}
+	return nil
+}
+
+// meterById resolves the meter reported by libsml, an unnamed one if unknown
+func meterById(id int) *meter {
+	if id >= 0 && id < len(_meters) {
+		return _meters[id]
+	}
+	return &meter{id: id}
+}
+
+// emit tags the measurement with the meter's name and passes it on if relevant
+func (m *meter) emit(measure Measurement) {
+	if entry, ok := _obisCatalogue.lookup(&measure); ok {
+		measure.Name = entry.Name
+	}
+	measure.Device = m.name
+	debug("Sending to channel", &measure)
+	_messages <- measure
+}
+
+// listenAll is blocking until the listeners of all meters returned
+func listenAll(listeners []func()) {
+	var wg sync.WaitGroup
+	for _, listen := range listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			listen()
+		}()
+	}
+	wg.Wait()
+}
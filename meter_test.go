@@ -0,0 +1,197 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testMeterConfig(device string) map[string]string {
+	return map[string]string{
+		Device:         device,
+		DeviceBaudRate: "9600",
+		DeviceMode:     "8-N-1",
+		ReplayInterval: "1s",
+	}
+}
+
+func TestParseSingleMeter(t *testing.T) {
+	// When
+	meters, err := parseMeters(testMeterConfig("/dev/ttyUSB0"))
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meters) != 1 {
+		t.Fatalf("Expected 1 meter, got %d", len(meters))
+	}
+	m := meters[0]
+	if m.id != 0 || m.name != "ttyUSB0" || m.protocol != Sml || m.device != "/dev/ttyUSB0" || m.baudRate != 9600 || m.mode != "8-N-1" ||
+		len(m.identFilter) != 0 || m.replayInterval != time.Second {
+		t.Errorf("Unexpected meter %+v", m)
+	}
+}
+
+func TestParseMultipleMeters(t *testing.T) {
+	// When
+	meters, err := parseMeters(testMeterConfig(
+		"/dev/ttyUSB0?name=home\n  /dev/ttyUSB1?name=heatpump&baud=300&mode=7-E-1&filter=1.8.0,2.8.0 tcp://192.168.1.5:8888",
+	))
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meters) != 3 {
+		t.Fatalf("Expected 3 meters, got %d", len(meters))
+	}
+	if meters[0].name != "home" || meters[0].baudRate != 9600 {
+		t.Errorf("Unexpected meter %+v", meters[0])
+	}
+	if meters[1].id != 1 || meters[1].name != "heatpump" || meters[1].device != "/dev/ttyUSB1" ||
+		meters[1].baudRate != 300 || meters[1].mode != "7-E-1" || meters[1].identFilter.String() != "1.8.0,2.8.0" {
+		t.Errorf("Unexpected meter %+v", meters[1])
+	}
+	if meters[2].name != "192.168.1.5:8888" || meters[2].device != "tcp://192.168.1.5:8888" {
+		t.Errorf("Unexpected meter %+v", meters[2])
+	}
+}
+
+func TestParseInvalidMeters(t *testing.T) {
+	for _, devices := range []string{
+		"",
+		"/dev/ttyUSB0 /dev/ttyUSB0",
+		"/dev/ttyUSB0?name=home /dev/ttyUSB1?name=home",
+		"/dev/ttyUSB0?speed=300",
+		"/dev/ttyUSB0?baud=fast",
+		"/dev/ttyUSB0?name=%zz",
+		"/dev/ttyUSB0?filter=1.8",
+	} {
+		if _, err := parseMeters(testMeterConfig(devices)); err == nil {
+			t.Errorf("Expected '%s' to be invalid", devices)
+		}
+	}
+}
+
+func TestMeterEmit(t *testing.T) {
+	// Given
+	m := &meter{name: "heatpump", identFilter: mustParseIdentFilter(t, "1.8.0")}
+
+	// When
+	m.emit(Measurement{Ident: "16.7.0"})
+
+	// Then
+	if measurement := <-_messages; measurement.Ident != "16.7.0" || measurement.Device != "heatpump" {
+		t.Errorf("Expected 16.7.0 of heatpump passed on to be filtered later, got %s of %s", measurement.Ident, measurement.Device)
+	}
+}
+
+func TestMeterEmitObisName(t *testing.T) {
+	// Given
+	m := &meter{name: "home"}
+
+	// When
+	m.emit(Measurement{Prefix: "1-0", Ident: "16.7.0", Suffix: "255"})
+
+	// Then
+	if measurement := <-_messages; measurement.Ident != "16.7.0" || measurement.Name != "power_active" {
+		t.Errorf("Expected 16.7.0 named power_active, got %s named %s", measurement.Ident, measurement.Name)
+	}
+}
+
+func TestMeterFilterOf(t *testing.T) {
+	// Given
+	defer func(meters []*meter) { _meters = meters }(_meters)
+	_meters = []*meter{{name: "home"}, {name: "heatpump", identFilter: mustParseIdentFilter(t, "power_active")}}
+
+	// Then
+	if filter := meterFilterOf("heatpump"); filter.String() != "power_active" {
+		t.Errorf("Expected the filter of heatpump, got %s", filter)
+	}
+	if filter := meterFilterOf("unknown"); filter != nil {
+		t.Errorf("Expected no filter of an unknown meter, got %s", filter)
+	}
+}
+
+func TestMeterById(t *testing.T) {
+	// Given
+	defer func(meters []*meter) { _meters = meters }(_meters)
+	_meters = []*meter{{id: 0, name: "home"}, {id: 1, name: "heatpump"}}
+
+	// Then
+	if m := meterById(1); m.name != "heatpump" {
+		t.Errorf("Expected heatpump, got %s", m.name)
+	}
+	if m := meterById(2); m.name != "" {
+		t.Errorf("Expected unnamed meter, got %s", m.name)
+	}
+}
+
+func TestParseD0Meter(t *testing.T) {
+	// When
+	meters, err := parseMeters(testMeterConfig("/dev/ttyUSB0?protocol=d0 /dev/ttyUSB1?protocol=d0&baud=9600"))
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meters[0].protocol != D0 || meters[0].baudRate != 300 || meters[0].mode != "7-E-1" {
+		t.Errorf("Unexpected meter %+v", meters[0])
+	}
+	if meters[1].baudRate != 9600 || meters[1].mode != "7-E-1" {
+		t.Errorf("Unexpected meter %+v", meters[1])
+	}
+
+	if _, err := parseMeters(testMeterConfig("/dev/ttyUSB0?protocol=mbus")); err == nil {
+		t.Error("Expected unknown protocol to be invalid")
+	}
+}
+
+func TestParseDsmrMeter(t *testing.T) {
+	// When
+	meters, err := parseMeters(testMeterConfig("/dev/ttyUSB0?protocol=dsmr"))
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meters[0].protocol != Dsmr || meters[0].baudRate != 115200 || meters[0].mode != "8-N-1" {
+		t.Errorf("Unexpected meter %+v", meters[0])
+	}
+}
+
+func TestParseModbusMeter(t *testing.T) {
+	// When
+	meters, err := parseMeters(testMeterConfig("tcp://192.168.1.7:502?protocol=modbus&slave=2&map=sdm630&interval=5s"))
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meters[0].protocol != Modbus || meters[0].slave != 2 || meters[0].registerMap != "sdm630" || meters[0].pollInterval != 5*time.Second {
+		t.Errorf("Unexpected meter %+v", meters[0])
+	}
+
+	for _, devices := range []string{"/dev/ttyUSB0?slave=248", "/dev/ttyUSB0?slave=0", "/dev/ttyUSB0?interval=0s", "/dev/ttyUSB0?interval=soon"} {
+		if _, err := parseMeters(testMeterConfig(devices)); err == nil {
+			t.Errorf("Expected '%s' to be invalid", devices)
+		}
+	}
+}
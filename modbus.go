@@ -0,0 +1,260 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Modbus function codes
+const (
+	modbusReadHolding = 0x03
+	modbusReadInput   = 0x04
+)
+
+// max time to wait for the response of a meter
+var modbusTimeout = time.Second
+
+var errModbusChecksum = errors.New("CRC mismatch")
+
+type modbusException struct {
+	function byte
+	code     byte
+}
+
+func (e modbusException) Error() string {
+	return fmt.Sprintf("modbus exception %d on function %#02x", e.code, e.function)
+}
+
+// modbusClient reads registers of a single device, using RTU framing on serial lines or TCP framing
+type modbusClient struct {
+	conn        io.ReadWriter
+	tcp         bool
+	slave       byte
+	transaction uint16
+	// discards stale input of serial lines, e.g. a late response of a timed out request
+	flush func() error
+}
+
+// modbusCrc16 is CRC-16/MODBUS, polynomial 0x8005 reflected with init 0xffff
+func modbusCrc16(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for range 8 {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// modbusListener returns the blocking poller reading the registers of the meter's register map
+func modbusListener(m *meter) func() {
+	registers, err := loadModbusRegisters(m.registerMap)
+	if err != nil {
+		printHelpAndExit(fmt.Sprintf("Illegal register map of device %s: %s\n", m.device, err))
+	}
+
+	if strings.HasPrefix(m.device, ReplayScheme) {
+		printHelpAndExit(fmt.Sprintf("Modbus devices can't be replayed: %s\n", m.device))
+	}
+
+	if address, isSocket := strings.CutPrefix(m.device, SocketScheme); isSocket {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			printHelpAndExit(fmt.Sprintf("Illegal socket address %s: %s\n", m.device, err))
+		}
+		return func() {
+			listenToSocket(address, func(file *os.File) int {
+				return pollModbus(m, &modbusClient{conn: file, tcp: true, slave: byte(m.slave)}, registers)
+			})
+		}
+	}
+
+	if err := checkSerialConfig(m.baudRate, m.mode); err != nil {
+		printHelpAndExit(fmt.Sprintf("Illegal configuration of device %s: %s\n", m.device, err))
+	}
+
+	return func() {
+		superviseDevice(m, func(path string) (*os.File, error) {
+			fmt.Printf("Poll %s (%s)\n", path, m.name)
+			return openSerial(path, m.baudRate, m.mode)
+		}, func(file *os.File) int {
+			flush := func() error { return flushSerialInput(file) }
+			return pollModbus(m, &modbusClient{conn: file, slave: byte(m.slave), flush: flush}, registers)
+		})
+	}
+}
+
+// pollModbus reads all registers each poll interval, returning once none of them could be read
+func pollModbus(m *meter, client *modbusClient, registers []modbusRegister) int {
+	for {
+		started := time.Now()
+		failed := 0
+		for _, register := range registers {
+			value, err := client.read(register)
+			if errors.Is(err, errModbusChecksum) {
+				m.stats.count(CrcError)
+			}
+			if err != nil {
+				log.Printf("Failed reading register %d of %s: %s\n", register.Address, m.name, err)
+				failed++
+				continue
+			}
+			m.stats.count(FrameOk)
+			m.emit(register.toMeasurement(value, time.Now()))
+		}
+		if failed == len(registers) {
+			return 1
+		}
+		time.Sleep(m.pollInterval - time.Since(started))
+	}
+}
+
+// read returns the scaled value of the register
+func (c *modbusClient) read(register modbusRegister) (float64, error) {
+	function := byte(modbusReadInput)
+	if register.Function == "holding" {
+		function = modbusReadHolding
+	}
+	data, err := c.readRegisters(function, register.Address, modbusRegisterCount[register.Type])
+	if err != nil {
+		return 0, err
+	}
+	return register.decode(data), nil
+}
+
+func (c *modbusClient) readRegisters(function byte, address uint16, count uint16) ([]byte, error) {
+	if deadline, ok := c.conn.(interface{ SetReadDeadline(time.Time) error }); ok {
+		deadline.SetReadDeadline(time.Now().Add(modbusTimeout))
+	}
+
+	pdu := binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16([]byte{function}, address), count)
+	var response []byte
+	var err error
+	if c.tcp {
+		response, err = c.exchangeTcp(pdu)
+	} else {
+		response, err = c.exchangeRtu(pdu)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if response[0] == function|0x80 && len(response) > 1 {
+		return nil, modbusException{function: function, code: response[1]}
+	}
+	if response[0] != function || len(response) < 2 || int(response[1]) != len(response)-2 || response[1] != byte(2*count) {
+		return nil, fmt.Errorf("unexpected response % x", response)
+	}
+	return response[2:], nil
+}
+
+// exchangeRtu sends the request framed by the slave address and CRC, returning the response's PDU
+func (c *modbusClient) exchangeRtu(pdu []byte) ([]byte, error) {
+	// RTU frames carry no transaction id, leftovers would be taken for the response
+	c.discardInput()
+	request := append([]byte{c.slave}, pdu...)
+	request = binary.LittleEndian.AppendUint16(request, modbusCrc16(request))
+	if _, err := c.conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	response, err := c.readRtu()
+	if err != nil {
+		// the rest of a garbled or late response must not prefix the next one
+		c.discardInput()
+		return nil, err
+	}
+	return response, nil
+}
+
+func (c *modbusClient) discardInput() {
+	if c.flush == nil {
+		return
+	}
+	if err := c.flush(); err != nil {
+		log.Printf("Failed discarding stale input of slave %d: %s\n", c.slave, err)
+	}
+}
+
+// readRtu reads a response frame, returning its PDU
+func (c *modbusClient) readRtu() ([]byte, error) {
+	// slave address and function, followed by the exception code or the byte count
+	response := make([]byte, 3, 3+255+2)
+	if _, err := io.ReadFull(c.conn, response); err != nil {
+		return nil, err
+	}
+	remaining := 2
+	if response[1]&0x80 == 0 {
+		remaining += int(response[2])
+	}
+	response = response[:3+remaining]
+	if _, err := io.ReadFull(c.conn, response[3:]); err != nil {
+		return nil, err
+	}
+
+	frame := response[:len(response)-2]
+	if crc := binary.LittleEndian.Uint16(response[len(response)-2:]); crc != modbusCrc16(frame) {
+		return nil, fmt.Errorf("%w, got %#04x of response", errModbusChecksum, crc)
+	}
+	if frame[0] != c.slave {
+		return nil, fmt.Errorf("response of slave %d instead of %d", frame[0], c.slave)
+	}
+	return frame[1:], nil
+}
+
+// exchangeTcp sends the request with the MBAP header, returning the response's PDU
+func (c *modbusClient) exchangeTcp(pdu []byte) ([]byte, error) {
+	c.transaction++
+	request := binary.BigEndian.AppendUint16(nil, c.transaction)
+	request = binary.BigEndian.AppendUint16(request, 0)
+	request = binary.BigEndian.AppendUint16(request, uint16(len(pdu)+1))
+	request = append(append(request, c.slave), pdu...)
+	if _, err := c.conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint16(header[4:6])
+	if length < 2 || length > 254 {
+		return nil, fmt.Errorf("invalid length %d of response", length)
+	}
+	response := make([]byte, length-1)
+	if _, err := io.ReadFull(c.conn, response); err != nil {
+		return nil, err
+	}
+	if transaction := binary.BigEndian.Uint16(header[0:2]); transaction != c.transaction {
+		return nil, fmt.Errorf("response of transaction %d instead of %d", transaction, c.transaction)
+	}
+	return response, nil
+}
@@ -0,0 +1,208 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// modbusRegister describes a value to read and the measurement to emit, register maps are JSON files like
+// [{"address": 12, "type": "float32", "obis": "1-0:36.7.0*255", "unit": "W"}]
+type modbusRegister struct {
+	Address uint16 `json:"address"`
+	// "input" (default) or "holding"
+	Function string `json:"function"`
+	// int16, uint16, int32, uint32, float32, int64, uint64 or float64
+	Type string `json:"type"`
+	// byte order of multi register values, "ABCD" (default, big endian), "CDAB", "BADC" or "DCBA"
+	Order string `json:"order"`
+	// factor the read value is multiplied with, defaults to 1
+	Scale float64 `json:"scale"`
+	Obis  string  `json:"obis"`
+	Unit  string  `json:"unit"`
+
+	prefix string
+	ident  string
+	suffix string
+}
+
+var modbusRegisterCount = map[string]uint16{
+	"int16":   1,
+	"uint16":  1,
+	"int32":   2,
+	"uint32":  2,
+	"float32": 2,
+	"int64":   4,
+	"uint64":  4,
+	"float64": 4,
+}
+
+var modbusByteOrders = []string{"ABCD", "CDAB", "BADC", "DCBA"}
+
+// Eastron meters provide their values as float32 input registers, energy is converted to Wh like sent by SML meters
+var eastronEnergy = []modbusRegister{
+	{Address: 0x0048, Type: "float32", Scale: 1000, Obis: "1-0:1.8.0*255", Unit: "Wh"},
+	{Address: 0x004a, Type: "float32", Scale: 1000, Obis: "1-0:2.8.0*255", Unit: "Wh"},
+}
+
+// built-in register maps of common meter models
+var modbusRegisterMaps = map[string][]modbusRegister{
+	"sdm630": append([]modbusRegister{
+		{Address: 0x0000, Type: "float32", Obis: "1-0:32.7.0*255", Unit: "V"},
+		{Address: 0x0002, Type: "float32", Obis: "1-0:52.7.0*255", Unit: "V"},
+		{Address: 0x0004, Type: "float32", Obis: "1-0:72.7.0*255", Unit: "V"},
+		{Address: 0x0006, Type: "float32", Obis: "1-0:31.7.0*255", Unit: "A"},
+		{Address: 0x0008, Type: "float32", Obis: "1-0:51.7.0*255", Unit: "A"},
+		{Address: 0x000a, Type: "float32", Obis: "1-0:71.7.0*255", Unit: "A"},
+		{Address: 0x000c, Type: "float32", Obis: "1-0:36.7.0*255", Unit: "W"},
+		{Address: 0x000e, Type: "float32", Obis: "1-0:56.7.0*255", Unit: "W"},
+		{Address: 0x0010, Type: "float32", Obis: "1-0:76.7.0*255", Unit: "W"},
+		{Address: 0x0034, Type: "float32", Obis: "1-0:16.7.0*255", Unit: "W"},
+		{Address: 0x0046, Type: "float32", Obis: "1-0:14.7.0*255", Unit: "Hz"},
+	}, eastronEnergy...),
+	"sdm72": append([]modbusRegister{
+		{Address: 0x0034, Type: "float32", Obis: "1-0:16.7.0*255", Unit: "W"},
+	}, eastronEnergy...),
+	// single phase meters provide the total power at the address of phase 1
+	"sdm120": append([]modbusRegister{
+		{Address: 0x0000, Type: "float32", Obis: "1-0:32.7.0*255", Unit: "V"},
+		{Address: 0x0006, Type: "float32", Obis: "1-0:31.7.0*255", Unit: "A"},
+		{Address: 0x000c, Type: "float32", Obis: "1-0:16.7.0*255", Unit: "W"},
+		{Address: 0x0046, Type: "float32", Obis: "1-0:14.7.0*255", Unit: "Hz"},
+	}, eastronEnergy...),
+}
+
+// loadModbusRegisters returns the built-in register map of that name or reads the given JSON file
+func loadModbusRegisters(name string) ([]modbusRegister, error) {
+	registers, builtIn := modbusRegisterMaps[strings.ToLower(name)]
+	if !builtIn {
+		if name == "" {
+			return nil, fmt.Errorf("no register map given, set ?map= to a file or one of %s", strings.Join(modbusRegisterMapNames(), ", "))
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &registers); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", name, err)
+		}
+	}
+	if len(registers) == 0 {
+		return nil, fmt.Errorf("no registers in %s", name)
+	}
+
+	prepared := make([]modbusRegister, len(registers))
+	for i, register := range registers {
+		if err := register.prepare(); err != nil {
+			return nil, fmt.Errorf("register %d: %w", register.Address, err)
+		}
+		prepared[i] = register
+	}
+	return prepared, nil
+}
+
+func modbusRegisterMapNames() []string {
+	names := []string{}
+	for name := range modbusRegisterMaps {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// prepare validates the register and applies the defaults
+func (r *modbusRegister) prepare() error {
+	if _, ok := modbusRegisterCount[r.Type]; !ok {
+		return fmt.Errorf("unsupported type '%s'", r.Type)
+	}
+	if r.Function == "" {
+		r.Function = "input"
+	}
+	if r.Function != "input" && r.Function != "holding" {
+		return fmt.Errorf("unsupported function '%s', expected input or holding", r.Function)
+	}
+	if r.Order == "" {
+		r.Order = "ABCD"
+	}
+	if !slices.Contains(modbusByteOrders, r.Order) {
+		return fmt.Errorf("unsupported order '%s', expected one of %s", r.Order, strings.Join(modbusByteOrders, ", "))
+	}
+	if r.Scale == 0 {
+		r.Scale = 1
+	}
+	var err error
+	r.prefix, r.ident, r.suffix, err = parseObisCode(r.Obis)
+	return err
+}
+
+// decode converts the registers' data to a big endian value and returns it scaled
+func (r *modbusRegister) decode(data []byte) float64 {
+	ordered := slices.Clone(data)
+	if r.Order == "CDAB" || r.Order == "DCBA" {
+		// reverse the order of the 16 bit words
+		for i, j := 0, len(ordered)-2; i < j; i, j = i+2, j-2 {
+			ordered[i], ordered[i+1], ordered[j], ordered[j+1] = ordered[j], ordered[j+1], ordered[i], ordered[i+1]
+		}
+	}
+	if r.Order == "BADC" || r.Order == "DCBA" {
+		// swap the bytes within the words
+		for i := 0; i+1 < len(ordered); i += 2 {
+			ordered[i], ordered[i+1] = ordered[i+1], ordered[i]
+		}
+	}
+
+	var value float64
+	switch r.Type {
+	case "int16":
+		value = float64(int16(binary.BigEndian.Uint16(ordered)))
+	case "uint16":
+		value = float64(binary.BigEndian.Uint16(ordered))
+	case "int32":
+		value = float64(int32(binary.BigEndian.Uint32(ordered)))
+	case "uint32":
+		value = float64(binary.BigEndian.Uint32(ordered))
+	case "float32":
+		value = float64(math.Float32frombits(binary.BigEndian.Uint32(ordered)))
+	case "int64":
+		value = float64(int64(binary.BigEndian.Uint64(ordered)))
+	case "uint64":
+		value = float64(binary.BigEndian.Uint64(ordered))
+	case "float64":
+		value = math.Float64frombits(binary.BigEndian.Uint64(ordered))
+	}
+	return value * r.Scale
+}
+
+func (r *modbusRegister) toMeasurement(value float64, measured time.Time) Measurement {
+	return Measurement{
+		Prefix: r.prefix,
+		Ident:  r.ident,
+		Suffix: r.suffix,
+		Unit:   r.Unit,
+		Type:   NumberValue,
+		Value:  value,
+		Time:   measured,
+	}
+}
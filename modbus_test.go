@@ -0,0 +1,283 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// modbusTestSlave answers RTU read requests with the float32 value of the register address
+func modbusTestSlave(conn net.Conn, slave byte, requests int) {
+	defer conn.Close()
+	for range requests {
+		request := make([]byte, 8)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		address := binary.BigEndian.Uint16(request[2:4])
+		var response []byte
+		if address == 0xffff {
+			response = []byte{slave, request[1] | 0x80, 0x02}
+		} else {
+			response = []byte{slave, request[1], 4}
+			response = binary.BigEndian.AppendUint32(response, math.Float32bits(float32(address)))
+		}
+		conn.Write(binary.LittleEndian.AppendUint16(response, modbusCrc16(response)))
+	}
+}
+
+func TestModbusCrc16(t *testing.T) {
+	if crc := modbusCrc16([]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x0a}); crc != 0xcdc5 {
+		t.Errorf("Expected 0xcdc5, got %#04x", crc)
+	}
+}
+
+func TestModbusRtuRead(t *testing.T) {
+	// Given
+	client, slave := net.Pipe()
+	defer client.Close()
+	go modbusTestSlave(slave, 7, 2)
+	modbus := &modbusClient{conn: client, slave: 7}
+
+	// When
+	value, err := modbus.read(modbusRegister{Address: 0x0048, Type: "float32", Order: "ABCD", Scale: 2})
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 0x0048*2 {
+		t.Errorf("Expected %d, got %f", 0x0048*2, value)
+	}
+
+	// When
+	_, err = modbus.read(modbusRegister{Address: 0xffff, Type: "float32", Order: "ABCD", Scale: 1})
+
+	// Then
+	var exception modbusException
+	if !errors.As(err, &exception) || exception.code != 2 {
+		t.Errorf("Expected illegal address exception, got %v", err)
+	}
+}
+
+func TestModbusRtuTimeout(t *testing.T) {
+	// Given
+	defer func(timeout time.Duration) { modbusTimeout = timeout }(modbusTimeout)
+	modbusTimeout = 10 * time.Millisecond
+	client, slave := net.Pipe()
+	defer client.Close()
+	defer slave.Close()
+	go io.Copy(io.Discard, slave)
+
+	flushes := 0
+	flush := func() error {
+		flushes++
+		return nil
+	}
+
+	// When
+	_, err := (&modbusClient{conn: client, slave: 1, flush: flush}).readRegisters(modbusReadInput, 0, 2)
+
+	// Then
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected timeout, got %v", err)
+	}
+	// before the request and after the timeout
+	if flushes != 2 {
+		t.Errorf("Expected 2 flushes, got %d", flushes)
+	}
+}
+
+// modbusTestLine answers each request with a response of register value 42, behind input received before
+type modbusTestLine struct {
+	input bytes.Buffer
+}
+
+func (l *modbusTestLine) Read(p []byte) (int, error) {
+	return l.input.Read(p)
+}
+
+func (l *modbusTestLine) Write(p []byte) (int, error) {
+	response := binary.BigEndian.AppendUint32([]byte{p[0], p[1], 4}, math.Float32bits(42))
+	l.input.Write(binary.LittleEndian.AppendUint16(response, modbusCrc16(response)))
+	return len(p), nil
+}
+
+func TestModbusRtuDiscardsStaleInput(t *testing.T) {
+	// Given
+	line := &modbusTestLine{}
+	// late response of a timed out request
+	stale := binary.BigEndian.AppendUint32([]byte{1, modbusReadInput, 4}, math.Float32bits(7))
+	line.input.Write(binary.LittleEndian.AppendUint16(stale, modbusCrc16(stale)))
+	flush := func() error {
+		line.input.Reset()
+		return nil
+	}
+	modbus := &modbusClient{conn: line, slave: 1, flush: flush}
+
+	// When
+	value, err := modbus.read(modbusRegister{Address: 0, Type: "float32", Order: "ABCD", Scale: 1})
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 42 {
+		t.Errorf("Expected 42, got %f", value)
+	}
+}
+
+func TestModbusTcpRead(t *testing.T) {
+	// Given
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		request := make([]byte, 12)
+		if _, err := io.ReadFull(server, request); err != nil {
+			return
+		}
+		// same transaction, unit and function, 2 registers holding int32 -2
+		server.Write([]byte{request[0], request[1], 0, 0, 0, 7, request[6], request[7], 4, 0xff, 0xff, 0xff, 0xfe})
+	}()
+	modbus := &modbusClient{conn: client, tcp: true, slave: 3}
+
+	// When
+	value, err := modbus.read(modbusRegister{Address: 1, Function: "holding", Type: "int32", Order: "ABCD", Scale: 1})
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != -2 {
+		t.Errorf("Expected -2, got %f", value)
+	}
+}
+
+func TestModbusRegisterDecode(t *testing.T) {
+	// 0x12345678 in the different byte orders
+	values := map[string][]byte{
+		"ABCD": {0x12, 0x34, 0x56, 0x78},
+		"CDAB": {0x56, 0x78, 0x12, 0x34},
+		"BADC": {0x34, 0x12, 0x78, 0x56},
+		"DCBA": {0x78, 0x56, 0x34, 0x12},
+	}
+	for order, data := range values {
+		register := modbusRegister{Type: "uint32", Order: order, Scale: 1}
+		if value := register.decode(data); value != 0x12345678 {
+			t.Errorf("Expected 0x12345678 for %s, got %#x", order, int(value))
+		}
+	}
+
+	register := modbusRegister{Type: "int16", Order: "ABCD", Scale: 0.1}
+	if value := register.decode([]byte{0xff, 0x9c}); math.Abs(value+10) > 1e-9 {
+		t.Errorf("Expected -10, got %f", value)
+	}
+}
+
+func TestLoadBuiltInModbusRegisters(t *testing.T) {
+	// When
+	registers, err := loadModbusRegisters("SDM630")
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, register := range registers {
+		if register.ident == "1.8.0" && (register.prefix != "1-0" || register.suffix != "255" || register.Scale != 1000 ||
+			register.Function != "input" || register.Order != "ABCD") {
+			t.Errorf("Unexpected register %+v", register)
+		}
+	}
+}
+
+func TestLoadModbusRegisterFile(t *testing.T) {
+	// Given
+	path := filepath.Join(t.TempDir(), "registers.json")
+	os.WriteFile(path, []byte(`[{"address": 30, "function": "holding", "type": "uint64", "order": "DCBA", "obis": "1-0:1.8.0", "unit": "Wh"}]`), 0644)
+
+	// When
+	registers, err := loadModbusRegisters(path)
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registers) != 1 || registers[0].Address != 30 || registers[0].Scale != 1 || registers[0].suffix != "255" {
+		t.Errorf("Unexpected registers %+v", registers)
+	}
+}
+
+func TestLoadInvalidModbusRegisters(t *testing.T) {
+	dir := t.TempDir()
+	for i, content := range []string{
+		`[]`,
+		`{"address": 1}`,
+		`[{"address": 1, "type": "float16", "obis": "1-0:1.8.0"}]`,
+		`[{"address": 1, "type": "float32", "order": "ACBD", "obis": "1-0:1.8.0"}]`,
+		`[{"address": 1, "type": "float32", "function": "coil", "obis": "1-0:1.8.0"}]`,
+		`[{"address": 1, "type": "float32", "obis": "1.8.0"}]`,
+	} {
+		path := filepath.Join(dir, "registers.json")
+		os.WriteFile(path, []byte(content), 0644)
+		if _, err := loadModbusRegisters(path); err == nil {
+			t.Errorf("Expected register map %d to be invalid", i)
+		}
+	}
+
+	for _, name := range []string{"", "sdm999"} {
+		if _, err := loadModbusRegisters(name); err == nil {
+			t.Errorf("Expected register map '%s' to be invalid", name)
+		}
+	}
+}
+
+func TestPollModbus(t *testing.T) {
+	// Given
+	registers, err := loadModbusRegisters("sdm72")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, slave := net.Pipe()
+	defer client.Close()
+	// the slave goes away after the first poll
+	go modbusTestSlave(slave, 1, len(registers))
+
+	// When
+	exitCode := pollModbus(&meter{name: "sdm", pollInterval: time.Millisecond}, &modbusClient{conn: client, slave: 1}, registers)
+
+	// Then
+	if exitCode == 0 {
+		t.Error("Expected failure exit once the slave is gone")
+	}
+	for _, register := range registers {
+		measure := <-_messages
+		if measure.Ident != register.ident || measure.Value != float64(register.Address)*register.Scale || measure.Device != "sdm" {
+			t.Errorf("Unexpected measurement %+v", measure)
+		}
+	}
+}
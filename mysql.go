@@ -18,69 +18,227 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 )
 
+// max rows per INSERT, keeping the placeholders below MySQL's limit of 65535
+const mysqlRowsPerInsert = 500
+
+// columns written by the SQL backends, MySQL and PostgreSQL
+var sqlColumns = []string{"time", "ident", "value", "unit", "prefix", "suffix", "server_id", "text_value", "status", "device", "obis_name", "aggregate"}
+
+type mysqlBackend struct {
+	dsn       string
+	tableName string
+	// guards the connection, as cached measurements are sent concurrently
+	mutex       sync.Mutex
+	database    *sql.DB
+	initialized bool
+	// prepared multi-row INSERTs into the table by number of rows, of full chunks and the latest remainder
+	statements map[int]*sql.Stmt
+	healthy    atomic.Bool
+}
+
 func InitializeMySQL(
 	mysqlDSN string,
 	tableName string,
-) func(measurement Measurement) bool {
+) *mysqlBackend {
 	fmt.Printf("Init MySQL")
+	return &mysqlBackend{dsn: mysqlDSN, tableName: tableName}
+}
 
-	initialized := false
-	var database *sql.DB
+func (b *mysqlBackend) Name() string {
+	return MySql
+}
+
+// Init connects to the database and creates or migrates the schema
+func (b *mysqlBackend) Init() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.init()
+}
+
+func (b *mysqlBackend) init() error {
+	if b.initialized {
+		return nil
+	}
+	db, err := sql.Open("mysql", b.dsn)
+	if err != nil {
+		return fmt.Errorf("failed to connect to MySQL: %w", err)
+	}
+	db.SetConnMaxLifetime(3 * time.Minute)
+	db.SetMaxOpenConns(3)
+	db.SetMaxIdleConns(1)
 
-	runInit := func() bool {
-		db, err := sql.Open("mysql", mysqlDSN)
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "select now()"); err != nil {
+		db.Close()
+		return fmt.Errorf("could not connect to database: %w", err)
+	}
+	if !setupSchema(db, b.tableName) {
+		db.Close()
+		return fmt.Errorf("failed to set up schema of %s", b.tableName)
+	}
+
+	b.database = db
+	b.statements = map[int]*sql.Stmt{}
+	b.initialized = true
+	return nil
+}
+
+func (b *mysqlBackend) Send(measurement Measurement) bool {
+	return b.SendBatch([]Measurement{measurement})
+}
+
+// SendBatch inserts all measurements within a single transaction
+func (b *mysqlBackend) SendBatch(measurements []Measurement) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	err := b.init()
+	if err == nil {
+		err = b.insert(measurements)
 		if err != nil {
-			log.Printf("Failed to connect to MySQL: %s\n", err)
-			return false
+			// reconnects on the next attempt
+			b.disconnect()
 		}
-		db.SetConnMaxLifetime(3 * time.Minute)
-		db.SetMaxOpenConns(3)
-		db.SetMaxIdleConns(1)
+	}
+	b.healthy.Store(err == nil)
+	if err != nil {
+		log.Printf("Failed sending to MySQL %s\n", err)
+		return false
+	}
+	return true
+}
 
-		if _, err := db.Exec("select now()"); err != nil {
-			log.Printf("Could not connect to database: %s\n", err)
-			return false
-		}
+// insert writes the measurements by multi-row INSERTs within a single transaction
+func (b *mysqlBackend) insert(measurements []Measurement) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	tx, err := b.database.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-		database = db
-		return setupSchema(db, tableName)
+	for start := 0; start < len(measurements); start += mysqlRowsPerInsert {
+		chunk := measurements[start:min(start+mysqlRowsPerInsert, len(measurements))]
+		statement, err := b.statement(ctx, len(chunk))
+		if err != nil {
+			return err
+		}
+		args := make([]any, 0, len(chunk)*len(sqlColumns))
+		for _, measurement := range chunk {
+			debug("Sending to MySQL", &measurement)
+			args = append(args, mysqlRow(measurement)...)
+		}
+		if _, err := tx.StmtContext(ctx, statement).ExecContext(ctx, args...); err != nil {
+			return err
+		}
 	}
+	return tx.Commit()
+}
 
-	sender := func(measurement Measurement) bool {
-		if !initialized {
-			initialized = runInit()
-			if !initialized {
-				return false
-			}
+// statement returns the prepared INSERT of the number of rows, prepared once per connection
+func (b *mysqlBackend) statement(ctx context.Context, rows int) (*sql.Stmt, error) {
+	if statement, ok := b.statements[rows]; ok {
+		return statement, nil
+	}
+	// remainders vary by batch, keeping all of them would hold up to a statement per size on the server
+	for cached, statement := range b.statements {
+		if cached != mysqlRowsPerInsert {
+			statement.Close()
+			delete(b.statements, cached)
 		}
+	}
+	statement, err := b.database.PrepareContext(ctx, insertStatement(b.tableName, rows))
+	if err != nil {
+		return nil, err
+	}
+	b.statements[rows] = statement
+	return statement, nil
+}
 
-		debug("Sending to MySQL", &measurement)
-		if _, err := database.Exec(fmt.Sprintf(`INSERT INTO %s
-			(time, ident, value, unit, prefix, suffix)
-			VALUES(?, ?, ?, ?, ?, ?)`, tableName),
-			measurement.Time,
-			measurement.Ident,
-			measurement.Value,
-			measurement.Unit,
-			measurement.Prefix,
-			measurement.Suffix,
-		); err != nil {
-			log.Printf("Failed sending to MySQL %s\n", err)
-			initialized = false
-			return false
+func insertStatement(tableName string, rows int) string {
+	placeholders := "(" + strings.Repeat("?, ", len(sqlColumns)-1) + "?)"
+	values := strings.Repeat(placeholders+", ", rows-1) + placeholders
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", tableName, strings.Join(sqlColumns, ", "), values)
+}
+
+// sqlRow returns the values of the measurement in the order of sqlColumns
+func sqlRow(measurement Measurement) []any {
+	var value, text, status, aggregate any
+	if measurement.Type != StringValue {
+		value = measurement.Value
+	}
+	if measurement.Type != NumberValue {
+		text = truncate(measurement.Text, 255)
+	}
+	if measurement.HasStatus {
+		status = measurement.Status
+	}
+	if measurement.Aggregate != "" {
+		aggregate = measurement.Aggregate
+	}
+	return []any{
+		measurement.Time,
+		measurement.Ident,
+		value,
+		measurement.Unit,
+		measurement.Prefix,
+		measurement.Suffix,
+		measurement.ServerId,
+		text,
+		status,
+		measurement.Device,
+		measurement.Name,
+		aggregate,
+	}
+}
+
+// widths of the string columns of the MySQL schema
+var mysqlColumnWidths = map[string]int{"ident": 32, "unit": 16, "prefix": 7, "suffix": 5, "server_id": 64, "device": 64, "obis_name": 64}
+
+// mysqlRow truncates the strings to the width of their columns, as a single value too long fails the whole INSERT in strict mode
+func mysqlRow(measurement Measurement) []any {
+	row := sqlRow(measurement)
+	for i, column := range sqlColumns {
+		if width, ok := mysqlColumnWidths[column]; ok {
+			row[i] = truncate(row[i].(string), width)
 		}
-		return true
 	}
+	return row
+}
+
+func (b *mysqlBackend) Healthy() bool {
+	return b.healthy.Load()
+}
+
+func (b *mysqlBackend) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.initialized {
+		b.disconnect()
+	}
+}
 
-	return sender
+// disconnect closes the connection along with its prepared statements
+func (b *mysqlBackend) disconnect() {
+	for _, statement := range b.statements {
+		statement.Close()
+	}
+	b.database.Close()
+	b.initialized = false
 }
 
 func setupSchema(db *sql.DB, tableName string) bool {
@@ -89,10 +247,10 @@ func setupSchema(db *sql.DB, tableName string) bool {
 		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
 			id bigint NOT NULL AUTO_INCREMENT,
 			time timestamp NOT NULL,
-			ident varchar(10) NOT NULL,
-			value double NOT NULL,
-			unit varchar(5),
-			prefix varchar(5),
+			ident varchar(32) NOT NULL,
+			value double,
+			unit varchar(16),
+			prefix varchar(7),
 			suffix varchar(5),
 			PRIMARY KEY (id),
 			INDEX idxTime (time DESC)
@@ -105,5 +263,93 @@ func setupSchema(db *sql.DB, tableName string) bool {
 			return false
 		}
 	}
+
+	// columns added later on, tables created by earlier versions get migrated
+	columns := [...][2]string{
+		{"server_id", "varchar(64)"},
+		{"text_value", "varchar(255)"},
+		{"status", "bigint unsigned"},
+		{"device", "varchar(64)"},
+		{"obis_name", "varchar(64)"},
+		{"aggregate", "varchar(8)"},
+	}
+
+	for _, c := range columns {
+		if err := addColumnIfMissing(db, tableName, c[0], c[1]); err != nil {
+			log.Printf("Failed to migrate schema: %s\n", err)
+			return false
+		}
+	}
+
+	// string values don't have a numeric value
+	if err := makeColumnNullable(db, tableName, "value", "double"); err != nil {
+		log.Printf("Failed to migrate schema: %s\n", err)
+		return false
+	}
+
+	// OBIS groups of up to three digits like "129-129:199.130.3", idents and units of register maps are user-defined
+	if err := widenColumn(db, tableName, "ident", 32, "varchar(32) NOT NULL"); err != nil {
+		log.Printf("Failed to migrate schema: %s\n", err)
+		return false
+	}
+	if err := widenColumn(db, tableName, "prefix", 7, "varchar(7)"); err != nil {
+		log.Printf("Failed to migrate schema: %s\n", err)
+		return false
+	}
+	if err := widenColumn(db, tableName, "unit", 16, "varchar(16)"); err != nil {
+		log.Printf("Failed to migrate schema: %s\n", err)
+		return false
+	}
 	return true
 }
+
+func widenColumn(db *sql.DB, tableName string, column string, length int, definition string) error {
+	var current int
+	if err := db.QueryRow(`SELECT CHARACTER_MAXIMUM_LENGTH FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`,
+		tableName, column,
+	).Scan(&current); err != nil {
+		return err
+	}
+	if current >= length {
+		return nil
+	}
+
+	log.Printf("Widening column %s of %s to %d characters\n", column, tableName, length)
+	_, err := db.Exec(fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s %s", tableName, column, definition))
+	return err
+}
+
+func makeColumnNullable(db *sql.DB, tableName string, column string, definition string) error {
+	var nullable string
+	if err := db.QueryRow(`SELECT IS_NULLABLE FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`,
+		tableName, column,
+	).Scan(&nullable); err != nil {
+		return err
+	}
+	if nullable == "YES" {
+		return nil
+	}
+
+	log.Printf("Making column %s of %s nullable\n", column, tableName)
+	_, err := db.Exec(fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s %s NULL", tableName, column, definition))
+	return err
+}
+
+func addColumnIfMissing(db *sql.DB, tableName string, column string, definition string) error {
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`,
+		tableName, column,
+	).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	log.Printf("Adding column %s to %s\n", column, tableName)
+	_, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", tableName, column, definition))
+	return err
+}
@@ -21,6 +21,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -34,7 +35,7 @@ func TestFailingMySqlSend(t *testing.T) {
 	m := Measurement{}
 
 	// When
-	success := sender(m)
+	success := sender.Send(m)
 
 	// Then
 	if success != false {
@@ -42,6 +43,69 @@ func TestFailingMySqlSend(t *testing.T) {
 	}
 }
 
+func TestInsertStatement(t *testing.T) {
+	// When
+	statement := insertStatement("measures", 2)
+
+	// Then
+	row := "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	expected := "INSERT INTO measures (time, ident, value, unit, prefix, suffix, server_id, text_value, status, device, obis_name, aggregate) VALUES " + row + ", " + row
+	if statement != expected {
+		t.Errorf("Unexpected statement %s", statement)
+	}
+	if placeholders := strings.Count(insertStatement("measures", mysqlRowsPerInsert), "?"); placeholders > 65535 {
+		t.Errorf("Expected less than 65536 placeholders, got %d", placeholders)
+	}
+}
+
+func TestSqlRow(t *testing.T) {
+	now := time.Now()
+	number := sqlRow(Measurement{Time: now, Ident: "1.8.0", Type: NumberValue, Value: 1.5, Device: "home", Aggregate: "mean"})
+	if len(number) != len(sqlColumns) || number[0] != now || number[2] != 1.5 || number[7] != nil || number[8] != nil || number[9] != "home" || number[11] != "mean" {
+		t.Errorf("Unexpected number row %v", number)
+	}
+
+	text := sqlRow(Measurement{Ident: "0.2.0", Type: StringValue, Text: "v1.2", Status: 4, HasStatus: true})
+	if text[2] != nil || text[7] != "v1.2" || text[8] != uint64(4) || text[11] != nil {
+		t.Errorf("Unexpected text row %v", text)
+	}
+}
+
+func TestMySqlRowTruncated(t *testing.T) {
+	// When
+	row := mysqlRow(Measurement{Ident: "energy.import.total", Unit: "kvarh per day", Device: strings.Repeat("d", 70), Type: StringValue, Text: "ok"})
+
+	// Then
+	if row[1] != "energy.import.total" || row[3] != "kvarh per day" || row[7] != "ok" {
+		t.Errorf("Expected values fitting their columns to be kept, got %v", row)
+	}
+	if row[9] != strings.Repeat("d", 64) {
+		t.Errorf("Expected the device truncated to 64 characters, got %s", row[9])
+	}
+	if row := mysqlRow(Measurement{Ident: strings.Repeat("1", 40)}); row[1] != strings.Repeat("1", 32) {
+		t.Errorf("Expected the ident truncated to 32 characters, got %s", row[1])
+	}
+}
+
+func TestMySqlStatementsOfFullChunksAndRemainder(t *testing.T) {
+	// Given
+	backend := InitializeMySQL("", "measures")
+	backend.database = sql.OpenDB(&copyRecorder{})
+	backend.statements = map[int]*sql.Stmt{}
+
+	// When
+	for _, rows := range []int{mysqlRowsPerInsert, 3, 7, mysqlRowsPerInsert, 7} {
+		if _, err := backend.statement(context.Background(), rows); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Then
+	if len(backend.statements) != 2 || backend.statements[mysqlRowsPerInsert] == nil || backend.statements[7] == nil {
+		t.Errorf("Expected statements of full chunks and the latest remainder, got %v", backend.statements)
+	}
+}
+
 func TestSuccessfulMySQLSend(t *testing.T) {
 	// Setup testcontainer
 	req := testcontainers.ContainerRequest{
@@ -67,23 +131,24 @@ func TestSuccessfulMySQLSend(t *testing.T) {
 	// Given
 	dsn := fmt.Sprintf("root:password@tcp(%s:%d)/samler", host, port.Num())
 
-	sender := selectBackend(map[string]string{
-		Backend:    "mysql",
+	sender := selectBackends(map[string]string{
+		Backends:   "mysql",
 		MySqlDSN:   dsn,
 		MySqlTable: "measures",
-	})
+	})[0]
 
 	m := Measurement{
-		Time:   time.Now(),
-		Value:  22.5,
-		Unit:   "°",
-		Ident:  "0.8.15",
-		Prefix: "1-2",
-		Suffix: "667",
+		Time:     time.Now(),
+		Value:    22.5,
+		Unit:     "°",
+		Ident:    "0.8.15",
+		Prefix:   "129-129",
+		Suffix:   "667",
+		ServerId: "0a01",
 	}
 
 	// When
-	success := sender(m)
+	success := sender.Send(m)
 
 	// Then
 	if !success {
@@ -95,7 +160,7 @@ func TestSuccessfulMySQLSend(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	res, err := db.Query("select ident, value, unit, prefix, suffix from measures")
+	res, err := db.Query("select ident, value, unit, prefix, suffix, server_id from measures")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -104,12 +169,12 @@ func TestSuccessfulMySQLSend(t *testing.T) {
 	}
 
 	var value float32
-	var ident, unit, prefix, suffix string
-	if err := res.Scan(&ident, &value, &unit, &prefix, &suffix); err != nil {
+	var ident, unit, prefix, suffix, serverId string
+	if err := res.Scan(&ident, &value, &unit, &prefix, &suffix, &serverId); err != nil {
 		t.Fatal(err)
 	}
 
-	if value != 22.5 || unit != "°" || prefix != "1-2" || suffix != "667" || ident != "0.8.15" {
+	if value != 22.5 || unit != "°" || prefix != "129-129" || suffix != "667" || ident != "0.8.15" || serverId != "0a01" {
 		t.Fatal()
 	}
 }
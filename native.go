@@ -0,0 +1,81 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// nativeListener returns the blocking listener decoding SML in Go for the device of the meter
+func nativeListener(m *meter) func() {
+	listenToFile := func(file *os.File) int {
+		return listenNative(m, file)
+	}
+
+	if path, isReplay := strings.CutPrefix(m.device, ReplayScheme); isReplay {
+		return func() {
+			replay(path, m.replayInterval, listenToFile)
+		}
+	}
+
+	if address, isSocket := strings.CutPrefix(m.device, SocketScheme); isSocket {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			printHelpAndExit(fmt.Sprintf("Illegal socket address %s: %s\n", m.device, err))
+		}
+		return func() {
+			listenToSocket(address, listenToFile)
+		}
+	}
+
+	if err := checkSerialConfig(m.baudRate, m.mode); err != nil {
+		printHelpAndExit(fmt.Sprintf("Illegal configuration of device %s: %s\n", m.device, err))
+	}
+
+	return func() {
+		superviseDevice(m, func(path string) (*os.File, error) {
+			fmt.Printf("Listen to %s (%s)\n", path, m.name)
+			return openSerial(path, m.baudRate, m.mode)
+		}, listenToFile)
+	}
+}
+
+// listenNative decodes SML transport frames of the meter until the reader ends or fails
+func listenNative(m *meter, reader io.Reader) int {
+	transport := newSmlTransportReader(reader)
+	transport.stats = &m.stats
+	for {
+		frame, err := transport.readFrame()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Failed reading SML stream of %s: %s\n", m.name, err)
+			}
+			return 0
+		}
+		if _capture != nil {
+			_capture.write(frame)
+		}
+		for _, measure := range decodeSmlFrame(frame, m.name, &m.stats) {
+			m.emit(measure)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestListenNative(t *testing.T) {
+	// Given
+	stream := bytes.Join([][]byte{
+		smlTestFrame(smlTestGetListResponse([]byte{0x0a, 0x01}, smlTestEnergy)),
+		smlTestFrame(smlTestGetListResponse([]byte{0x0a, 0x01}, smlTestPower)),
+	}, nil)
+
+	// When
+	exitCode := listenNative(&meter{name: "home"}, bytes.NewReader(stream))
+
+	// Then
+	if exitCode != 0 {
+		t.Error()
+	}
+	if energy := <-_messages; energy.Ident != "1.8.0" || energy.Device != "home" {
+		t.Errorf("Expected 1.8.0 of home, got %s of %s", energy.Ident, energy.Device)
+	}
+	if power := <-_messages; power.Ident != "16.7.0" {
+		t.Errorf("Expected 16.7.0, got %s", power.Ident)
+	}
+}
@@ -0,0 +1,182 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// full OBIS codes like "1-0:1.8.0*255", the suffix is optional and defaults to 255 (current value)
+var obisCode = regexp.MustCompile(`^(\d{1,3}-\d{1,3}):(\d{1,3}\.\d{1,3}\.\d{1,3})(?:\*(\d{1,3}))?$`)
+
+// parseObisCode splits an OBIS code into the prefix, ident and suffix as used by measurements
+func parseObisCode(code string) (prefix string, ident string, suffix string, err error) {
+	parts := obisCode.FindStringSubmatch(code)
+	if parts == nil {
+		return "", "", "", fmt.Errorf("invalid OBIS code '%s', expected A-B:C.D.E*F like 1-0:1.8.0*255", code)
+	}
+	suffix = parts[3]
+	if suffix == "" {
+		suffix = "255"
+	}
+	return parts[1], parts[2], suffix, nil
+}
+
+// obisEntry is the stable name and description of an OBIS code
+type obisEntry struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// obisCatalogue maps codes "A-B:C.D.E*F", or "A-B:C.D.E" for any suffix, to their entry
+type obisCatalogue map[string]obisEntry
+
+var builtInObisCatalogue = obisCatalogue{
+	// electricity
+	"1-0:0.0.9":         {"device_id", "Device identification"},
+	"1-0:0.2.0":         {"firmware_version", "Firmware version"},
+	"1-0:96.1.0":        {"meter_serial", "Meter serial number"},
+	"1-0:96.50.1":       {"manufacturer", "Manufacturer identification"},
+	"1-0:1.8.0":         {"energy_import_total", "Positive active energy (A+), total"},
+	"1-0:1.8.1":         {"energy_import_tariff1", "Positive active energy (A+), tariff 1"},
+	"1-0:1.8.2":         {"energy_import_tariff2", "Positive active energy (A+), tariff 2"},
+	"1-0:2.8.0":         {"energy_export_total", "Negative active energy (A-), total"},
+	"1-0:2.8.1":         {"energy_export_tariff1", "Negative active energy (A-), tariff 1"},
+	"1-0:2.8.2":         {"energy_export_tariff2", "Negative active energy (A-), tariff 2"},
+	"1-0:1.7.0":         {"power_import", "Positive active instantaneous power (A+)"},
+	"1-0:2.7.0":         {"power_export", "Negative active instantaneous power (A-)"},
+	"1-0:16.7.0":        {"power_active", "Sum active instantaneous power (A+ - A-)"},
+	"1-0:21.7.0":        {"power_import_l1", "Positive active instantaneous power (A+) L1"},
+	"1-0:41.7.0":        {"power_import_l2", "Positive active instantaneous power (A+) L2"},
+	"1-0:61.7.0":        {"power_import_l3", "Positive active instantaneous power (A+) L3"},
+	"1-0:22.7.0":        {"power_export_l1", "Negative active instantaneous power (A-) L1"},
+	"1-0:42.7.0":        {"power_export_l2", "Negative active instantaneous power (A-) L2"},
+	"1-0:62.7.0":        {"power_export_l3", "Negative active instantaneous power (A-) L3"},
+	"1-0:36.7.0":        {"power_active_l1", "Sum active instantaneous power (A+ - A-) L1"},
+	"1-0:56.7.0":        {"power_active_l2", "Sum active instantaneous power (A+ - A-) L2"},
+	"1-0:76.7.0":        {"power_active_l3", "Sum active instantaneous power (A+ - A-) L3"},
+	"1-0:31.7.0":        {"current_l1", "Instantaneous current L1"},
+	"1-0:51.7.0":        {"current_l2", "Instantaneous current L2"},
+	"1-0:71.7.0":        {"current_l3", "Instantaneous current L3"},
+	"1-0:32.7.0":        {"voltage_l1", "Instantaneous voltage L1"},
+	"1-0:52.7.0":        {"voltage_l2", "Instantaneous voltage L2"},
+	"1-0:72.7.0":        {"voltage_l3", "Instantaneous voltage L3"},
+	"1-0:14.7.0":        {"frequency", "Supply frequency"},
+	"129-129:199.130.3": {"manufacturer", "Manufacturer identification"},
+	"129-129:199.130.5": {"public_key", "Public key of the meter"},
+	// balance derived by SaMLer
+	"1-0:130.7.0": {"net_power", "Power drawn from the grid, negative if fed in"},
+	"1-0:131.7.0": {"net_import_power", "Power drawn from the grid"},
+	"1-0:132.7.0": {"net_export_power", "Power fed into the grid"},
+	"1-0:131.8.0": {"daily_import_energy", "Energy drawn from the grid today"},
+	"1-0:132.8.0": {"daily_export_energy", "Energy fed into the grid today"},
+	"1-0:133.8.0": {"daily_pv_energy", "Energy produced by PV today"},
+	"1-0:134.8.0": {"daily_self_consumption", "PV energy consumed by the household today"},
+	"1-0:135.8.0": {"daily_consumption", "Energy consumed by the household today"},
+	"1-0:136.8.0": {"self_consumption_ratio", "Share of the PV energy consumed by the household today"},
+	"1-0:137.8.0": {"autarky_ratio", "Share of the consumption covered by PV today"},
+	// DSMR
+	"1-3:0.2.8":   {"dsmr_version", "DSMR version of the P1 output"},
+	"0-0:96.1.1":  {"equipment_id", "Equipment identifier"},
+	"0-0:96.14.0": {"tariff_indicator", "Tariff indicator electricity"},
+	"0-0:96.7.21": {"power_failures", "Number of power failures in any phase"},
+	"0-0:96.7.9":  {"power_failures_long", "Number of long power failures in any phase"},
+	"0-1:24.1.0":  {"mbus1_device_type", "Device type of M-Bus device 1"},
+	"0-1:24.2.1":  {"mbus1_reading", "Last reading of M-Bus device 1, usually gas"},
+	// gas
+	"7-0:3.0.0": {"gas_volume_total", "Gas volume, meter index"},
+	"7-0:3.1.0": {"gas_volume_corrected", "Gas volume at base conditions"},
+	// heat
+	"6-0:1.0.0":  {"heat_energy_total", "Heat energy, meter index"},
+	"6-0:2.0.0":  {"heat_volume_total", "Heat transfer medium volume, meter index"},
+	"6-0:8.0.0":  {"heat_power", "Heat power"},
+	"6-0:9.0.0":  {"heat_flow_rate", "Heat transfer medium flow rate"},
+	"6-0:10.0.0": {"heat_flow_temperature", "Flow temperature"},
+	"6-0:11.0.0": {"heat_return_temperature", "Return temperature"},
+	// water
+	"8-0:1.0.0": {"cold_water_volume_total", "Cold water volume, meter index"},
+	"9-0:1.0.0": {"hot_water_volume_total", "Hot water volume, meter index"},
+}
+
+var _obisCatalogue = builtInObisCatalogue
+
+// selectObisCatalogue extends the built-in catalogue by a JSON file like
+// {"1-0:1.8.0": {"name": "energy_import_total", "description": "Positive active energy (A+), total"}}
+func selectObisCatalogue(config map[string]string) obisCatalogue {
+	path := config[ObisCatalogue]
+	if path == "-" || path == "" {
+		return builtInObisCatalogue
+	}
+	catalogue, err := loadObisCatalogue(path)
+	if err != nil {
+		printHelpAndExit(fmt.Sprintf("Illegal OBIS catalogue %s: %s\n", path, err))
+	}
+	return catalogue
+}
+
+func loadObisCatalogue(path string) (obisCatalogue, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entries := obisCatalogue{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	catalogue := maps.Clone(builtInObisCatalogue)
+	for code, entry := range entries {
+		if !obisCode.MatchString(code) {
+			return nil, fmt.Errorf("invalid OBIS code '%s', expected A-B:C.D.E*F like 1-0:1.8.0*255", code)
+		}
+		if entry.Name == "" {
+			return nil, fmt.Errorf("missing name of %s", code)
+		}
+		catalogue[code] = entry
+	}
+	return catalogue, nil
+}
+
+// lookup finds the entry of the measurement's code, falling back to the entry of any suffix
+func (c obisCatalogue) lookup(measure *Measurement) (obisEntry, bool) {
+	code := measure.fullCode()
+	if entry, ok := c[code]; ok {
+		return entry, true
+	}
+	code, _, _ = strings.Cut(code, "*")
+	entry, ok := c[code]
+	return entry, ok
+}
+
+// fullCode is the OBIS code "A-B:C.D.E*F" of the measurement,
+// short codes without prefix like sent by D0 meters are taken as electricity
+func (m *Measurement) fullCode() string {
+	prefix, suffix := m.Prefix, m.Suffix
+	if prefix == "" {
+		prefix = "1-0"
+	}
+	if suffix == "" {
+		suffix = "255"
+	}
+	return prefix + ":" + m.Ident + "*" + suffix
+}
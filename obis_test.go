@@ -0,0 +1,156 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseObisCode(t *testing.T) {
+	prefix, ident, suffix, err := parseObisCode("0-1:24.2.1*1")
+	if err != nil || prefix != "0-1" || ident != "24.2.1" || suffix != "1" {
+		t.Errorf("Unexpected %s %s %s %v", prefix, ident, suffix, err)
+	}
+
+	if _, _, suffix, _ := parseObisCode("1-0:1.8.0"); suffix != "255" {
+		t.Errorf("Expected default suffix 255, got %s", suffix)
+	}
+
+	for _, code := range []string{"", "1.8.0", "1-0:1.8", "1-0:1.8.0*", "a-0:1.8.0"} {
+		if _, _, _, err := parseObisCode(code); err == nil {
+			t.Errorf("Expected '%s' to be invalid", code)
+		}
+	}
+}
+
+func TestObisCatalogueLookup(t *testing.T) {
+	// Given
+	catalogue := obisCatalogue{
+		"1-0:1.8.0":   {Name: "energy_import_total"},
+		"1-0:1.8.0*1": {Name: "energy_import_total_billing"},
+		"7-0:3.0.0":   {Name: "gas_volume_total"},
+	}
+
+	expectations := []struct {
+		measure Measurement
+		name    string
+	}{
+		{Measurement{Prefix: "1-0", Ident: "1.8.0", Suffix: "255"}, "energy_import_total"},
+		{Measurement{Prefix: "1-0", Ident: "1.8.0", Suffix: "1"}, "energy_import_total_billing"},
+		{Measurement{Ident: "1.8.0"}, "energy_import_total"},
+		{Measurement{Prefix: "7-0", Ident: "3.0.0", Suffix: "255"}, "gas_volume_total"},
+		{Measurement{Prefix: "0-0", Ident: "1.8.0", Suffix: "255"}, ""},
+		{Measurement{Prefix: "1-0", Ident: "2.8.0", Suffix: "255"}, ""},
+	}
+
+	for _, e := range expectations {
+		// When
+		entry, ok := catalogue.lookup(&e.measure)
+
+		// Then
+		if entry.Name != e.name || ok != (e.name != "") {
+			t.Errorf("Expected name '%s' of %s:%s*%s, got '%s'", e.name, e.measure.Prefix, e.measure.Ident, e.measure.Suffix, entry.Name)
+		}
+	}
+}
+
+func TestBuiltInObisCatalogue(t *testing.T) {
+	names := map[string]string{}
+	for code, entry := range builtInObisCatalogue {
+		if !obisCode.MatchString(code) {
+			t.Errorf("Invalid code %s", code)
+		}
+		if entry.Name == "" || entry.Description == "" {
+			t.Errorf("Incomplete entry of %s", code)
+		}
+		if other, ok := names[entry.Name]; ok && entry.Name != "manufacturer" {
+			t.Errorf("Name %s of %s already used by %s", entry.Name, code, other)
+		}
+		names[entry.Name] = code
+	}
+}
+
+func TestBuiltInObisCatalogueOfDecodedSml(t *testing.T) {
+	// Given
+	publicKey := smlTestEntry([]byte{129, 129, 199, 130, 5, 255}, 0, 0, smlTestTL(smlTypeOctetString, 0xca, 0xfe))
+	frame := smlTestFrame(smlTestGetListResponse([]byte{0x0a, 0x01}, smlTestVendor, publicKey))
+
+	// When
+	measurements := decodeSmlFrame(frame, "", nil)
+
+	// Then
+	if len(measurements) != 2 {
+		t.Fatalf("Expected 2 measurements, got %d", len(measurements))
+	}
+	for i, name := range []string{"manufacturer", "public_key"} {
+		if entry, ok := builtInObisCatalogue.lookup(&measurements[i]); !ok || entry.Name != name {
+			t.Errorf("Expected %s of %s, got %+v", name, measurements[i].fullCode(), entry)
+		}
+	}
+}
+
+func TestLoadObisCatalogue(t *testing.T) {
+	// Given
+	path := filepath.Join(t.TempDir(), "obis.json")
+	os.WriteFile(path, []byte(`{
+		"1-0:1.8.0": {"name": "grid_import", "description": "Bought from the grid"},
+		"1-0:2.8.0*255": {"name": "grid_export"}
+	}`), 0644)
+
+	// When
+	catalogue, err := loadObisCatalogue(path)
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := catalogue.lookup(&Measurement{Prefix: "1-0", Ident: "1.8.0", Suffix: "255"}); entry.Name != "grid_import" {
+		t.Errorf("Expected overridden name, got %s", entry.Name)
+	}
+	if entry, _ := catalogue.lookup(&Measurement{Prefix: "1-0", Ident: "2.8.0", Suffix: "255"}); entry.Name != "grid_export" {
+		t.Errorf("Expected added name, got %s", entry.Name)
+	}
+	if entry, _ := catalogue.lookup(&Measurement{Prefix: "1-0", Ident: "16.7.0", Suffix: "255"}); entry.Name != "power_active" {
+		t.Errorf("Expected built-in name, got %s", entry.Name)
+	}
+	if builtInObisCatalogue["1-0:1.8.0"].Name != "energy_import_total" {
+		t.Error("Expected built-in catalogue to be untouched")
+	}
+}
+
+func TestLoadInvalidObisCatalogue(t *testing.T) {
+	for _, content := range []string{`{"1.8.0": {"name": "x"}}`, `{"1-0:1.8.0": {"description": "x"}}`, `[]`} {
+		// Given
+		path := filepath.Join(t.TempDir(), "obis.json")
+		os.WriteFile(path, []byte(content), 0644)
+
+		// When
+		_, err := loadObisCatalogue(path)
+
+		// Then
+		if err == nil {
+			t.Errorf("Expected %s to be invalid", content)
+		}
+	}
+
+	if _, err := loadObisCatalogue(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("Expected missing file to fail")
+	}
+}
@@ -0,0 +1,356 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// TimescaleDB features of the table, compression requires it to be a hypertable
+type timescale struct {
+	hypertable bool
+	// age of chunks to compress, none if 0
+	compressAfter time.Duration
+}
+
+type postgresBackend struct {
+	dsn       string
+	tableName string
+	timescale timescale
+	// guards the connection, as cached measurements are sent concurrently
+	mutex       sync.Mutex
+	database    *sql.DB
+	initialized bool
+	healthy     atomic.Bool
+}
+
+func InitializePostgres(
+	postgresDSN string,
+	tableName string,
+	timescale timescale,
+) *postgresBackend {
+	fmt.Printf("Init PostgreSQL\n")
+	return &postgresBackend{dsn: postgresDSN, tableName: tableName, timescale: timescale}
+}
+
+// selectPostgresDSN returns the configured DSN along with the TLS options set
+func selectPostgresDSN(config map[string]string) string {
+	dsn, err := withSslOptions(config[PostgresDSN], [][2]string{
+		{"sslmode", config[PostgresSslMode]},
+		{"sslrootcert", config[PostgresSslRootCert]},
+		{"sslcert", config[PostgresSslCert]},
+		{"sslkey", config[PostgresSslKey]},
+	})
+	if err != nil {
+		printHelpAndExit(fmt.Sprintf("Illegal PostgreSQL DSN: %s\n", err))
+	}
+	return dsn
+}
+
+func selectTimescale(config map[string]string) timescale {
+	hypertable, err := strconv.ParseBool(config[PostgresTimescale])
+	if err != nil {
+		printHelpAndExit(fmt.Sprintf("Illegal TimescaleDB flag value %s: %s\n", config[PostgresTimescale], err))
+	}
+	var compressAfter time.Duration
+	if value := config[PostgresCompressAfter]; value != "-" {
+		compressAfter, err = time.ParseDuration(value)
+		if err != nil || compressAfter <= 0 {
+			printHelpAndExit(fmt.Sprintf("Illegal compression age %s\n", value))
+		}
+		if !hypertable {
+			printHelpAndExit(fmt.Sprintf("Compression requires %s to be enabled\n", PostgresTimescale))
+		}
+	}
+	return timescale{hypertable: hypertable, compressAfter: compressAfter}
+}
+
+// withSslOptions adds the options not set to "-" to the DSN, both given as URL like "postgres://host/db"
+// or as key/value pairs like "host=localhost dbname=samler"
+func withSslOptions(dsn string, options [][2]string) (string, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		parsed, err := url.Parse(dsn)
+		if err != nil {
+			return "", err
+		}
+		query := parsed.Query()
+		for _, option := range options {
+			if option[1] != "-" {
+				query.Set(option[0], option[1])
+			}
+		}
+		parsed.RawQuery = query.Encode()
+		return parsed.String(), nil
+	}
+
+	quote := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	for _, option := range options {
+		if option[1] != "-" {
+			dsn = strings.TrimSpace(fmt.Sprintf("%s %s='%s'", dsn, option[0], quote.Replace(option[1])))
+		}
+	}
+	return dsn, nil
+}
+
+func (b *postgresBackend) Name() string {
+	return Postgres
+}
+
+// Init connects to the database and creates the schema
+func (b *postgresBackend) Init() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.init()
+}
+
+func (b *postgresBackend) init() error {
+	if b.initialized {
+		return nil
+	}
+	connector, err := pq.NewConnector(b.dsn)
+	if err != nil {
+		return fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+	// lib/pq cancels queries on the server, but doesn't stop waiting for an unresponsive one
+	connector.Dialer(deadlineDialer{})
+	db := sql.OpenDB(connector)
+	db.SetConnMaxLifetime(3 * time.Minute)
+	db.SetMaxOpenConns(3)
+	db.SetMaxIdleConns(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "select now()"); err != nil {
+		db.Close()
+		return fmt.Errorf("could not connect to database: %w", err)
+	}
+	if !setupPostgresSchema(db, b.tableName, b.timescale) {
+		db.Close()
+		return fmt.Errorf("failed to set up schema of %s", b.tableName)
+	}
+
+	b.database = db
+	b.initialized = true
+	return nil
+}
+
+func (b *postgresBackend) Send(measurement Measurement) bool {
+	return b.SendBatch([]Measurement{measurement})
+}
+
+// SendBatch copies all measurements within a single transaction
+func (b *postgresBackend) SendBatch(measurements []Measurement) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	err := b.init()
+	if err == nil {
+		err = b.copy(measurements)
+		if err != nil {
+			// reconnects on the next attempt
+			b.database.Close()
+			b.initialized = false
+		}
+	}
+	b.healthy.Store(err == nil)
+	if err != nil {
+		log.Printf("Failed sending to PostgreSQL %s\n", err)
+		return false
+	}
+	return true
+}
+
+// copy writes the measurements using COPY, being way faster than INSERTs for larger batches
+func (b *postgresBackend) copy(measurements []Measurement) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	tx, err := b.database.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statement, err := tx.PrepareContext(ctx, copyStatement(b.tableName))
+	if err != nil {
+		return err
+	}
+	defer statement.Close()
+	for _, measurement := range measurements {
+		debug("Sending to PostgreSQL", &measurement)
+		if _, err := statement.ExecContext(ctx, postgresRow(measurement)...); err != nil {
+			return err
+		}
+	}
+	// flushes the buffered rows
+	if _, err := statement.ExecContext(ctx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// postgresRow passes the status as text, as database/sql refuses uint64 values with the high bit set
+func postgresRow(measurement Measurement) []any {
+	row := sqlRow(measurement)
+	if measurement.HasStatus {
+		row[slices.Index(sqlColumns, "status")] = strconv.FormatUint(measurement.Status, 10)
+	}
+	return row
+}
+
+// copyStatement returns the COPY into the table, which may be qualified by its schema like "energy.home_power"
+func copyStatement(tableName string) string {
+	if schema, table, ok := strings.Cut(tableName, "."); ok {
+		return pq.CopyInSchema(schema, table, sqlColumns...)
+	}
+	return pq.CopyIn(tableName, sqlColumns...)
+}
+
+// deadlineDialer limits how long reading from and writing to the server may block
+type deadlineDialer struct{}
+
+func (d deadlineDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialTimeout(network, address, sendTimeout)
+}
+
+func (d deadlineDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return deadlineConn{conn}, nil
+}
+
+type deadlineConn struct {
+	net.Conn
+}
+
+func (c deadlineConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(sendTimeout))
+	return c.Conn.Read(b)
+}
+
+func (c deadlineConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(sendTimeout))
+	return c.Conn.Write(b)
+}
+
+func (b *postgresBackend) Healthy() bool {
+	return b.healthy.Load()
+}
+
+func (b *postgresBackend) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.initialized {
+		b.database.Close()
+		b.initialized = false
+	}
+}
+
+func setupPostgresSchema(db *sql.DB, tableName string, timescale timescale) bool {
+	log.Println("Creating database schema")
+	for _, s := range postgresSchema(tableName, timescale) {
+		if _, err := db.Exec(s); err != nil {
+			log.Printf("Failed to create schema: %s\n", err)
+			return false
+		}
+	}
+
+	if timescale.compressAfter > 0 {
+		if err := enableCompression(db, tableName, timescale.compressAfter); err != nil {
+			log.Printf("Failed to enable compression: %s\n", err)
+			return false
+		}
+	}
+	return true
+}
+
+// postgresSchema returns the statements creating the table, and turning it into a hypertable if configured
+func postgresSchema(tableName string, timescale timescale) []string {
+	schema := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			id bigint GENERATED ALWAYS AS IDENTITY,
+			time timestamptz NOT NULL,
+			ident text NOT NULL,
+			value double precision,
+			unit text,
+			prefix text,
+			suffix text,
+			server_id text,
+			text_value text,
+			status numeric(20),
+			device text,
+			obis_name text,
+			aggregate text,
+			PRIMARY KEY (id, time)
+			)`, tableName),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_time_idx ON %s (time DESC)", strings.ReplaceAll(tableName, ".", "_"), tableName),
+	}
+	if timescale.hypertable {
+		schema = append(schema,
+			"CREATE EXTENSION IF NOT EXISTS timescaledb",
+			// partitioned by time, keeping the rows of tables created before
+			fmt.Sprintf("SELECT create_hypertable('%s', 'time', if_not_exists => TRUE, migrate_data => TRUE, create_default_indexes => FALSE)", tableName),
+		)
+	}
+	return schema
+}
+
+// enableCompression compresses chunks older than the given age, segmented by the measurements of a meter
+func enableCompression(db *sql.DB, tableName string, after time.Duration) error {
+	var enabled bool
+	if err := db.QueryRow(`SELECT compression_enabled FROM timescaledb_information.hypertables
+		WHERE format('%I.%I', hypertable_schema, hypertable_name)::regclass = $1::regclass`, tableName,
+	).Scan(&enabled); err != nil {
+		return err
+	}
+	// the settings can't be changed once chunks are compressed
+	if !enabled {
+		log.Printf("Enabling compression of %s\n", tableName)
+		if _, err := db.Exec(compressionSettings(tableName)); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec(compressionPolicy(tableName, after))
+	return err
+}
+
+func compressionSettings(tableName string) string {
+	return fmt.Sprintf(`ALTER TABLE %s SET (
+			timescaledb.compress,
+			timescaledb.compress_segmentby = 'device, ident',
+			timescaledb.compress_orderby = 'time DESC'
+			)`, tableName)
+}
+
+func compressionPolicy(tableName string, after time.Duration) string {
+	return fmt.Sprintf("SELECT add_compression_policy('%s', INTERVAL '%d seconds', if_not_exists => TRUE)", tableName, int64(after.Seconds()))
+}
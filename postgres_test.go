@@ -0,0 +1,278 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	testcontainers "github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+func TestFailingPostgresSend(t *testing.T) {
+	// Given
+	sender := InitializePostgres("host=localhost port=1 connect_timeout=1", "", timescale{})
+	m := Measurement{}
+
+	// When
+	success := sender.Send(m)
+
+	// Then
+	if success != false || sender.Healthy() {
+		t.Fatal()
+	}
+}
+
+func TestWithSslOptions(t *testing.T) {
+	// Given
+	options := [][2]string{
+		{"sslmode", "verify-full"},
+		{"sslrootcert", "/etc/ssl/it's.pem"},
+		{"sslcert", "-"},
+	}
+
+	// When
+	keyValue, err := withSslOptions("host=db dbname=samler", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, err := withSslOptions("postgres://user:secret@db:5432/samler?sslmode=disable", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unchanged, _ := withSslOptions("host=db", [][2]string{{"sslmode", "-"}})
+	escaped, _ := withSslOptions("", [][2]string{{"sslkey", `C:\keys\my key.pem`}})
+
+	// Then
+	if keyValue != `host=db dbname=samler sslmode='verify-full' sslrootcert='/etc/ssl/it\'s.pem'` {
+		t.Errorf("Unexpected key/value DSN %s", keyValue)
+	}
+	if url != "postgres://user:secret@db:5432/samler?sslmode=verify-full&sslrootcert=%2Fetc%2Fssl%2Fit%27s.pem" {
+		t.Errorf("Unexpected URL DSN %s", url)
+	}
+	if escaped != `sslkey='C:\\keys\\my key.pem'` {
+		t.Errorf("Expected backslashes escaped and spaces quoted, got %s", escaped)
+	}
+	if unchanged != "host=db" {
+		t.Errorf("Expected unset options to be skipped, got %s", unchanged)
+	}
+}
+
+func TestCopyStatement(t *testing.T) {
+	if statement := copyStatement("measures"); statement != `COPY "measures" ("time", "ident", "value", "unit", "prefix", "suffix", "server_id", "text_value", "status", "device", "obis_name", "aggregate") FROM STDIN` {
+		t.Errorf("Unexpected statement %s", statement)
+	}
+	if statement := copyStatement("energy.measures"); statement[:27] != `COPY "energy"."measures" ("` {
+		t.Errorf("Expected the schema to be quoted separately, got %s", statement)
+	}
+}
+
+// copyRecorder is a database/sql driver recording the rows copied, converting values the same way as for lib/pq
+type copyRecorder struct {
+	mutex     sync.Mutex
+	statement string
+	rows      [][]driver.Value
+	committed bool
+}
+
+func (r *copyRecorder) Connect(context.Context) (driver.Conn, error) { return r, nil }
+func (r *copyRecorder) Driver() driver.Driver                        { return nil }
+func (r *copyRecorder) Close() error                                 { return nil }
+func (r *copyRecorder) Begin() (driver.Tx, error)                    { return r, nil }
+func (r *copyRecorder) Rollback() error                              { return nil }
+func (r *copyRecorder) NumInput() int                                { return -1 }
+
+func (r *copyRecorder) Prepare(query string) (driver.Stmt, error) {
+	r.statement = query
+	return r, nil
+}
+
+func (r *copyRecorder) Commit() error {
+	r.committed = true
+	return nil
+}
+
+func (r *copyRecorder) Exec(args []driver.Value) (driver.Result, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	// the final call without values flushes the copied rows
+	if len(args) > 0 {
+		r.rows = append(r.rows, args)
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (r *copyRecorder) Query([]driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestPostgresCopy(t *testing.T) {
+	// Given
+	recorder := &copyRecorder{}
+	backend := InitializePostgres("", "energy.measures", timescale{})
+	backend.database = sql.OpenDB(recorder)
+	backend.initialized = true
+	now := time.Now()
+
+	// When
+	success := backend.SendBatch([]Measurement{
+		{Time: now, Ident: "1.8.0", Type: NumberValue, Value: 1.5, Device: "home"},
+		{Time: now, Ident: "96.5.0", Type: StringValue, Text: "ok", Status: 1 << 63, HasStatus: true},
+	})
+
+	// Then
+	if !success || !backend.Healthy() || !recorder.committed {
+		t.Fatal("Expected the batch to be copied and committed")
+	}
+	if recorder.statement != copyStatement("energy.measures") {
+		t.Errorf("Unexpected statement %s", recorder.statement)
+	}
+	if len(recorder.rows) != 2 || len(recorder.rows[0]) != len(sqlColumns) {
+		t.Fatalf("Unexpected rows %v", recorder.rows)
+	}
+	if recorder.rows[0][2] != 1.5 || recorder.rows[0][8] != nil || recorder.rows[0][9] != "home" {
+		t.Errorf("Unexpected number row %v", recorder.rows[0])
+	}
+	if recorder.rows[1][2] != nil || recorder.rows[1][7] != "ok" || recorder.rows[1][8] != "9223372036854775808" {
+		t.Errorf("Unexpected text row %v", recorder.rows[1])
+	}
+}
+
+func TestPostgresSchema(t *testing.T) {
+	// When
+	plain := postgresSchema("energy.measures", timescale{})
+	hypertable := postgresSchema("energy.measures", timescale{hypertable: true})
+
+	// Then
+	if len(plain) != 2 || !strings.Contains(plain[0], "status numeric(20)") || !strings.Contains(plain[1], "energy_measures_time_idx ON energy.measures") {
+		t.Errorf("Unexpected schema %v", plain)
+	}
+	if len(hypertable) != 4 || !strings.HasPrefix(hypertable[3], "SELECT create_hypertable('energy.measures', 'time'") {
+		t.Errorf("Unexpected hypertable schema %v", hypertable)
+	}
+	if !strings.Contains(compressionSettings("measures"), "timescaledb.compress_segmentby = 'device, ident'") {
+		t.Errorf("Unexpected compression settings %s", compressionSettings("measures"))
+	}
+	if policy := compressionPolicy("measures", 7*24*time.Hour); policy != "SELECT add_compression_policy('measures', INTERVAL '604800 seconds', if_not_exists => TRUE)" {
+		t.Errorf("Unexpected compression policy %s", policy)
+	}
+}
+
+func TestSelectTimescale(t *testing.T) {
+	ts := selectTimescale(map[string]string{PostgresTimescale: "true", PostgresCompressAfter: "168h"})
+	if !ts.hypertable || ts.compressAfter != 7*24*time.Hour {
+		t.Errorf("Unexpected timescale options %+v", ts)
+	}
+
+	if ts := selectTimescale(map[string]string{PostgresTimescale: "false", PostgresCompressAfter: "-"}); ts.hypertable || ts.compressAfter != 0 {
+		t.Errorf("Unexpected timescale options %+v", ts)
+	}
+}
+
+func TestSuccessfulPostgresSend(t *testing.T) {
+	// Setup testcontainer
+	req := testcontainers.ContainerRequest{
+		Image:        "timescale/timescaledb:latest-pg17",
+		ExposedPorts: []string{"5432/tcp"},
+		WaitingFor:   wait.ForLog("database system is ready to accept connections").WithOccurrence(2),
+		Env: map[string]string{
+			"POSTGRES_PASSWORD": "password",
+			"POSTGRES_DB":       "samler",
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, _ := container.Host(ctx)
+	port, _ := container.MappedPort(ctx, "5432/tcp")
+
+	// Given
+	dsn := fmt.Sprintf("postgres://postgres:password@%s:%d/samler", host, port.Num())
+
+	sender := selectBackends(map[string]string{
+		Backends:              "postgres",
+		PostgresDSN:           dsn,
+		PostgresTable:         "measures",
+		PostgresSslMode:       "disable",
+		PostgresSslRootCert:   "-",
+		PostgresSslCert:       "-",
+		PostgresSslKey:        "-",
+		PostgresTimescale:     "true",
+		PostgresCompressAfter: "168h",
+	})[0]
+
+	m := Measurement{
+		Time:     time.Now(),
+		Value:    22.5,
+		Unit:     "°",
+		Ident:    "0.8.15",
+		Prefix:   "1-2",
+		Suffix:   "667",
+		ServerId: "0a01",
+		// beyond int64
+		Status:    1 << 63,
+		HasStatus: true,
+	}
+
+	// When
+	success := sender.SendBatch([]Measurement{m, m})
+
+	// Then
+	if !success {
+		t.Fatal()
+	}
+
+	db, err := sql.Open("postgres", dsn+"?sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := db.Query("select ident, value, unit, prefix, suffix, server_id from measures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := 0
+	for res.Next() {
+		var value float32
+		var ident, unit, prefix, suffix, serverId string
+		if err := res.Scan(&ident, &value, &unit, &prefix, &suffix, &serverId); err != nil {
+			t.Fatal(err)
+		}
+		if value != 22.5 || unit != "°" || prefix != "1-2" || suffix != "667" || ident != "0.8.15" || serverId != "0a01" {
+			t.Fatal()
+		}
+		rows++
+	}
+	if rows != 2 {
+		t.Fatalf("Expected 2 rows, got %d", rows)
+	}
+}
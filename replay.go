@@ -0,0 +1,120 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+const ReplayScheme = "file://"
+
+// pacedReader passes a recorded SML byte stream through, holding back each frame by the interval
+type pacedReader struct {
+	reader   *bufio.Reader
+	interval time.Duration
+	window   []byte
+	frames   int
+	pause    bool
+}
+
+func newPacedReader(reader io.Reader, interval time.Duration) *pacedReader {
+	return &pacedReader{
+		reader:   bufio.NewReader(reader),
+		interval: interval,
+		window:   make([]byte, len(smlStart)),
+	}
+}
+
+func (p *pacedReader) Read(buffer []byte) (int, error) {
+	if p.pause {
+		time.Sleep(p.interval)
+		p.pause = false
+	}
+
+	n := 0
+	for n < len(buffer) {
+		b, err := p.reader.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		buffer[n] = b
+		n++
+
+		copy(p.window, p.window[1:])
+		p.window[len(p.window)-1] = b
+		if bytes.Equal(p.window, smlStart) {
+			p.frames++
+			if p.frames > 1 {
+				// hand out what's read so far, the next frame follows after the interval
+				p.pause = true
+				return n, nil
+			}
+		}
+	}
+	return n, nil
+}
+
+func parseReplayInterval(interval string) time.Duration {
+	duration, err := time.ParseDuration(interval)
+	if err != nil || duration < 0 {
+		printHelpAndExit(fmt.Sprintf("Illegal replay interval %s\n", interval))
+	}
+	return duration
+}
+
+// openReplay opens a recorded SML byte stream, paced by the interval unless it's zero
+func openReplay(path string, interval time.Duration) (*os.File, error) {
+	file, err := os.Open(path)
+	if err != nil || interval == 0 {
+		return file, err
+	}
+
+	// the libsml listener requires a file descriptor, so the paced stream is passed through a pipe
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	go func() {
+		defer file.Close()
+		defer writer.Close()
+		if _, err := io.Copy(writer, newPacedReader(file, interval)); err != nil {
+			log.Printf("Failed replaying %s: %s\n", path, err)
+		}
+	}()
+	return reader, nil
+}
+
+// replay hands a recorded SML byte stream to listen, returning once it's consumed
+func replay(path string, interval time.Duration, listen func(file *os.File) int) {
+	fmt.Printf("Replay %s\n", path)
+	file, err := openReplay(path, interval)
+	if err != nil {
+		log.Fatalf("Failed to open replay %s: %s\n", path, err)
+	}
+	defer file.Close()
+
+	exitCode := listen(file)
+	fmt.Printf("Replay of %s finished (exit: %d)\n", path, exitCode)
+}
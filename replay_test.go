@@ -0,0 +1,80 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCapture(t *testing.T, frames ...[]byte) string {
+	path := filepath.Join(t.TempDir(), "capture.bin")
+	if err := os.WriteFile(path, bytes.Join(frames, nil), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPacedReader(t *testing.T) {
+	// Given
+	first := smlTestFrame(smlTestGetListResponse([]byte{0x0a, 0x01}, smlTestEnergy))
+	second := smlTestFrame(smlTestGetListResponse([]byte{0x0a, 0x01}, smlTestPower))
+	stream := bytes.Join([][]byte{first, {0x42}, second, second}, nil)
+	started := time.Now()
+
+	// When
+	replayed, err := io.ReadAll(newPacedReader(bytes.NewReader(stream), 50*time.Millisecond))
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(replayed, stream) {
+		t.Error("Replayed stream differs")
+	}
+	if elapsed := time.Since(started); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected two pauses, took %s", elapsed)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	// Given
+	path := writeTestCapture(t,
+		smlTestFrame(smlTestGetListResponse([]byte{0x0a, 0x01}, smlTestEnergy)),
+		smlTestFrame(smlTestGetListResponse([]byte{0x0a, 0x01}, smlTestPower)),
+	)
+
+	for _, interval := range []time.Duration{0, time.Millisecond} {
+		// When
+		replay(path, interval, func(file *os.File) int {
+			return listenNative(&meter{}, file)
+		})
+
+		// Then
+		if energy := <-_messages; energy.Ident != "1.8.0" {
+			t.Errorf("Expected 1.8.0, got %s", energy.Ident)
+		}
+		if power := <-_messages; power.Ident != "16.7.0" {
+			t.Errorf("Expected 16.7.0, got %s", power.Ident)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultRule is the pattern of the rule applying to all measurements not matched by another rule
+const defaultRule = "default"
+
+// rule holds the options configured for the measurements matched by its filter,
+// the filter of the default rule is empty what matches everything
+type rule struct {
+	filter  identFilter
+	options map[string]string
+}
+
+// parseRules parses rules separated by ';', each of them comma separated filter patterns or "default",
+// followed by whitespace separated options like "deadband=5" or flags like "always":
+//
+//	16.7.0 deadband=5 heartbeat=5m; 1.8.0,2.8.0 deadband=0.1%; default heartbeat=1m
+//
+// the default rule is returned last, regardless where it's configured
+func parseRules(rules string) ([]rule, error) {
+	parsed := []rule{}
+	var fallback *rule
+	for _, raw := range strings.Split(rules, ";") {
+		fields := strings.Fields(raw)
+		if len(fields) == 0 || len(fields) == 1 && fields[0] == "-" {
+			continue
+		}
+
+		r := rule{options: map[string]string{}}
+		for _, option := range fields[1:] {
+			key, value, hasValue := strings.Cut(option, "=")
+			if !hasValue {
+				value = "true"
+			}
+			if key == "" || value == "" {
+				return nil, fmt.Errorf("invalid option '%s' of rule '%s'", option, strings.TrimSpace(raw))
+			}
+			r.options[key] = value
+		}
+
+		if fields[0] == defaultRule {
+			if fallback != nil {
+				return nil, fmt.Errorf("duplicate default rule '%s'", strings.TrimSpace(raw))
+			}
+			fallback = &r
+			continue
+		}
+		filter, err := parseIdentFilter(fields[0])
+		if err == nil && len(filter) == 0 {
+			err = fmt.Errorf("missing patterns")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule '%s': %s", strings.TrimSpace(raw), err)
+		}
+		r.filter = filter
+		parsed = append(parsed, r)
+	}
+
+	if fallback != nil {
+		parsed = append(parsed, *fallback)
+	}
+	return parsed, nil
+}
+
+// isDefault tells whether the rule applies to all measurements
+func (r rule) isDefault() bool {
+	return len(r.filter) == 0
+}
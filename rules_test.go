@@ -0,0 +1,58 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import "testing"
+
+func TestParseRules(t *testing.T) {
+	// When
+	rules, err := parseRules(" default heartbeat=1m ; 16.7.0,!1-0:16.7.0*1 deadband=5 always;; 1.8.0 deadband=0.1% ")
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("Expected 3 rules, got %d", len(rules))
+	}
+	if rules[0].filter.String() != "16.7.0,!1-0:16.7.0*1" || rules[0].options["deadband"] != "5" || rules[0].options["always"] != "true" {
+		t.Errorf("Unexpected first rule %s %v", rules[0].filter, rules[0].options)
+	}
+	if rules[1].filter.String() != "1.8.0" || rules[1].options["deadband"] != "0.1%" {
+		t.Errorf("Unexpected second rule %s %v", rules[1].filter, rules[1].options)
+	}
+	if !rules[2].isDefault() || rules[2].options["heartbeat"] != "1m" {
+		t.Errorf("Expected default rule last, got %s %v", rules[2].filter, rules[2].options)
+	}
+}
+
+func TestParseEmptyRules(t *testing.T) {
+	for _, raw := range []string{"", "-", " ; "} {
+		if rules, err := parseRules(raw); err != nil || len(rules) != 0 {
+			t.Errorf("Expected no rules of '%s', got %v %v", raw, rules, err)
+		}
+	}
+}
+
+func TestParseInvalidRules(t *testing.T) {
+	for _, raw := range []string{"1.8 deadband=1", "1.8.0 =1", "1.8.0 deadband=", ", deadband=1", "default a=1; default b=2"} {
+		if _, err := parseRules(raw); err == nil {
+			t.Errorf("Expected '%s' to be invalid", raw)
+		}
+	}
+}
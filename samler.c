@@ -31,6 +31,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 #include "libsml/sml/include/sml/sml_file.h"
 #include "libsml/sml/include/sml/sml_transport.h"
 #include "libsml/sml/include/sml/sml_value.h"
+#include "libsml/sml/include/sml/sml_crc16.h"
 
 #include "libsml/examples/unit.h"
 #include "samler.h"
@@ -39,14 +40,126 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 * Most of the following is taken from the libsml examples, many thanks to the volkszaehler project.
 */
 
-// Registered callback
-SmlEvent event;
+// server ids are usually 10 bytes, longer ones get truncated
+#define SERVER_ID_MAX_BYTES 32
+
+// max size of a transport frame, like within libsml
+#define SML_BUFFER_LEN 8096
+
+static const struct {
+	int rate;
+	speed_t speed;
+} baud_rates[] = {
+	{ 50, B50 },
+	{ 75, B75 },
+	{ 110, B110 },
+	{ 134, B134 },
+	{ 150, B150 },
+	{ 200, B200 },
+	{ 300, B300 },
+	{ 600, B600 },
+	{ 1200, B1200 },
+	{ 1800, B1800 },
+	{ 2400, B2400 },
+	{ 4800, B4800 },
+	{ 9600, B9600 },
+	{ 19200, B19200 },
+	{ 38400, B38400 },
+#ifdef B57600
+	{ 57600, B57600 },
+#endif
+#ifdef B115200
+	{ 115200, B115200 },
+#endif
+#ifdef B230400
+	{ 230400, B230400 },
+#endif
+#ifdef B460800
+	{ 460800, B460800 },
+#endif
+#ifdef B921600
+	{ 921600, B921600 },
+#endif
+};
+
+struct SerialMode {
+	tcflag_t dataBits;
+	tcflag_t parity;
+	tcflag_t stopBits;
+};
+
+// looks up the termios speed for the given baud rate, returns false if unsupported
+static bool baud_rate_to_speed(int baudRate, speed_t *speed) {
+	size_t i;
+	for (i = 0; i < sizeof(baud_rates) / sizeof(baud_rates[0]); i++) {
+		if (baud_rates[i].rate == baudRate) {
+			*speed = baud_rates[i].speed;
+			return true;
+		}
+	}
+	return false;
+}
+
+// parses a mode like "8-N-1" or "7-E-1": <databits 5-8>-<parity N/E/O>-<stopbits 1/2>
+static bool parse_mode(const char *mode, struct SerialMode *serialMode) {
+	if (mode == NULL || strlen(mode) != 5 || mode[1] != '-' || mode[3] != '-') {
+		return false;
+	}
+
+	switch (mode[0]) {
+		case '5': serialMode->dataBits = CS5; break;
+		case '6': serialMode->dataBits = CS6; break;
+		case '7': serialMode->dataBits = CS7; break;
+		case '8': serialMode->dataBits = CS8; break;
+		default: return false;
+	}
+
+	switch (toupper((unsigned char) mode[2])) {
+		case 'N': serialMode->parity = 0; break;
+		case 'E': serialMode->parity = PARENB; break;
+		case 'O': serialMode->parity = PARENB | PARODD; break;
+		default: return false;
+	}
+
+	switch (mode[4]) {
+		case '1': serialMode->stopBits = 0; break;
+		case '2': serialMode->stopBits = CSTOPB; break;
+		default: return false;
+	}
+
+	return true;
+}
+
+int check_device_config(struct DeviceConfig config) {
+	speed_t speed;
+	struct SerialMode serialMode;
+
+	if (!baud_rate_to_speed(config.baudRate, &speed)) {
+		return DEVICE_CONFIG_INVALID_BAUD_RATE;
+	}
+	if (!parse_mode(config.mode, &serialMode)) {
+		return DEVICE_CONFIG_INVALID_MODE;
+	}
+	return DEVICE_CONFIG_OK;
+}
 
 int serial_port_open(struct DeviceConfig *deviceConfig) {
 	int bits;
+	speed_t speed;
+	struct SerialMode serialMode;
 	struct termios config;
 	memset(&config, 0, sizeof(config));
 
+	if (!parse_mode(deviceConfig->mode, &serialMode)) {
+		fprintf(stderr, "error: unsupported mode: %s\n", deviceConfig->mode);
+		return DEVICE_CONFIG_INVALID_MODE;
+	}
+
+	if (!baud_rate_to_speed(deviceConfig->baudRate, &speed)) {
+		fprintf(stderr, "error: unsupported baud rate: %d\n", deviceConfig->baudRate);
+		return DEVICE_CONFIG_INVALID_BAUD_RATE;
+	}
+
 #ifdef O_NONBLOCK
 	int fd = open(deviceConfig->name, O_RDWR | O_NOCTTY | O_NONBLOCK);
 #else
@@ -64,37 +177,242 @@ int serial_port_open(struct DeviceConfig *deviceConfig) {
 
 	tcgetattr(fd, &config);
 
-	if (strcmp(deviceConfig->mode, "8-N-1") == 0) {
-		// set 8-N-1
-		config.c_iflag &= ~(IGNBRK | BRKINT | PARMRK | ISTRIP | INLCR | IGNCR
-				| ICRNL | IXON);
-		config.c_oflag &= ~OPOST;
-		config.c_lflag &= ~(ECHO | ECHONL | ICANON | ISIG | IEXTEN);
-		config.c_cflag &= ~(CSIZE | PARENB | PARODD | CSTOPB);
-		config.c_cflag |= CS8;
-	} else {
-		fprintf(stderr, "error: unsupported mode: %s\n", deviceConfig->mode);
+	// raw mode with the configured framing
+	config.c_iflag &= ~(IGNBRK | BRKINT | PARMRK | ISTRIP | INLCR | IGNCR
+			| ICRNL | IXON | INPCK);
+	config.c_oflag &= ~OPOST;
+	config.c_lflag &= ~(ECHO | ECHONL | ICANON | ISIG | IEXTEN);
+	config.c_cflag &= ~(CSIZE | PARENB | PARODD | CSTOPB);
+	config.c_cflag |= serialMode.dataBits | serialMode.parity | serialMode.stopBits;
+	if (serialMode.parity) {
+		// check the parity of incoming bytes
+		config.c_iflag |= INPCK;
+	}
+
+	cfsetispeed(&config, speed);
+	cfsetospeed(&config, speed);
+
+	tcsetattr(fd, TCSANOW, &config);
+	return fd;
+}
+
+struct SmlTime to_sml_time(sml_time *time) {
+	struct SmlTime smlTime;
+	memset(&smlTime, 0, sizeof(smlTime));
+
+	if (time == NULL || time->tag == NULL) {
+		return smlTime;
+	}
+
+	switch (*time->tag) {
+		case SML_TIME_SEC_INDEX:
+			if (time->data.sec_index) {
+				smlTime.type = SML_TIME_TYPE_SEC_INDEX;
+				smlTime.value = *time->data.sec_index;
+			}
+			break;
+		case SML_TIME_TIMESTAMP:
+			if (time->data.timestamp) {
+				smlTime.type = SML_TIME_TYPE_TIMESTAMP;
+				smlTime.value = *time->data.timestamp;
+			}
+			break;
+		case SML_TIME_LOCAL_TIMESTAMP:
+			// the timestamp is UTC, offsets are for local display only
+			if (time->data.local_timestamp && time->data.local_timestamp->timestamp) {
+				smlTime.type = SML_TIME_TYPE_LOCAL_TIMESTAMP;
+				smlTime.value = *time->data.local_timestamp->timestamp;
+			}
+			break;
+	}
+	return smlTime;
+}
+
+// printable octet strings like firmware versions are passed as text, others hex encoded
+char *octet_string_to_text(octet_string *bytes) {
+	int i;
+	bool printable = bytes->len > 0;
+	for (i = 0; i < bytes->len; i++) {
+		if (!isprint(bytes->str[i])) {
+			printable = false;
+			break;
+		}
+	}
+
+	char *text = malloc(2 * bytes->len + 1);
+	text[0] = '\0';
+	for (i = 0; i < bytes->len; i++) {
+		if (printable) {
+			text[i] = bytes->str[i];
+			text[i + 1] = '\0';
+		} else {
+			snprintf(text + 2 * i, 3, "%02x", bytes->str[i]);
+		}
+	}
+	return text;
+}
+
+bool status_to_uint64(sml_status *status, uint64_t *value) {
+	if (status == NULL) {
+		return false;
+	}
+
+	switch (status->type & SML_LENGTH_FIELD) {
+		case sizeof(u8):
+			if (status->data.status8) {
+				*value = *status->data.status8;
+				return true;
+			}
+			break;
+		case sizeof(u16):
+			if (status->data.status16) {
+				*value = *status->data.status16;
+				return true;
+			}
+			break;
+		case sizeof(u32):
+			if (status->data.status32) {
+				*value = *status->data.status32;
+				return true;
+			}
+			break;
+		case sizeof(u64):
+			if (status->data.status64) {
+				*value = *status->data.status64;
+				return true;
+			}
+			break;
+	}
+	return false;
+}
+
+void count_stat(int device, Callbacks *callbacks, int stat) {
+	if (callbacks->stat != NULL) {
+		callbacks->stat(device, stat);
+	}
+}
+
+// the checksum is transmitted low byte first, but some meters send it the other way around
+bool crc_matches(u16 crc, u16 received) {
+	return received == crc || received == (u16) ((crc << 8) | (crc >> 8));
+}
+
+// returns the number of bytes of the SML element at buffer, or -1 if it exceeds the length
+int sml_element_length(unsigned char *buffer, int len) {
+	int i, pos, length, tl;
+
+	if (len < 1) {
 		return -1;
 	}
+	if (buffer[0] == 0x00) {
+		// end of message
+		return 1;
+	}
 
-	if (deviceConfig->baudRate == 9600) {
-		// set speed to 9600 baud
-		cfsetispeed(&config, B9600);
-		cfsetospeed(&config, B9600);
-	} else {
-		fprintf(stderr, "error: unsupported baud rate: %d\n", deviceConfig->baudRate);
+	length = buffer[0] & SML_LENGTH_FIELD;
+	for (tl = 1; buffer[tl - 1] & SML_ANOTHER_TL; tl++) {
+		if (tl >= len) {
+			return -1;
+		}
+		length = (length << 4) | (buffer[tl] & SML_LENGTH_FIELD);
+	}
+
+	if ((buffer[0] & SML_TYPE_FIELD) == SML_TYPE_LIST) {
+		// the length of lists is the number of their elements
+		pos = tl;
+		for (i = 0; i < length; i++) {
+			int element = sml_element_length(buffer + pos, len - pos);
+			if (element < 0) {
+				return -1;
+			}
+			pos += element;
+		}
+		return pos;
+	}
+
+	// for all other types the length includes the TL field itself
+	if (length < tl || length > len) {
 		return -1;
 	}
+	return length;
+}
 
-	tcsetattr(fd, TCSANOW, &config);
-	return fd;
+// checks the transport checksum, covering the whole frame except the checksum itself
+bool frame_crc_valid(unsigned char *buffer, size_t buffer_len) {
+	if (buffer_len < 16) {
+		return false;
+	}
+	u16 received = (buffer[buffer_len - 2] << 8) | buffer[buffer_len - 1];
+	return crc_matches(sml_crc16_calculate(buffer, buffer_len - 2), received);
 }
 
-void transport_receiver(unsigned char *buffer, size_t buffer_len) {
+// checks the checksums of all messages, each covering the message up to its crc16 element
+bool messages_crc_valid(unsigned char *file, int len) {
+	int i, pos = 0;
+
+	while (pos < len) {
+		if (file[pos] == 0x00) {
+			// padding
+			pos++;
+			continue;
+		}
+
+		// transactionId, groupNo, abortOnError, messageBody, crc16, endOfSmlMsg
+		if (file[pos] != (SML_TYPE_LIST | 6)) {
+			return false;
+		}
+		int start = pos++;
+		for (i = 0; i < 4; i++) {
+			int element = sml_element_length(file + pos, len - pos);
+			if (element < 0) {
+				return false;
+			}
+			pos += element;
+		}
+
+		int crcLength = sml_element_length(file + pos, len - pos);
+		if (crcLength < 2 || crcLength > 3 || (file[pos] & SML_TYPE_FIELD) != SML_TYPE_UNSIGNED) {
+			return false;
+		}
+		u16 received = crcLength == 3 ? (file[pos + 1] << 8) | file[pos + 2] : file[pos + 1];
+		if (!crc_matches(sml_crc16_calculate(file + start, pos - start), received)) {
+			return false;
+		}
+		pos += crcLength;
+
+		// end of message
+		if (pos >= len || file[pos] != 0x00) {
+			return false;
+		}
+		pos++;
+	}
+	return true;
+}
+
+void transport_receiver(int device, Callbacks *callbacks, unsigned char *buffer, size_t buffer_len) {
 	int i;
+
+	// raw frame as received, e.g. for capturing
+	if (callbacks->frame != NULL) {
+		callbacks->frame(device, buffer, buffer_len);
+	}
+
+	// garbage, e.g. of an IR head in sunlight, is discarded instead of emitting bogus values
+	if (!frame_crc_valid(buffer, buffer_len) || !messages_crc_valid(buffer + 8, buffer_len - 16)) {
+		fprintf(stderr, "Invalid checksum, skipping frame.\n");
+		count_stat(device, callbacks, SML_STAT_CRC_ERROR);
+		return;
+	}
+
 	// the buffer contains the whole message, with transport escape sequences.
 	// these escape sequences are stripped here.
 	sml_file *file = sml_file_parse(buffer + 8, buffer_len - 16);
+	if (file == NULL) {
+		fprintf(stderr, "Failed to parse frame, skipping it.\n");
+		count_stat(device, callbacks, SML_STAT_PARSE_ERROR);
+		return;
+	}
+	count_stat(device, callbacks, SML_STAT_FRAME_OK);
 
 	for (i = 0; i < file->messages_len; i++) {
 		sml_message *message = file->messages[i];
@@ -103,35 +421,50 @@ void transport_receiver(unsigned char *buffer, size_t buffer_len) {
 			sml_list *entry;
 			sml_get_list_response *body;
 			body = (sml_get_list_response *) message->message_body->data;
+
+			char serverIdString[2 * SERVER_ID_MAX_BYTES + 1] = "";
+			if (body->server_id) {
+				int j;
+				for (j = 0; j < body->server_id->len && j < SERVER_ID_MAX_BYTES; j++) {
+					snprintf(serverIdString + 2 * j, 3, "%02x", body->server_id->str[j]);
+				}
+			}
+
+			struct SmlTime sensorTime = to_sml_time(body->act_sensor_time);
+
 			for (entry = body->val_list; entry != NULL; entry = entry->next) {
 
-				char identString[10] = "";
-				char prefixString[5] = "";
+				// sized for the largest groups like "255.255.255"
+				char identString[12] = "";
+				char prefixString[8] = "";
 				char suffixString[5] = "";
 				char valueString[20] = "";
 				char unitString[5] = "";
+				char *text = NULL;
+				int valueType = SML_VALUE_NUMBER;
 
 				if (!entry->value) { // do not crash on null value
 					fprintf(stderr, "Error in data stream. entry->value should not be NULL. Skipping this.\n");
+					count_stat(device, callbacks, SML_STAT_NULL_VALUE);
 					continue;
 				}
-				snprintf(prefixString, 5, "%d-%d",
+				snprintf(prefixString, sizeof(prefixString), "%d-%d",
 						entry->obj_name->str[0], entry->obj_name->str[1]
 				);
-				snprintf(identString, 10, "%d.%d.%d",
+				snprintf(identString, sizeof(identString), "%d.%d.%d",
 						entry->obj_name->str[2], entry->obj_name->str[3], entry->obj_name->str[4]
 				);
 				snprintf(suffixString, 5, "%d", entry->obj_name->str[5]);
 
 				if (entry->value->type == SML_TYPE_OCTET_STRING) {
 
-					char *str;
-					snprintf(valueString, 20, "%s", sml_value_to_strhex(entry->value, &str, true));
-					free(str);
+					text = octet_string_to_text(entry->value->data.bytes);
+					valueType = SML_VALUE_STRING;
 
 				} else if (entry->value->type == SML_TYPE_BOOLEAN) {
 
 					snprintf(valueString, 20, "%s", entry->value->data.boolean ? "true" : "false");
+					valueType = SML_VALUE_BOOL;
 
 				} else if (((entry->value->type & SML_TYPE_FIELD) == SML_TYPE_INTEGER) ||
 						((entry->value->type & SML_TYPE_FIELD) == SML_TYPE_UNSIGNED)) {
@@ -150,20 +483,31 @@ void transport_receiver(unsigned char *buffer, size_t buffer_len) {
 
 					snprintf(valueString, 20, "%.*f", prec, value);
 					snprintf(unitString, 5,  "%s", unit != NULL ? unit : "");
+				} else {
+					// lists or unknown types can't be passed on
+					continue;
 				}
 
 				struct SmlValue smlValue;
 				memset(&smlValue, 0, sizeof(smlValue));
 				smlValue.ident = identString;
-				smlValue.value = valueString;
+				smlValue.value = text != NULL ? text : valueString;
 				smlValue.unit = unitString;
 				smlValue.prefix = prefixString;
 				smlValue.suffix = suffixString;
+				smlValue.type = valueType;
+				smlValue.hasStatus = status_to_uint64(entry->status, &smlValue.status);
 
 				struct SmlData smlData;
 				memset(&smlData, 0, sizeof(smlData));
+				smlData.device = device;
 				smlData.value = smlValue;
-				event(smlData);
+				smlData.serverId = serverIdString;
+				smlData.sensorTime = sensorTime;
+				smlData.valueTime = to_sml_time(entry->val_time);
+				callbacks->event(smlData);
+
+				free(text);
 			}
 		}
 	}
@@ -172,18 +516,20 @@ void transport_receiver(unsigned char *buffer, size_t buffer_len) {
 	sml_file_free(file);
 }
 
-int listen_to_device(struct DeviceConfig config, Callbacks callbacks){
-	event = callbacks.event;
-	// open serial port
-	int fd = serial_port_open(&config);
-	if (fd < 0) {
-		// error message is printed by serial_port_open()
-		return fd;
-	}
+int open_device(struct DeviceConfig config){
+	// open serial port, error messages are printed by serial_port_open()
+	return serial_port_open(&config);
+}
 
-	// listen on the serial device, this call is blocking.
-	sml_transport_listen(fd, &transport_receiver);
-	close(fd);
+int listen_to_fd(int fd, int device, Callbacks callbacks){
+	unsigned char buffer[SML_BUFFER_LEN];
+	size_t bytes;
+
+	// like sml_transport_listen, but passing the device to the receiver, so multiple devices can be listened to in parallel.
+	// this call is blocking until the stream ends or fails.
+	while ((bytes = sml_transport_read(fd, buffer, SML_BUFFER_LEN)) > 0) {
+		transport_receiver(device, &callbacks, buffer, bytes);
+	}
 
 	return 0;
 }
@@ -192,3 +538,13 @@ int listen_to_device(struct DeviceConfig config, Callbacks callbacks){
 void propagateEvent(struct SmlData msg) {
 	onSmlMessage(msg);
 }
+
+// handler function, passed from the Go part as callback if capturing is enabled
+void propagateFrame(int device, unsigned char *buffer, size_t length) {
+	onSmlFrame(device, buffer, length);
+}
+
+// handler function, passed from the Go part as callback
+void propagateStat(int device, int stat) {
+	onSmlStat(device, stat);
+}
@@ -18,32 +18,56 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/fs"
 	"log"
 	"os"
-	"slices"
 	"strings"
 	"time"
+)
+
+type ValueType int
 
-	diskqueue "github.com/nsqio/go-diskqueue"
+const (
+	NumberValue ValueType = iota
+	StringValue
+	BoolValue
 )
 
 type Measurement struct {
+	// name of the meter the measurement was received from
+	Device string
 	Ident  string
-	Unit   string
-	Prefix string
-	Suffix string
-	Value  float64
-	Time   time.Time
+	// stable name of the OBIS code like "energy_import_total", empty if not catalogued
+	Name     string
+	Unit     string
+	Prefix   string
+	Suffix   string
+	ServerId string
+	Type     ValueType
+	// numeric value, 1 or 0 for bool values
+	Value float64
+	// textual representation of string and bool values
+	Text      string
+	Status    uint64
+	HasStatus bool
+	Time      time.Time
+	// statistic of an aggregated time window like "mean", empty for single readings
+	Aggregate string
+}
+
+// key identifies the measurement of a meter, regardless of its reading
+func (m *Measurement) key() string {
+	return fmt.Sprintf("%s#%s#%s#%s#%s", m.Device, m.ServerId, m.Prefix, m.Ident, m.Suffix)
 }
 
 type samler struct {
 	messageChannel chan Measurement
-	send           func(Measurement) bool
+	backends       []Backend
 	cacheLocation  string
-	identFilter    []string
+	identFilter    identFilter
+	stopping       chan struct{}
+	stopped        chan struct{}
 }
 
 var memo = make(map[string]Measurement)
@@ -56,17 +80,25 @@ func debug(msg string, measure *Measurement) {
 
 func RunSamler(
 	messageChannel chan Measurement,
-	send func(Measurement) bool,
+	backends []Backend,
 	cacheLocation string,
-	identFilter string,
-) {
+	identFilter identFilter,
+) (stop func()) {
 	samler := samler{
 		messageChannel: messageChannel,
-		send:           send,
+		backends:       backends,
 		cacheLocation:  cacheLocation,
-		identFilter:    toFilterList(identFilter),
+		identFilter:    identFilter,
+		stopping:       make(chan struct{}),
+		stopped:        make(chan struct{}),
 	}
 	go processLoop(&samler)
+
+	// processes the measurements still in the channel and closes the disk queue
+	return func() {
+		close(samler.stopping)
+		<-samler.stopped
+	}
 }
 
 func toFilterList(identFilter string) []string {
@@ -91,14 +123,14 @@ func toFilterList(identFilter string) []string {
 	return identFilterList
 }
 
-func shouldSendAndMemorize(measure Measurement, identFilter []string) bool {
-	if !isRelevant(measure.Ident, identFilter) {
+func shouldSendAndMemorize(measure Measurement, identFilter identFilter) bool {
+	if !identFilter.matches(&measure) {
 		return false
 	}
 
-	key := fmt.Sprintf("%s#%s#%s", measure.Prefix, measure.Ident, measure.Suffix)
+	key := measure.key()
 	previous, ok := memo[key]
-	if !ok || previous.Value != measure.Value || previous.Time.Add(60*time.Second).Before(time.Now()) {
+	if !ok || _sendRules.policyOf(&measure).shouldSend(previous, measure) {
 		debug("Memorized", &measure)
 		memo[key] = measure
 		return true
@@ -108,82 +140,87 @@ func shouldSendAndMemorize(measure Measurement, identFilter []string) bool {
 	}
 }
 
-func isRelevant(ident string, identFilter []string) bool {
-	if len(identFilter) == 0 {
-		return true
-	}
-
-	return slices.Contains(identFilter, ident)
-}
-
 func processLoop(ctx *samler) {
+	defer close(ctx.stopped)
 	fmt.Printf("Init DiskQueue at %s\n", ctx.cacheLocation)
 	if err := os.MkdirAll(ctx.cacheLocation, fs.ModePerm); err != nil {
 		log.Fatal(err)
 	}
-	diskQueue := diskqueue.New("cached", ctx.cacheLocation, 10485760, 4, 1<<10, 4096, 10*time.Second, dqLog)
-	defer diskQueue.Close()
-
-	readChan := diskQueue.ReadChan()
-	peekChan := diskQueue.PeekChan()
-	circuitOpen := false
-
-	send := func(measure Measurement) bool {
-		success := ctx.send(measure)
-		if !success {
-			circuitOpen = true
-			log.Printf("Circuit open")
-			go func() {
-				time.Sleep(30 * time.Second)
-				circuitOpen = false
-				log.Printf("Circuit closed")
-			}()
-		}
-		return success
+
+	// each backend has its own disk queue, sending to all of them
+	adoptLegacyQueue(ctx.backends, ctx.cacheLocation)
+	queues := make([]*backendQueue, len(ctx.backends))
+	for i, backend := range ctx.backends {
+		queues[i] = newBackendQueue(backend, ctx.cacheLocation)
+		defer queues[i].close()
 	}
 
-	writeToDisk := func(measure Measurement) {
-		debug("Writing to disk", &measure)
-		if jsonData, err := json.Marshal(measure); err == nil {
-			diskQueue.Put(jsonData)
-		} else {
-			log.Fatal("Could not serialize measure", err)
+	forward := func(measurement Measurement) {
+		for _, queue := range queues {
+			queue.forward(measurement)
 		}
 	}
 
-	peekFromDisk := func() Measurement {
-		message := <-peekChan
-		var measure Measurement
-		if err := json.Unmarshal(message, &measure); err != nil {
-			log.Fatal("Failed to deserialize msg", err)
+	// aggregated measurements are sent once per window, others if changed
+	aggregator := newAggregator(_aggregationRules)
+	pass := func(measurement Measurement) {
+		// like the global filter, the one of the meter only selects what's sent, not what's validated and derived
+		if !meterFilterOf(measurement.Device).matches(&measurement) {
+			return
+		}
+		if ctx.identFilter.matches(&measurement) && aggregator.add(measurement, forward) {
+			return
+		}
+		if shouldSendAndMemorize(measurement, ctx.identFilter) {
+			forward(measurement)
 		}
-		debug("Read from disk", &measure)
-		return measure
 	}
 
-	removeLastPeeked := func() {
-		<-readChan
+	// derived measurements pass like the ones received, also if the counters they're derived from are filtered
+	deriver := newDeriver(_powerRules)
+	balancer := newBalancer(_balance)
+	derive := func(measurement Measurement) {
+		pass(measurement)
+		for _, balanced := range balancer.balance(measurement) {
+			pass(balanced)
+		}
 	}
-
-	// process disk messages
-	go func() {
-		for {
-			if circuitOpen {
-				time.Sleep(30 * time.Second)
-			}
-			measurement := peekFromDisk()
-			if send(measurement) {
-				removeLastPeeked()
-			}
+	// implausible readings, like misread counters, neither pass nor are taken into account for derived ones
+	quarantine, err := newRotatingFiles(ctx.cacheLocation, "quarantine", ".log", quarantineMaxSize, quarantineMaxAge, quarantineFiles)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer quarantine.close()
+	validator := newValidator(_plausibilityRules, quarantineTo(quarantine))
+	process := func(measurement Measurement) {
+		if !validator.validate(measurement) {
+			return
+		}
+		derive(measurement)
+		if power, ok := deriver.derive(measurement); ok {
+			derive(power)
 		}
-	}()
+	}
 
-	for {
-		measurement := <-ctx.messageChannel
+	ticker := time.NewTicker(aggregationTick)
+	defer ticker.Stop()
 
-		if shouldSendAndMemorize(measurement, ctx.identFilter) {
-			if circuitOpen || !send(measurement) {
-				writeToDisk(measurement)
+	for {
+		select {
+		case measurement := <-ctx.messageChannel:
+			process(measurement)
+		case <-ticker.C:
+			aggregator.flushIdle(forward)
+		case <-ctx.stopping:
+			for {
+				select {
+				case measurement := <-ctx.messageChannel:
+					process(measurement)
+				default:
+					// partial windows are sent as well
+					aggregator.flush(forward)
+					return
+				}
 			}
 		}
 	}
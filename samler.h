@@ -18,33 +18,97 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 #ifndef SML_CGO_H_
 #define SML_CGO_H_
 
+#include <stddef.h>
+#include <stdint.h>
+
 struct DeviceConfig {
     const char *name;
     int baudRate;
     const char *mode;
 };
 
+// results of check_device_config, negative like the errors of open_device
+enum DeviceConfigResult {
+    DEVICE_CONFIG_OK = 0,
+    DEVICE_CONFIG_INVALID_BAUD_RATE = -2,
+    DEVICE_CONFIG_INVALID_MODE = -3,
+};
+
+enum SmlValueType {
+    SML_VALUE_NUMBER = 0,
+    SML_VALUE_STRING = 1,
+    SML_VALUE_BOOL = 2,
+};
+
 struct SmlValue{
     const char *value;
     const char *unit;
     const char *prefix;
     const char *ident;
     const char *suffix;
+    int type;
+    // status word of the entry, if hasStatus is set
+    int hasStatus;
+    uint64_t status;
+};
+
+// kinds of SmlTime, the non zero ones as defined by SML
+enum SmlTimeType {
+    SML_TIME_TYPE_NONE = 0,
+    SML_TIME_TYPE_SEC_INDEX = 1,
+    SML_TIME_TYPE_TIMESTAMP = 2,
+    SML_TIME_TYPE_LOCAL_TIMESTAMP = 3,
+};
+
+struct SmlTime{
+    int type;
+    // seconds index of the meter or UTC unix timestamp
+    uint32_t value;
 };
 
 struct SmlData{
+    // id of the device the data was received from
+    int device;
     struct SmlValue value;
+    // hex encoded server id of the meter
+    const char *serverId;
+    // actSensorTime of the list and valTime of the entry, if provided by the meter
+    struct SmlTime sensorTime;
+    struct SmlTime valueTime;
+};
+
+// outcomes of received frames and their entries, counted by the Go part
+enum SmlStat {
+    SML_STAT_FRAME_OK = 0,
+    SML_STAT_CRC_ERROR = 1,
+    SML_STAT_PARSE_ERROR = 2,
+    SML_STAT_NULL_VALUE = 3,
 };
 
 typedef void (*SmlEvent)(struct SmlData message);
+typedef void (*SmlFrameEvent)(int device, unsigned char *buffer, size_t length);
+typedef void (*SmlStatEvent)(int device, int stat);
 
 typedef struct {
     SmlEvent event;
+    // optional, receives each raw transport frame
+    SmlFrameEvent frame;
+    // optional, receives the outcome of each frame and skipped entries
+    SmlStatEvent stat;
 } Callbacks;
 
-int listen_to_device(struct DeviceConfig config, Callbacks callbacks);
+int check_device_config(struct DeviceConfig config);
+// returns the file descriptor of the opened serial device or a negative error
+int open_device(struct DeviceConfig config);
+int listen_to_fd(int fd, int device, Callbacks callbacks);
 
 extern void onSmlMessage(struct SmlData);
 void propagateEvent(struct SmlData message);
 
+extern void onSmlFrame(int device, unsigned char *buffer, size_t length);
+void propagateFrame(int device, unsigned char *buffer, size_t length);
+
+extern void onSmlStat(int device, int stat);
+void propagateStat(int device, int stat);
+
 #endif
@@ -49,10 +49,11 @@ func TestSuccessfullSending(t *testing.T) {
 		sent = m
 		return true
 	}
-	RunSamler(messages, send, tempDir(), "")
+	stop := RunSamler(messages, []Backend{SenderFunc(send)}, tempDir(), nil)
 
 	// When
 	messages <- measurement
+	stop()
 
 	// Then
 	if sent.Value != 42.23 {
@@ -80,7 +81,7 @@ func TestFailedSending(t *testing.T) {
 		result = !result
 		return result
 	}
-	RunSamler(messages, send, tempDir(), "")
+	RunSamler(messages, []Backend{SenderFunc(send)}, tempDir(), nil)
 
 	// When
 	messages <- measurement
@@ -97,6 +98,28 @@ func TestFailedSending(t *testing.T) {
 	}
 }
 
+func TestStopSendsRemaining(t *testing.T) {
+	// Given
+	messages := make(chan Measurement, 10)
+	sent := 0
+	send := func(m Measurement) bool {
+		sent++
+		return true
+	}
+	stop := RunSamler(messages, []Backend{SenderFunc(send)}, tempDir(), nil)
+
+	// When
+	for i := range 10 {
+		messages <- Measurement{Ident: "stop", Value: float64(i), Time: time.Now()}
+	}
+	stop()
+
+	// Then
+	if sent != 10 {
+		t.Errorf("Expected 10 sent, got %d", sent)
+	}
+}
+
 func TestToEmptyFilterList(t *testing.T) {
 	// Given
 	empties := []string{"-", "", " ", ",", " ,   , "}
@@ -129,30 +152,70 @@ func TestToFilterList(t *testing.T) {
 	}
 }
 
-func TestIsRelevantWithValues(t *testing.T) {
+func TestStopFlushesAggregation(t *testing.T) {
 	// Given
-	filter := []string{"1.8.1", "2.4.1"}
-
-	// When && Then
-	if isRelevant("2.8.1", filter) {
-		t.Error()
+	previous := _aggregationRules
+	defer func() { _aggregationRules = previous }()
+	_aggregationRules, _ = parseAggregationRules("16.7.0 window=1h stats=mean")
+	messages := make(chan Measurement, 10)
+	var sent []Measurement
+	send := func(m Measurement) bool {
+		sent = append(sent, m)
+		return true
 	}
+	stop := RunSamler(messages, []Backend{SenderFunc(send)}, tempDir(), nil)
 
-	if isRelevant("1.8", filter) {
-		t.Error()
-	}
+	// When
+	now := time.Now()
+	messages <- Measurement{Device: "aggregation", Ident: "16.7.0", Type: NumberValue, Value: 100, Time: now}
+	messages <- Measurement{Device: "aggregation", Ident: "16.7.0", Type: NumberValue, Value: 200, Time: now}
+	messages <- Measurement{Device: "aggregation", Ident: "1.8.0", Type: NumberValue, Value: 5000, Time: now}
+	stop()
 
-	if !isRelevant("1.8.1", filter) {
-		t.Error()
+	// Then
+	if len(sent) != 2 || sent[0].Ident != "1.8.0" || sent[1].Aggregate != "mean" || sent[1].Value != 150 {
+		t.Errorf("Expected 1.8.0 and the mean of 16.7.0, got %+v", sent)
 	}
+}
 
-	if !isRelevant("2.4.1", filter) {
+func TestMemorizePerDevice(t *testing.T) {
+	// Given
+	home := Measurement{Device: "home", Ident: "memo", Value: 1, Time: time.Now()}
+	heatpump := Measurement{Device: "heatpump", Ident: "memo", Value: 1, Time: time.Now()}
+
+	// Then
+	if !shouldSendAndMemorize(home, nil) {
 		t.Error()
 	}
+	if !shouldSendAndMemorize(heatpump, nil) {
+		t.Error("Expected same value of another device to be sent")
+	}
+	if shouldSendAndMemorize(home, nil) {
+		t.Error("Expected unchanged value to be skipped")
+	}
 }
 
-func TestIsRelevantEmptyList(t *testing.T) {
-	if !isRelevant("1.2.3", []string{}) {
-		t.Error()
+func TestMeterFilterAfterDerivation(t *testing.T) {
+	// Given
+	defer func(meters []*meter, rules powerRules) { _meters, _powerRules = meters, rules }(_meters, _powerRules)
+	_meters = []*meter{{name: "filtered", identFilter: mustParseIdentFilter(t, "1.7.0")}}
+	_powerRules, _ = parsePowerRules("1.8.0 ident=1.7.0")
+	messages := make(chan Measurement, 10)
+	var sent []Measurement
+	send := func(m Measurement) bool {
+		sent = append(sent, m)
+		return true
+	}
+	stop := RunSamler(messages, []Backend{SenderFunc(send)}, tempDir(), nil)
+
+	// When
+	now := time.Now()
+	messages <- Measurement{Device: "filtered", Ident: "1.8.0", Type: NumberValue, Value: 1000, Unit: "Wh", Time: now}
+	messages <- Measurement{Device: "filtered", Ident: "1.8.0", Type: NumberValue, Value: 1050, Unit: "Wh", Time: now.Add(time.Minute)}
+	stop()
+
+	// Then
+	if len(sent) != 1 || sent[0].Ident != "1.7.0" || sent[0].Value != 3000 {
+		t.Errorf("Expected only the power derived from the filtered counter, got %+v", sent)
 	}
 }
@@ -0,0 +1,57 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type serialMode struct {
+	dataBits int
+	parity   byte
+	stopBits int
+}
+
+// parseSerialMode parses a mode like "8-N-1" or "7-E-1": <databits 5-8>-<parity N/E/O>-<stopbits 1/2>
+func parseSerialMode(mode string) (serialMode, error) {
+	invalid := fmt.Errorf("unsupported mode '%s', expected <databits 5-8>-<parity N/E/O>-<stopbits 1/2> like 8-N-1", mode)
+	if len(mode) != 5 || mode[1] != '-' || mode[3] != '-' {
+		return serialMode{}, invalid
+	}
+
+	parsed := serialMode{
+		dataBits: int(mode[0] - '0'),
+		parity:   strings.ToUpper(mode[2:3])[0],
+		stopBits: int(mode[4] - '0'),
+	}
+	if parsed.dataBits < 5 || parsed.dataBits > 8 ||
+		!strings.ContainsRune("NEO", rune(parsed.parity)) ||
+		(parsed.stopBits != 1 && parsed.stopBits != 2) {
+		return serialMode{}, invalid
+	}
+	return parsed, nil
+}
+
+func checkSerialConfig(baudRate int, mode string) error {
+	if _, ok := serialBaudRates[baudRate]; !ok {
+		return fmt.Errorf("unsupported baud rate %d", baudRate)
+	}
+	_, err := parseSerialMode(mode)
+	return err
+}
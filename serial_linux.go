@@ -0,0 +1,162 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var serialBaudRates = map[int]uint32{
+	50:     unix.B50,
+	75:     unix.B75,
+	110:    unix.B110,
+	134:    unix.B134,
+	150:    unix.B150,
+	200:    unix.B200,
+	300:    unix.B300,
+	600:    unix.B600,
+	1200:   unix.B1200,
+	1800:   unix.B1800,
+	2400:   unix.B2400,
+	4800:   unix.B4800,
+	9600:   unix.B9600,
+	19200:  unix.B19200,
+	38400:  unix.B38400,
+	57600:  unix.B57600,
+	115200: unix.B115200,
+	230400: unix.B230400,
+	460800: unix.B460800,
+	921600: unix.B921600,
+}
+
+var serialDataBits = map[int]uint32{
+	5: unix.CS5,
+	6: unix.CS6,
+	7: unix.CS7,
+	8: unix.CS8,
+}
+
+// openSerial opens the serial device in raw mode like serial_port_open of samler.c does
+func openSerial(name string, baudRate int, mode string) (*os.File, error) {
+	speed, ok := serialBaudRates[baudRate]
+	if !ok {
+		return nil, fmt.Errorf("unsupported baud rate %d", baudRate)
+	}
+	serial, err := parseSerialMode(mode)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.Open(name, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open(%s): %w", name, err)
+	}
+
+	// set RTS
+	if bits, err := unix.IoctlGetInt(fd, unix.TIOCMGET); err == nil {
+		bits |= unix.TIOCM_RTS
+		unix.IoctlSetPointerInt(fd, unix.TIOCMSET, bits)
+	}
+
+	config, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("tcgetattr(%s): %w", name, err)
+	}
+
+	// raw mode with the configured framing
+	config.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR |
+		unix.ICRNL | unix.IXON | unix.INPCK
+	config.Oflag &^= unix.OPOST
+	config.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	config.Cflag &^= unix.CSIZE | unix.PARENB | unix.PARODD | unix.CSTOPB | unix.CBAUD
+	config.Cflag |= serialDataBits[serial.dataBits] | speed
+	switch serial.parity {
+	case 'E':
+		config.Cflag |= unix.PARENB
+		config.Iflag |= unix.INPCK
+	case 'O':
+		config.Cflag |= unix.PARENB | unix.PARODD
+		config.Iflag |= unix.INPCK
+	}
+	if serial.stopBits == 2 {
+		config.Cflag |= unix.CSTOPB
+	}
+	config.Ispeed = speed
+	config.Ospeed = speed
+
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, config); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("tcsetattr(%s): %w", name, err)
+	}
+
+	// the non-blocking descriptor is served by the runtime poller
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// setSerialBaudRate changes the speed of an opened serial device once pending output is transmitted
+func setSerialBaudRate(file *os.File, baudRate int) error {
+	speed, ok := serialBaudRates[baudRate]
+	if !ok {
+		return fmt.Errorf("unsupported baud rate %d", baudRate)
+	}
+
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var setErr error
+	if err := conn.Control(func(fd uintptr) {
+		config, err := unix.IoctlGetTermios(int(fd), unix.TCGETS)
+		if err != nil {
+			setErr = fmt.Errorf("tcgetattr(%s): %w", file.Name(), err)
+			return
+		}
+		config.Cflag &^= unix.CBAUD
+		config.Cflag |= speed
+		config.Ispeed = speed
+		config.Ospeed = speed
+		// TCSETSW waits for the output to drain, like the acknowledgement sent at the former speed
+		if err := unix.IoctlSetTermios(int(fd), unix.TCSETSW, config); err != nil {
+			setErr = fmt.Errorf("tcsetattr(%s): %w", file.Name(), err)
+		}
+	}); err != nil {
+		return err
+	}
+	return setErr
+}
+
+// flushSerialInput discards received but not yet read input, like tcflush(fd, TCIFLUSH)
+func flushSerialInput(file *os.File) error {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var flushErr error
+	if err := conn.Control(func(fd uintptr) {
+		if err := unix.IoctlSetInt(int(fd), unix.TCFLSH, unix.TCIFLUSH); err != nil {
+			flushErr = fmt.Errorf("tcflush(%s): %w", file.Name(), err)
+		}
+	}); err != nil {
+		return err
+	}
+	return flushErr
+}
@@ -0,0 +1,41 @@
+//go:build !linux
+
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+var serialBaudRates = map[int]uint32{}
+
+func openSerial(name string, baudRate int, mode string) (*os.File, error) {
+	return nil, fmt.Errorf("serial devices are not supported natively on %s", runtime.GOOS)
+}
+
+func setSerialBaudRate(file *os.File, baudRate int) error {
+	return fmt.Errorf("serial devices are not supported natively on %s", runtime.GOOS)
+}
+
+func flushSerialInput(file *os.File) error {
+	return fmt.Errorf("serial devices are not supported natively on %s", runtime.GOOS)
+}
@@ -0,0 +1,53 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"testing"
+)
+
+func TestParseSerialMode(t *testing.T) {
+	// When
+	mode, err := parseSerialMode("7-e-2")
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode.dataBits != 7 || mode.parity != 'E' || mode.stopBits != 2 {
+		t.Errorf("Unexpected mode %+v", mode)
+	}
+}
+
+func TestParseInvalidSerialMode(t *testing.T) {
+	for _, mode := range []string{"", "8N1", "9-N-1", "4-N-1", "8-X-1", "8-N-3", "8-N-1-", "8_N_1"} {
+		if _, err := parseSerialMode(mode); err == nil {
+			t.Errorf("Expected mode '%s' to be invalid", mode)
+		}
+	}
+}
+
+func TestCheckSerialConfig(t *testing.T) {
+	if err := checkSerialConfig(9600, "8-N-1"); err != nil {
+		t.Error(err)
+	}
+
+	if err := checkSerialConfig(9601, "8-N-1"); err == nil {
+		t.Error()
+	}
+}
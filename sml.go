@@ -0,0 +1,585 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strconv"
+	"time"
+)
+
+/*
+* Native SML decoder, an alternative to libsml that doesn't require cgo.
+* It covers what SaMLer needs: the transport framing, the TL encoding of the SML file and GetList.Res value lists.
+ */
+
+const (
+	smlTypeOctetString byte = 0x00
+	smlTypeBoolean     byte = 0x40
+	smlTypeInteger     byte = 0x50
+	smlTypeUnsigned    byte = 0x60
+	smlTypeList        byte = 0x70
+	// pseudo type for the single 0x00 byte closing each message
+	smlTypeEndOfMessage byte = 0xff
+)
+
+const smlGetListResponse = 0x00000701
+
+// as limited by transport_receiver
+const smlServerIdMaxBytes = 32
+
+// same as the buffer libsml reads transport frames into
+const smlMaxFrameLength = 8096
+
+// type-length fields of up to 4 bytes cover lengths of 16 bits, way beyond smlMaxFrameLength
+const smlMaxTlLength = 4
+
+var smlEscape = []byte{0x1b, 0x1b, 0x1b, 0x1b}
+var smlStart = []byte{0x1b, 0x1b, 0x1b, 0x1b, 0x01, 0x01, 0x01, 0x01}
+
+var errSmlTruncated = errors.New("truncated SML data")
+var errSmlChecksum = errors.New("SML checksum mismatch")
+
+// smlCrc16 calculates the CRC-16/X-25 used by SML transport frames and messages
+func smlCrc16(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for range 8 {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0x8408
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return ^crc
+}
+
+type smlTransportReader struct {
+	reader *bufio.Reader
+	// counts the skipped malformed frames, optional
+	stats *frameStats
+}
+
+func newSmlTransportReader(reader io.Reader) *smlTransportReader {
+	return &smlTransportReader{
+		reader: bufio.NewReader(reader),
+	}
+}
+
+// readFrame blocks until a complete transport frame has been read, including start and end escape sequences.
+// Malformed frames are skipped, errors are only returned for the underlying reader.
+func (t *smlTransportReader) readFrame() ([]byte, error) {
+	for {
+		frame, err := t.nextFrame()
+		if frame != nil || err != nil {
+			return frame, err
+		}
+		t.stats.count(ParseError)
+	}
+}
+
+// nextFrame reads the frame following the next start sequence, nil if it's malformed
+func (t *smlTransportReader) nextFrame() ([]byte, error) {
+	if err := t.syncToStart(); err != nil {
+		return nil, err
+	}
+
+	frame := append(make([]byte, 0, 512), smlStart...)
+	block := make([]byte, 4)
+	for len(frame) < smlMaxFrameLength {
+		if _, err := io.ReadFull(t.reader, block); err != nil {
+			return nil, err
+		}
+		frame = append(frame, block...)
+		if !bytes.Equal(block, smlEscape) {
+			continue
+		}
+
+		if _, err := io.ReadFull(t.reader, block); err != nil {
+			return nil, err
+		}
+		frame = append(frame, block...)
+		switch {
+		case block[0] == 0x1a:
+			return frame, nil
+		case bytes.Equal(block, smlEscape):
+			// escaped data
+		case bytes.Equal(block, smlStart[4:]):
+			// the previous frame was cut off, start over with the new one
+			frame = append(frame[:0], smlStart...)
+		default:
+			log.Printf("Unrecognized SML escape sequence %x, skipping frame\n", block)
+			return nil, nil
+		}
+	}
+
+	log.Printf("SML frame exceeds %d bytes, skipping it\n", smlMaxFrameLength)
+	return nil, nil
+}
+
+func (t *smlTransportReader) syncToStart() error {
+	window := make([]byte, len(smlStart))
+	for {
+		b, err := t.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		copy(window, window[1:])
+		window[len(window)-1] = b
+		if bytes.Equal(window, smlStart) {
+			return nil
+		}
+	}
+}
+
+// unpackSmlFrame checks the transport checksum and returns the contained SML file without escaping and padding
+func unpackSmlFrame(frame []byte) ([]byte, error) {
+	if len(frame) < 16 || len(frame)%4 != 0 {
+		return nil, fmt.Errorf("invalid SML frame length %d", len(frame))
+	}
+
+	// the checksum is transmitted low byte first, but some meters send it the other way around
+	crc := smlCrc16(frame[:len(frame)-2])
+	received := uint16(frame[len(frame)-2]) | uint16(frame[len(frame)-1])<<8
+	if received != crc && received != crc>>8|crc<<8 {
+		return nil, fmt.Errorf("%w of frame, expected %04x, got %04x", errSmlChecksum, crc, received)
+	}
+
+	body := frame[len(smlStart) : len(frame)-8]
+	file := make([]byte, 0, len(body))
+	for i := 0; i < len(body); i += 4 {
+		block := body[i : i+4]
+		file = append(file, block...)
+		if bytes.Equal(block, smlEscape) {
+			// skip the doubled escape sequence
+			i += 4
+		}
+	}
+
+	padding := int(frame[len(frame)-3])
+	if padding > 3 || padding > len(file) {
+		return nil, fmt.Errorf("invalid SML frame padding %d", padding)
+	}
+	return file[:len(file)-padding], nil
+}
+
+type smlNode struct {
+	typ   byte
+	data  []byte
+	items []smlNode
+}
+
+// isEmpty is true for absent optional values
+func (n smlNode) isEmpty() bool {
+	return n.typ == smlTypeOctetString && len(n.data) == 0
+}
+
+func (n smlNode) unsigned() (uint64, bool) {
+	if (n.typ != smlTypeUnsigned && n.typ != smlTypeInteger) || len(n.data) == 0 || len(n.data) > 8 {
+		return 0, false
+	}
+	var value uint64
+	for _, b := range n.data {
+		value = value<<8 | uint64(b)
+	}
+	return value, true
+}
+
+func (n smlNode) integer() (int64, bool) {
+	value, ok := n.unsigned()
+	if !ok {
+		return 0, false
+	}
+	if n.typ == smlTypeInteger && len(n.data) < 8 {
+		// sign extension
+		shift := 64 - 8*len(n.data)
+		return int64(value<<shift) >> shift, true
+	}
+	return int64(value), true
+}
+
+func (n smlNode) toFloat() (float64, bool) {
+	if n.typ == smlTypeUnsigned {
+		value, ok := n.unsigned()
+		return float64(value), ok
+	}
+	value, ok := n.integer()
+	return float64(value), ok
+}
+
+type smlParser struct {
+	data []byte
+	pos  int
+}
+
+func (p *smlParser) parseNode() (smlNode, error) {
+	if p.pos >= len(p.data) {
+		return smlNode{}, errSmlTruncated
+	}
+
+	tl := p.data[p.pos]
+	p.pos++
+	if tl == 0x00 {
+		return smlNode{typ: smlTypeEndOfMessage}, nil
+	}
+
+	typ := tl & 0x70
+	length := int(tl & 0x0f)
+	tlLength := 1
+	for more := tl&0x80 != 0; more; {
+		if p.pos >= len(p.data) {
+			return smlNode{}, errSmlTruncated
+		}
+		if tlLength == smlMaxTlLength {
+			return smlNode{}, fmt.Errorf("SML length field exceeds %d bytes", smlMaxTlLength)
+		}
+		next := p.data[p.pos]
+		p.pos++
+		tlLength++
+		length = length<<4 | int(next&0x0f)
+		more = next&0x80 != 0
+	}
+
+	if typ == smlTypeList {
+		// each item takes at least a byte, so longer lists can't be complete
+		if length > len(p.data)-p.pos {
+			return smlNode{}, errSmlTruncated
+		}
+		node := smlNode{typ: typ, items: make([]smlNode, 0, length)}
+		for range length {
+			item, err := p.parseNode()
+			if err != nil {
+				return smlNode{}, err
+			}
+			node.items = append(node.items, item)
+		}
+		return node, nil
+	}
+
+	// for all other types the length includes the TL field itself
+	size := length - tlLength
+	if size < 0 || p.pos+size > len(p.data) {
+		return smlNode{}, errSmlTruncated
+	}
+	node := smlNode{typ: typ, data: p.data[p.pos : p.pos+size]}
+	p.pos += size
+	return node, nil
+}
+
+type smlMessage struct {
+	tag  uint64
+	body smlNode
+}
+
+// parseSmlFile parses the unpacked content of a transport frame into its messages
+func parseSmlFile(file []byte) ([]smlMessage, error) {
+	parser := smlParser{data: file}
+	messages := []smlMessage{}
+	for parser.pos < len(file) {
+		if file[parser.pos] == 0x00 {
+			// trailing end of message markers or padding
+			parser.pos++
+			continue
+		}
+		start := parser.pos
+		node, err := parser.parseNode()
+		if err != nil {
+			return nil, err
+		}
+		// transactionId, groupNo, abortOnError, messageBody, crc16, endOfSmlMsg
+		if node.typ != smlTypeList || len(node.items) != 6 || node.items[5].typ != smlTypeEndOfMessage {
+			return nil, fmt.Errorf("invalid SML message")
+		}
+		// the message checksum covers everything up to the crc16 element, followed by its single byte TL and the end of message
+		received, ok := node.items[4].unsigned()
+		crcStart := parser.pos - 1 - (1 + len(node.items[4].data))
+		if !ok || crcStart < start {
+			return nil, fmt.Errorf("invalid SML message checksum")
+		}
+		if crc := smlCrc16(file[start:crcStart]); uint16(received) != crc && uint16(received) != crc>>8|crc<<8 {
+			return nil, fmt.Errorf("%w of message, expected %04x, got %04x", errSmlChecksum, crc, received)
+		}
+		body := node.items[3]
+		if body.typ != smlTypeList || len(body.items) != 2 {
+			return nil, fmt.Errorf("invalid SML message body")
+		}
+		tag, ok := body.items[0].unsigned()
+		if !ok {
+			return nil, fmt.Errorf("invalid SML message tag")
+		}
+		messages = append(messages, smlMessage{tag: tag, body: body.items[1]})
+	}
+	return messages, nil
+}
+
+// decodeSmlFrame produces the measurements of a transport frame the same way transport_receiver and onSmlMessage do,
+// frames failing any checksum are discarded as a whole. The device names the meter the frame was received from.
+func decodeSmlFrame(frame []byte, device string, stats *frameStats) []Measurement {
+	file, err := unpackSmlFrame(frame)
+	if err == nil {
+		var messages []smlMessage
+		if messages, err = parseSmlFile(file); err == nil {
+			stats.count(FrameOk)
+			return decodeSmlMessages(messages, device, stats)
+		}
+	}
+
+	if errors.Is(err, errSmlChecksum) {
+		stats.count(CrcError)
+	} else {
+		stats.count(ParseError)
+	}
+	log.Printf("Skipping SML frame: %s\n", err)
+	return nil
+}
+
+func decodeSmlMessages(messages []smlMessage, device string, stats *frameStats) []Measurement {
+
+	measurements := []Measurement{}
+	for _, message := range messages {
+		// clientId, serverId, listName, actSensorTime, valList, listSignature, actGatewayTime
+		if message.tag != smlGetListResponse || message.body.typ != smlTypeList || len(message.body.items) != 7 {
+			continue
+		}
+		serverId := message.body.items[1].data
+		if len(serverId) > smlServerIdMaxBytes {
+			serverId = serverId[:smlServerIdMaxBytes]
+		}
+		sensorTime := decodeSmlTime(message.body.items[3])
+		for _, entry := range message.body.items[4].items {
+			if entry.typ == smlTypeList && len(entry.items) == 7 && entry.items[5].isEmpty() {
+				stats.count(NullValue)
+			}
+			if measure, ok := decodeSmlListEntry(entry, device, hex.EncodeToString(serverId), sensorTime); ok {
+				measurements = append(measurements, measure)
+			}
+		}
+	}
+	return measurements
+}
+
+func decodeSmlListEntry(entry smlNode, device string, serverId string, sensorTime smlTime) (Measurement, bool) {
+	// objName, status, valTime, unit, scaler, value, valueSignature
+	if entry.typ != smlTypeList || len(entry.items) != 7 || len(entry.items[0].data) != 6 {
+		return Measurement{}, false
+	}
+	objName := entry.items[0].data
+	value := entry.items[5]
+	if value.isEmpty() {
+		log.Println("Error in data stream. entry->value should not be NULL. Skipping this.")
+		return Measurement{}, false
+	}
+
+	prefix := fmt.Sprintf("%d-%d", objName[0], objName[1])
+	ident := fmt.Sprintf("%d.%d.%d", objName[2], objName[3], objName[4])
+	suffix := fmt.Sprintf("%d", objName[5])
+
+	valueString := ""
+	unitString := ""
+	valueType := NumberValue
+	switch value.typ {
+	case smlTypeOctetString:
+		valueString = octetStringToText(value.data)
+		valueType = StringValue
+	case smlTypeBoolean:
+		valueString = strconv.FormatBool(len(value.data) > 0 && value.data[0] != 0)
+		valueType = BoolValue
+	case smlTypeInteger, smlTypeUnsigned:
+		number, ok := value.toFloat()
+		if !ok {
+			return Measurement{}, false
+		}
+		scaler, _ := entry.items[4].integer()
+		precision := max(0, -int(scaler))
+		number = number * math.Pow(10, float64(scaler))
+		valueString = truncate(strconv.FormatFloat(number, 'f', precision, 64), 19)
+		if unitCode, ok := entry.items[3].unsigned(); ok {
+			unitString = truncate(dlmsUnits[byte(unitCode)], 4)
+		}
+	default:
+		// lists or unknown types can't be passed on
+		return Measurement{}, false
+	}
+
+	measure, ok := toMeasurement(valueType, valueString, unitString, prefix, ident, suffix, serverId)
+	if ok {
+		measure.Status, measure.HasStatus = entry.items[1].unsigned()
+		measure.Time = measurementTime(meterClock(device, serverId), sensorTime, decodeSmlTime(entry.items[2]), measure.Time)
+	}
+	return measure, ok
+}
+
+// octetStringToText passes printable octet strings like firmware versions as text, others hex encoded
+func octetStringToText(data []byte) string {
+	for _, b := range data {
+		if b < 0x20 || b > 0x7e {
+			return hex.EncodeToString(data)
+		}
+	}
+	if len(data) == 0 {
+		return ""
+	}
+	return string(data)
+}
+
+// decodeSmlTime decodes the SML_Time choice, an absent time results in smlTimeNone
+func decodeSmlTime(node smlNode) smlTime {
+	switch {
+	case node.typ == smlTypeList && len(node.items) == 2:
+		kind, ok := node.items[0].unsigned()
+		if !ok {
+			return smlTime{}
+		}
+		value := node.items[1]
+		if kind == smlTimeLocalTimestamp {
+			// timestamp, localOffset, seasonTimeOffset
+			if value.typ != smlTypeList || len(value.items) != 3 {
+				return smlTime{}
+			}
+			value = value.items[0]
+		}
+		if seconds, ok := value.unsigned(); ok && kind >= smlTimeSecIndex && kind <= smlTimeLocalTimestamp {
+			return smlTime{kind: int(kind), value: uint32(seconds)}
+		}
+	case node.typ == smlTypeUnsigned:
+		// some meters send a plain seconds index instead of the choice
+		if seconds, ok := node.unsigned(); ok {
+			return smlTime{kind: smlTimeSecIndex, value: uint32(seconds)}
+		}
+	}
+	return smlTime{}
+}
+
+// toMeasurement converts the textual values of a list entry, numbers that can't be parsed are dropped
+func toMeasurement(valueType ValueType, value, unit, prefix, ident, suffix, serverId string) (Measurement, bool) {
+	measure := Measurement{
+		Ident:    ident,
+		Unit:     unit,
+		Prefix:   prefix,
+		Suffix:   suffix,
+		ServerId: serverId,
+		Type:     valueType,
+		Time:     time.Now(),
+	}
+
+	switch valueType {
+	case NumberValue:
+		val, err := strconv.ParseFloat(value, 32)
+		if err != nil {
+			return Measurement{}, false
+		}
+		measure.Value = val
+	case BoolValue:
+		val, err := strconv.ParseBool(value)
+		if err != nil {
+			return Measurement{}, false
+		}
+		if val {
+			measure.Value = 1
+		}
+		measure.Text = value
+	default:
+		measure.Text = value
+	}
+	return measure, true
+}
+
+func truncate(value string, length int) string {
+	if len(value) > length {
+		return value[:length]
+	}
+	return value
+}
+
+// DLMS unit codes, as in libsml/examples/unit.h
+var dlmsUnits = map[byte]string{
+	1:   "a",
+	2:   "mo",
+	3:   "wk",
+	4:   "d",
+	5:   "h",
+	6:   "min.",
+	7:   "s",
+	8:   "°",
+	9:   "°C",
+	10:  "currency",
+	11:  "m",
+	12:  "m/s",
+	13:  "m³",
+	14:  "m³",
+	15:  "m³/h",
+	16:  "m³/h",
+	17:  "m³/d",
+	18:  "m³/d",
+	19:  "l",
+	20:  "kg",
+	21:  "N",
+	22:  "Nm",
+	23:  "Pa",
+	24:  "bar",
+	25:  "J",
+	26:  "J/h",
+	27:  "W",
+	28:  "VA",
+	29:  "var",
+	30:  "Wh",
+	31:  "VAh",
+	32:  "varh",
+	33:  "A",
+	34:  "C",
+	35:  "V",
+	36:  "V/m",
+	37:  "F",
+	38:  "Ω",
+	39:  "Ωm²/m",
+	40:  "Wb",
+	41:  "T",
+	42:  "A/m",
+	43:  "H",
+	44:  "Hz",
+	45:  "1/(Wh)",
+	46:  "1/(varh)",
+	47:  "1/(VAh)",
+	48:  "V²h",
+	49:  "A²h",
+	50:  "kg/s",
+	51:  "S, mho",
+	52:  "K",
+	53:  "1/(V²h)",
+	54:  "1/(A²h)",
+	55:  "1/m³",
+	56:  "%",
+	57:  "Ah",
+	60:  "Wh/m³",
+	61:  "J/m³",
+	62:  "Mol %",
+	63:  "g/m³",
+	64:  "Pa s",
+	253: "(reserved)",
+	254: "(other)",
+	255: "(unitless)",
+}
@@ -0,0 +1,408 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// smlTestTL encodes a value of the given type, enough for the short values used in tests
+func smlTestTL(typ byte, data ...byte) []byte {
+	if len(data)+1 < 0x10 {
+		return append([]byte{typ | byte(len(data)+1)}, data...)
+	}
+	length := len(data) + 2
+	return append([]byte{0x80 | typ | byte(length>>4), byte(length & 0x0f)}, data...)
+}
+
+func smlTestList(items ...[]byte) []byte {
+	list := []byte{smlTypeList | byte(len(items))}
+	for _, item := range items {
+		list = append(list, item...)
+	}
+	return list
+}
+
+func smlTestEntry(obis []byte, unit byte, scaler int8, value []byte) []byte {
+	return smlTestTimedEntry(obis, []byte{0x01}, unit, scaler, value)
+}
+
+func smlTestTimedEntry(obis []byte, valTime []byte, unit byte, scaler int8, value []byte) []byte {
+	return smlTestList(
+		smlTestTL(smlTypeOctetString, obis...),
+		[]byte{0x01},
+		valTime,
+		smlTestTL(smlTypeUnsigned, unit),
+		smlTestTL(smlTypeInteger, byte(scaler)),
+		value,
+		[]byte{0x01},
+	)
+}
+
+func smlTestMessage(tag byte, body []byte) []byte {
+	message := smlTestList(
+		smlTestTL(smlTypeOctetString, 0x01),
+		smlTestTL(smlTypeUnsigned, 0x00),
+		smlTestTL(smlTypeUnsigned, 0x00),
+		smlTestList(smlTestTL(smlTypeUnsigned, 0x00, 0x00, 0x07, tag), body),
+	)
+	// the list claims 6 items, the checksum covers everything before it
+	message[0] = smlTypeList | 6
+	crc := smlCrc16(message)
+	return append(message, smlTestTL(smlTypeUnsigned, byte(crc), byte(crc>>8))[0], byte(crc), byte(crc>>8), 0x00)
+}
+
+func smlTestGetListResponse(serverId []byte, entries ...[]byte) []byte {
+	return smlTestMessage(0x01, smlTestList(
+		[]byte{0x01},
+		smlTestTL(smlTypeOctetString, serverId...),
+		[]byte{0x01},
+		[]byte{0x01},
+		smlTestList(entries...),
+		[]byte{0x01},
+		[]byte{0x01},
+	))
+}
+
+// smlTestFrame wraps the messages into a transport frame with escaping, padding and checksum
+func smlTestFrame(messages ...[]byte) []byte {
+	file := bytes.Join(messages, nil)
+	padding := (4 - len(file)%4) % 4
+	file = append(file, make([]byte, padding)...)
+
+	frame := append([]byte{}, smlStart...)
+	for i := 0; i < len(file); i += 4 {
+		block := file[i : i+4]
+		frame = append(frame, block...)
+		if bytes.Equal(block, smlEscape) {
+			frame = append(frame, block...)
+		}
+	}
+	frame = append(frame, 0x1b, 0x1b, 0x1b, 0x1b, 0x1a, byte(padding))
+	crc := smlCrc16(frame)
+	return append(frame, byte(crc), byte(crc>>8))
+}
+
+var smlTestEnergy = smlTestEntry([]byte{1, 0, 1, 8, 0, 255}, 30, -1, smlTestTL(smlTypeUnsigned, 0x00, 0x01, 0xe2, 0x40))
+var smlTestPower = smlTestEntry([]byte{1, 0, 16, 7, 0, 255}, 27, 0, smlTestTL(smlTypeInteger, 0xff, 0x38))
+var smlTestVendor = smlTestEntry([]byte{129, 129, 199, 130, 3, 255}, 0, 0, smlTestTL(smlTypeOctetString, 'E', 'M', 'H'))
+
+func TestSmlCrc16(t *testing.T) {
+	// CRC-16/X-25 check value
+	if crc := smlCrc16([]byte("123456789")); crc != 0x906e {
+		t.Errorf("Expected 906e, got %04x", crc)
+	}
+}
+
+func TestDecodeSmlFrame(t *testing.T) {
+	// Given
+	frame := smlTestFrame(smlTestGetListResponse([]byte{0x0a, 0x01}, smlTestEnergy, smlTestPower, smlTestVendor))
+
+	// When
+	measurements := decodeSmlFrame(frame, "", nil)
+
+	// Then
+	if len(measurements) != 3 {
+		t.Fatalf("Expected 3 measurements, got %d", len(measurements))
+	}
+
+	energy := measurements[0]
+	if energy.ServerId != "0a01" {
+		t.Errorf("Unexpected server id %s", energy.ServerId)
+	}
+	if energy.Prefix != "1-0" || energy.Ident != "1.8.0" || energy.Suffix != "255" {
+		t.Errorf("Unexpected OBIS %s:%s*%s", energy.Prefix, energy.Ident, energy.Suffix)
+	}
+	// parsed with float32 precision like onSmlMessage does
+	if energy.Value != float64(float32(12345.6)) || energy.Unit != "Wh" {
+		t.Errorf("Unexpected value %f %s", energy.Value, energy.Unit)
+	}
+
+	power := measurements[1]
+	if power.Ident != "16.7.0" || power.Value != -200 || power.Unit != "W" {
+		t.Errorf("Unexpected power %s %f %s", power.Ident, power.Value, power.Unit)
+	}
+
+	vendor := measurements[2]
+	if vendor.Prefix != "129-129" || vendor.Ident != "199.130.3" || vendor.Type != StringValue || vendor.Text != "EMH" {
+		t.Errorf("Unexpected vendor %s:%s %s", vendor.Prefix, vendor.Ident, vendor.Text)
+	}
+}
+
+func TestDecodeSmlStatus(t *testing.T) {
+	// Given
+	entry := smlTestList(
+		smlTestTL(smlTypeOctetString, 1, 0, 1, 8, 0, 255),
+		smlTestTL(smlTypeUnsigned, 0x01, 0x82),
+		[]byte{0x01},
+		smlTestTL(smlTypeUnsigned, 30),
+		smlTestTL(smlTypeInteger, 0),
+		smlTestTL(smlTypeUnsigned, 0x2a),
+		[]byte{0x01},
+	)
+
+	// When
+	measurements := decodeSmlFrame(smlTestFrame(smlTestGetListResponse([]byte{0x0a, 0x01}, entry)), "", nil)
+
+	// Then
+	if len(measurements) != 1 || !measurements[0].HasStatus || measurements[0].Status != 0x0182 {
+		t.Errorf("Expected status 0x0182, got %+v", measurements)
+	}
+}
+
+func TestDecodeCorruptSmlFrame(t *testing.T) {
+	// Given
+	frame := smlTestFrame(smlTestGetListResponse([]byte{0x0a, 0x01}, smlTestEnergy))
+	frame[20] ^= 0xff
+
+	stats := &frameStats{}
+
+	// When && Then
+	if measurements := decodeSmlFrame(frame, "", stats); len(measurements) != 0 {
+		t.Error()
+	}
+	if stats.crcErrors.Load() != 1 || stats.framesOk.Load() != 0 {
+		t.Errorf("Unexpected stats %s", stats)
+	}
+}
+
+func TestDecodeSmlFrameWithCorruptMessage(t *testing.T) {
+	// Given
+	message := smlTestGetListResponse([]byte{0x0a, 0x01}, smlTestEnergy)
+	message[len(message)-2] ^= 0xff
+	stats := &frameStats{}
+
+	// When
+	measurements := decodeSmlFrame(smlTestFrame(message), "", stats)
+
+	// Then
+	if len(measurements) != 0 {
+		t.Error("Expected the frame to be discarded")
+	}
+	if stats.crcErrors.Load() != 1 {
+		t.Errorf("Unexpected stats %s", stats)
+	}
+}
+
+func TestDecodeSmlFrameStats(t *testing.T) {
+	// Given
+	empty := smlTestList(
+		smlTestTL(smlTypeOctetString, 1, 0, 96, 50, 1, 255),
+		[]byte{0x01}, []byte{0x01}, []byte{0x01}, []byte{0x01}, []byte{0x01}, []byte{0x01},
+	)
+	stats := &frameStats{}
+
+	// When
+	decodeSmlFrame(smlTestFrame(smlTestGetListResponse([]byte{0x0a, 0x01}, smlTestEnergy, empty)), "", stats)
+	decodeSmlFrame(smlTestFrame([]byte{0x76, 0x01, 0x01}), "", stats)
+
+	// Then
+	if stats.String() != "frames ok: 1, CRC errors: 0, parse errors: 1, null values skipped: 1" {
+		t.Errorf("Unexpected stats %s", stats)
+	}
+}
+
+func TestUnpackEscapedSmlFrame(t *testing.T) {
+	// Given
+	file := []byte{0x1b, 0x1b, 0x1b, 0x1b, 0x01, 0x02, 0x03}
+	frame := smlTestFrame(file)
+
+	// When
+	unpacked, err := unpackSmlFrame(frame)
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unpacked, file) {
+		t.Errorf("Expected %x, got %x", file, unpacked)
+	}
+}
+
+func TestReadSmlFrames(t *testing.T) {
+	// Given
+	first := smlTestFrame(smlTestGetListResponse([]byte{0x0a, 0x01}, smlTestEnergy))
+	second := smlTestFrame(smlTestGetListResponse([]byte{0x0a, 0x01}, smlTestPower))
+	stream := bytes.Join([][]byte{{0x00, 0x1b, 0x42}, first, {0x13, 0x37}, second}, nil)
+	transport := newSmlTransportReader(bytes.NewReader(stream))
+
+	// When && Then
+	for _, expected := range [][]byte{first, second} {
+		frame, err := transport.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(frame, expected) {
+			t.Errorf("Expected %x, got %x", expected, frame)
+		}
+	}
+	if _, err := transport.readFrame(); err == nil {
+		t.Error()
+	}
+}
+
+func TestParseSmlNodes(t *testing.T) {
+	// Given
+	parser := smlParser{data: []byte{
+		0x72,       // list of two
+		0x52, 0xfe, // int8 -2
+		0x81, 0x04, // octet string of 18 bytes, multi byte TL
+		1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+	}}
+
+	// When
+	node, err := parser.parseNode()
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(node.items) != 2 {
+		t.Fatalf("Expected 2 items, got %d", len(node.items))
+	}
+	if value, _ := node.items[0].integer(); value != -2 {
+		t.Errorf("Expected -2, got %d", value)
+	}
+	if len(node.items[1].data) != 18 {
+		t.Errorf("Expected 18 bytes, got %d", len(node.items[1].data))
+	}
+}
+
+func TestDecodeSmlTime(t *testing.T) {
+	secIndex := smlTestList(smlTestTL(smlTypeUnsigned, 0x01), smlTestTL(smlTypeUnsigned, 0x00, 0x00, 0x12, 0x67))
+	timestamp := smlTestList(smlTestTL(smlTypeUnsigned, 0x02), smlTestTL(smlTypeUnsigned, 0x65, 0x53, 0xf1, 0x00))
+	localTimestamp := smlTestList(smlTestTL(smlTypeUnsigned, 0x03), smlTestList(
+		smlTestTL(smlTypeUnsigned, 0x65, 0x53, 0xf1, 0x00),
+		smlTestTL(smlTypeInteger, 0x00, 0x3c),
+		smlTestTL(smlTypeInteger, 0x00, 0x00),
+	))
+	plain := smlTestTL(smlTypeUnsigned, 0x00, 0x00, 0x12, 0x67)
+
+	expected := map[string]smlTime{
+		string(secIndex):       {smlTimeSecIndex, 4711},
+		string(timestamp):      {smlTimeTimestamp, 1700000000},
+		string(localTimestamp): {smlTimeLocalTimestamp, 1700000000},
+		string(plain):          {smlTimeSecIndex, 4711},
+		string([]byte{0x01}):   {},
+	}
+
+	for encoded, time := range expected {
+		parser := smlParser{data: []byte(encoded)}
+		node, err := parser.parseNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded := decodeSmlTime(node); decoded != time {
+			t.Errorf("Expected %+v, got %+v", time, decoded)
+		}
+	}
+}
+
+func TestDecodeSmlFrameWithMeterTime(t *testing.T) {
+	// Given
+	defer withTimeSource(MeterTime)()
+	timestamp := smlTestList(smlTestTL(smlTypeUnsigned, 0x02), smlTestTL(smlTypeUnsigned, 0x65, 0x53, 0xf1, 0x00))
+	entry := smlTestTimedEntry([]byte{1, 0, 1, 8, 0, 255}, timestamp, 30, 0, smlTestTL(smlTypeUnsigned, 0x01))
+
+	// When
+	measurements := decodeSmlFrame(smlTestFrame(smlTestGetListResponse([]byte{0x0a, 0x01}, entry)), "", nil)
+
+	// Then
+	if len(measurements) != 1 || measurements[0].Time.Unix() != 1700000000 {
+		t.Errorf("Expected the meter time, got %+v", measurements)
+	}
+}
+
+func TestParseTruncatedSmlNode(t *testing.T) {
+	parser := smlParser{data: []byte{0x65, 0x00, 0x01}}
+	if _, err := parser.parseNode(); err == nil {
+		t.Error()
+	}
+}
+
+func TestDecodeSmlFrameWithOversizedList(t *testing.T) {
+	// Given
+	hostile := smlTestFrame([]byte{0xf7, 0x8f, 0x8f, 0x8f, 0x8f, 0x8f, 0x8f, 0x8f, 0x8f, 0x8f, 0x8f, 0x8f, 0x0f})
+	claimed := smlTestFrame([]byte{0xf1, 0x0f, 0x01, 0x01})
+	stats := &frameStats{}
+
+	// When && Then
+	for _, frame := range [][]byte{hostile, claimed} {
+		if measurements := decodeSmlFrame(frame, "", stats); len(measurements) != 0 {
+			t.Errorf("Unexpected measurements %v", measurements)
+		}
+	}
+	if stats.parseErrors.Load() != 2 {
+		t.Errorf("Unexpected stats %s", stats)
+	}
+}
+
+func TestReadSmlFramesSkipsGarbage(t *testing.T) {
+	// Given
+	garbage := append(append([]byte{}, smlStart...), 0x1b, 0x1b, 0x1b, 0x1b, 0x42, 0x42, 0x42, 0x42)
+	valid := smlTestFrame(smlTestGetListResponse([]byte{0x0a, 0x01}, smlTestEnergy))
+	stream := append(bytes.Repeat(garbage, 100000), valid...)
+	transport := newSmlTransportReader(bytes.NewReader(stream))
+	transport.stats = &frameStats{}
+
+	// When
+	frame, err := transport.readFrame()
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame, valid) {
+		t.Errorf("Expected %x, got %x", valid, frame)
+	}
+	if transport.stats.parseErrors.Load() != 100000 {
+		t.Errorf("Unexpected stats %s", transport.stats)
+	}
+}
+
+func TestToMeasurement(t *testing.T) {
+	if _, ok := toMeasurement(NumberValue, "true", "", "1-0", "96.1.0", "255", ""); ok {
+		t.Error()
+	}
+
+	measure, ok := toMeasurement(NumberValue, "23.5", "Wh", "1-0", "1.8.0", "255", "0a01")
+	if !ok || measure.Value != 23.5 || measure.Unit != "Wh" || measure.Ident != "1.8.0" {
+		t.Error()
+	}
+
+	measure, ok = toMeasurement(BoolValue, "true", "", "1-0", "96.1.0", "255", "")
+	if !ok || measure.Type != BoolValue || measure.Value != 1 || measure.Text != "true" {
+		t.Error()
+	}
+
+	measure, ok = toMeasurement(StringValue, "EMH", "", "129-129", "199.130.3", "255", "")
+	if !ok || measure.Type != StringValue || measure.Text != "EMH" {
+		t.Error()
+	}
+}
+
+func TestOctetStringToText(t *testing.T) {
+	if text := octetStringToText([]byte("1.02")); text != "1.02" {
+		t.Errorf("Expected 1.02, got %s", text)
+	}
+
+	if text := octetStringToText([]byte{0x0a, 0x01, 0x45}); text != "0a0145" {
+		t.Errorf("Expected 0a0145, got %s", text)
+	}
+}
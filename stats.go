@@ -0,0 +1,75 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// outcomes of received frames and their values, the same as enum SmlStat of samler.h
+const (
+	FrameOk = iota
+	CrcError
+	ParseError
+	NullValue
+)
+
+// interval of logging the frame statistics of each meter
+var statsInterval = 15 * time.Minute
+
+// frameStats counts the outcome of the frames or telegrams received by a meter
+type frameStats struct {
+	framesOk    atomic.Uint64
+	crcErrors   atomic.Uint64
+	parseErrors atomic.Uint64
+	nullValues  atomic.Uint64
+}
+
+func (s *frameStats) count(stat int) {
+	if s == nil {
+		return
+	}
+	switch stat {
+	case FrameOk:
+		s.framesOk.Add(1)
+	case CrcError:
+		s.crcErrors.Add(1)
+	case ParseError:
+		s.parseErrors.Add(1)
+	case NullValue:
+		s.nullValues.Add(1)
+	}
+}
+
+func (s *frameStats) String() string {
+	return fmt.Sprintf("frames ok: %d, CRC errors: %d, parse errors: %d, null values skipped: %d",
+		s.framesOk.Load(), s.crcErrors.Load(), s.parseErrors.Load(), s.nullValues.Load())
+}
+
+// reportStats is blocking forever, logging the statistics of the meters each interval
+func reportStats(meters []*meter) {
+	for {
+		time.Sleep(statsInterval)
+		for _, m := range meters {
+			log.Printf("Statistics of %s: %s\n", m.name, &m.stats)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import "testing"
+
+func TestFrameStats(t *testing.T) {
+	// Given
+	stats := &frameStats{}
+
+	// When
+	for _, stat := range []int{FrameOk, FrameOk, CrcError, ParseError, NullValue, NullValue, NullValue, 42} {
+		stats.count(stat)
+	}
+
+	// Then
+	if stats.String() != "frames ok: 2, CRC errors: 1, parse errors: 1, null values skipped: 3" {
+		t.Errorf("Unexpected stats %s", stats)
+	}
+
+	// optional stats can be nil
+	var none *frameStats
+	none.count(FrameOk)
+}
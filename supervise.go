@@ -0,0 +1,95 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// interval of checking whether an unplugged device is back
+var devicePollInterval = time.Second
+
+// a stream lasting that long is considered stable, reopening it after it ended starts over with the min delay
+var streamStableAfter = 30 * time.Second
+
+// supervise is blocking forever, handing each opened stream to listen and reopening it
+// with backoff whenever opening fails or the stream ends, e.g. because the device got unplugged
+// or the connection dropped. The measurement pipeline isn't affected by that.
+func supervise(label string, retry *backoff, open func() (*os.File, error), listen func(file *os.File) int) {
+	for {
+		file, err := open()
+		if err != nil {
+			delay := retry.next()
+			log.Printf("%s unavailable, retry in %s: %s\n", label, delay, err)
+			retry.sleep(delay)
+			continue
+		}
+
+		log.Printf("%s up\n", label)
+		opened := retry.now()
+		exitCode := listen(file)
+		file.Close()
+
+		// a connection dropping now and then is reopened quickly again, one failing right away backs off
+		if retry.now().Sub(opened) >= streamStableAfter {
+			retry.reset()
+		}
+		delay := retry.next()
+		log.Printf("%s down (exit: %d), reopen in %s\n", label, exitCode, delay)
+		retry.sleep(delay)
+	}
+}
+
+// superviseDevice listens to a serial device, waiting for the device node to reappear if it's gone.
+// Stable names like /dev/serial/by-id/... are resolved on every attempt, so the device is found
+// again even if it got another /dev/ttyUSB* number when plugged in again.
+func superviseDevice(m *meter, open func(path string) (*os.File, error), listen func(file *os.File) int) {
+	label := "Device " + m.name
+	supervise(label, newBackoff(time.Second, 2*time.Minute), func() (*os.File, error) {
+		path := waitForDevice(label, m.device)
+		if path != m.device {
+			log.Printf("%s found at %s\n", label, path)
+		}
+		return open(path)
+	}, listen)
+}
+
+// waitForDevice is blocking until the device node exists and returns its resolved path
+func waitForDevice(label string, device string) string {
+	waiting := false
+	for {
+		path, err := filepath.EvalSymlinks(device)
+		if err == nil {
+			return path
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			// let opening the device report the actual problem
+			return device
+		}
+		if !waiting {
+			log.Printf("%s down, waiting for %s to appear\n", label, device)
+			waiting = true
+		}
+		time.Sleep(devicePollInterval)
+	}
+}
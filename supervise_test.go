@@ -0,0 +1,125 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSuperviseReopens(t *testing.T) {
+	// Given
+	opened := 0
+	open := func() (*os.File, error) {
+		opened++
+		if opened == 1 {
+			return nil, errors.New("unplugged")
+		}
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		writer.Close()
+		return reader, nil
+	}
+	listened := make(chan int)
+	listen := func(file *os.File) int {
+		listened <- opened
+		return 0
+	}
+
+	// When
+	go supervise("Test", newBackoff(time.Millisecond, 2*time.Millisecond), open, listen)
+
+	// Then
+	for _, expected := range []int{2, 3} {
+		select {
+		case attempt := <-listened:
+			if attempt != expected {
+				t.Errorf("Expected listening after attempt %d, got %d", expected, attempt)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Not reopened")
+		}
+	}
+}
+
+func TestSuperviseBacksOffUnlessStable(t *testing.T) {
+	// Given
+	clock := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	delays := []time.Duration{}
+	retry := newBackoff(time.Second, time.Minute)
+	retry.now = func() time.Time { return clock }
+	retry.sleep = func(d time.Duration) {
+		delays = append(delays, d)
+		clock = clock.Add(d)
+	}
+	// the third stream lasts, the others end right away
+	uptimes := []time.Duration{0, 0, streamStableAfter, 0}
+	done := make(chan struct{})
+	open := func() (*os.File, error) {
+		return os.Open(os.DevNull)
+	}
+	listen := func(file *os.File) int {
+		if len(uptimes) == 0 {
+			close(done)
+			select {}
+		}
+		clock = clock.Add(uptimes[0])
+		uptimes = uptimes[1:]
+		return 0
+	}
+
+	// When
+	go supervise("Test", retry, open, listen)
+	<-done
+
+	// Then
+	expected := []time.Duration{time.Second, 2 * time.Second, time.Second, 2 * time.Second}
+	if !slices.Equal(delays, expected) {
+		t.Errorf("Expected delays %v, got %v", expected, delays)
+	}
+}
+
+func TestWaitForDevice(t *testing.T) {
+	// Given
+	defer func(interval time.Duration) { devicePollInterval = interval }(devicePollInterval)
+	devicePollInterval = time.Millisecond
+	dir := t.TempDir()
+	device := filepath.Join(dir, "ttyUSB1")
+	stable := filepath.Join(dir, "usb-meter-if00")
+	if err := os.Symlink(device, stable); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		os.WriteFile(device, nil, 0644)
+	}()
+
+	// When
+	path := waitForDevice("Test", stable)
+
+	// Then
+	if path != device {
+		t.Errorf("Expected %s, got %s", device, path)
+	}
+}
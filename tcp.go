@@ -0,0 +1,52 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+const SocketScheme = "tcp://"
+
+// dialSocket connects to a raw SML byte stream, as exposed by ser2net or IR-to-WiFi adapters,
+// and returns a blocking file handle of the connection to be passed to libsml.
+func dialSocket(address string) (*os.File, error) {
+	dialer := net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	conn, err := dialer.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	// File() hands out a duplicate of the connection's descriptor
+	defer conn.Close()
+	return conn.(*net.TCPConn).File()
+}
+
+// listenToSocket is blocking forever, handing each connection to listen and
+// reconnecting with backoff whenever the connection fails or drops
+func listenToSocket(address string, listen func(file *os.File) int) {
+	supervise("Connection to "+address, newBackoff(time.Second, 2*time.Minute), func() (*os.File, error) {
+		fmt.Printf("Connect to %s\n", address)
+		return dialSocket(address)
+	}, listen)
+}
@@ -0,0 +1,63 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestDialSocket(t *testing.T) {
+	// Given
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte{0x1b, 0x1b, 0x1b, 0x1b})
+		conn.Close()
+	}()
+
+	// When
+	file, err := dialSocket(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	// Then
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 4 || data[0] != 0x1b {
+		t.Errorf("Unexpected data %v", data)
+	}
+}
+
+func TestDialSocketFailure(t *testing.T) {
+	if _, err := dialSocket("127.0.0.1:1"); err == nil {
+		t.Error()
+	}
+}
@@ -0,0 +1,209 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+)
+
+// quarantined readings are appended to files rotated by size and age, keeping that many
+var quarantineMaxSize int64 = 1024 * 1024
+var quarantineMaxAge = 7 * 24 * time.Hour
+var quarantineFiles = 4
+
+type plausibilityRule struct {
+	filter identFilter
+	// counters must not go backwards
+	monotonic bool
+	// max change per hour, e.g. the max power in W of a counter in Wh
+	maxRate float64
+	// range of plausible values
+	min, max float64
+	// readings keep being rejected until they were implausible for that long while plausible among each other,
+	// e.g. after the meter got replaced
+	rebase time.Duration
+}
+
+// plausibilityRules are checked in order, the first one matching a numeric measurement applies
+type plausibilityRules []plausibilityRule
+
+var _plausibilityRules plausibilityRules
+
+func selectPlausibilityRules(config map[string]string) plausibilityRules {
+	rules, err := parsePlausibilityRules(config[Plausibility])
+	if err != nil {
+		printHelpAndExit(fmt.Sprintf("Illegal plausibility rules: %s\n", err))
+	}
+	return rules
+}
+
+// parsePlausibilityRules parses rules like "1.8.0,2.8.0 monotonic max_rate=50000; 16.7.0 min=-30000 max=30000"
+func parsePlausibilityRules(config string) (plausibilityRules, error) {
+	rules, err := parseRules(config)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed := plausibilityRules{}
+	for _, r := range rules {
+		rule := plausibilityRule{filter: r.filter, min: math.Inf(-1), max: math.Inf(1), rebase: 15 * time.Minute}
+		for key, value := range r.options {
+			switch key {
+			case "monotonic":
+				rule.monotonic, err = strconv.ParseBool(value)
+			case "max_rate":
+				rule.maxRate, err = strconv.ParseFloat(value, 64)
+				if err == nil && rule.maxRate <= 0 {
+					err = fmt.Errorf("not positive")
+				}
+			case "min":
+				rule.min, err = strconv.ParseFloat(value, 64)
+			case "max":
+				rule.max, err = strconv.ParseFloat(value, 64)
+			case "rebase":
+				rule.rebase, err = time.ParseDuration(value)
+				if err == nil && rule.rebase <= 0 {
+					err = fmt.Errorf("not positive")
+				}
+			default:
+				return nil, fmt.Errorf("unknown option '%s' of rule %s, expected monotonic, max_rate, min, max or rebase", key, r.filter)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("illegal %s %s of rule %s: %s", key, value, r.filter, err)
+			}
+		}
+		if rule.min > rule.max {
+			return nil, fmt.Errorf("min of rule %s is greater than its max", r.filter)
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
+
+func (r plausibilityRules) ruleOf(measure *Measurement) *plausibilityRule {
+	if measure.Type != NumberValue {
+		return nil
+	}
+	for i := range r {
+		if r[i].filter.matches(measure) {
+			return &r[i]
+		}
+	}
+	return nil
+}
+
+// check returns why the reading is implausible compared to the previously accepted one, empty if it's plausible
+func (r *plausibilityRule) check(previous *Measurement, measure *Measurement) string {
+	if measure.Value < r.min || measure.Value > r.max {
+		return fmt.Sprintf("value %f out of range [%f, %f]", measure.Value, r.min, r.max)
+	}
+	if previous == nil {
+		return ""
+	}
+	if r.monotonic && measure.Value < previous.Value {
+		return fmt.Sprintf("counter went back from %f to %f", previous.Value, measure.Value)
+	}
+	if elapsed := measure.Time.Sub(previous.Time).Hours(); r.maxRate > 0 && elapsed > 0 {
+		if rate := math.Abs(measure.Value-previous.Value) / elapsed; rate > r.maxRate {
+			return fmt.Sprintf("change from %f to %f is %f per hour, more than %f", previous.Value, measure.Value, rate, r.maxRate)
+		}
+	}
+	return ""
+}
+
+// validator rejects implausible readings, passing them to quarantine with the reason
+type validator struct {
+	rules      plausibilityRules
+	quarantine func(measure Measurement, reason string)
+	// latest plausible reading per measurement
+	accepted map[string]Measurement
+	// consecutively rejected readings agreeing with each other per measurement
+	rejected map[string]rejection
+}
+
+type rejection struct {
+	since  time.Time
+	latest Measurement
+}
+
+func newValidator(rules plausibilityRules, quarantine func(measure Measurement, reason string)) *validator {
+	return &validator{
+		rules:      rules,
+		quarantine: quarantine,
+		accepted:   map[string]Measurement{},
+		rejected:   map[string]rejection{},
+	}
+}
+
+// validate tells whether the reading is plausible
+func (v *validator) validate(measure Measurement) bool {
+	rule := v.rules.ruleOf(&measure)
+	if rule == nil {
+		return true
+	}
+
+	key := measure.key()
+	var previous *Measurement
+	if accepted, ok := v.accepted[key]; ok {
+		previous = &accepted
+	}
+
+	reason := rule.check(previous, &measure)
+	if reason != "" && previous != nil && rule.check(nil, &measure) == "" {
+		// consistently differing readings are taken as the new normal after a while, like of a replaced meter,
+		// as long as they're plausible among each other and not just garbage
+		rejected, ok := v.rejected[key]
+		if !ok || rule.check(&rejected.latest, &measure) != "" {
+			rejected.since = measure.Time
+		} else if measure.Time.Sub(rejected.since) >= rule.rebase {
+			log.Printf("Accepting %s of %s as new baseline after being implausible since %s\n", measure.Ident, measure.Device, rejected.since.Format(time.RFC3339))
+			reason = ""
+		}
+		rejected.latest = measure
+		v.rejected[key] = rejected
+	}
+	if reason != "" {
+		v.quarantine(measure, reason)
+		return false
+	}
+
+	delete(v.rejected, key)
+	v.accepted[key] = measure
+	return true
+}
+
+// quarantineTo returns the quarantine logging rejected readings and appending them with their reason as JSON lines to the files
+func quarantineTo(files *rotatingFiles) func(measure Measurement, reason string) {
+	return func(measure Measurement, reason string) {
+		log.Printf("Quarantined %s of %s: %s\n", measure.Ident, measure.Device, reason)
+		entry, err := json.Marshal(struct {
+			Reason      string
+			Measurement Measurement
+		}{reason, measure})
+		if err != nil {
+			log.Printf("Failed to serialize quarantined measurement: %s\n", err)
+			return
+		}
+		files.write(append(entry, '\n'))
+	}
+}
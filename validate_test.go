@@ -0,0 +1,213 @@
+/*
+SaMLer - Smart Meter data colletor at the edge
+Copyright (C) 2025  Florian Heubeck
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePlausibilityRules(t *testing.T) {
+	// When
+	rules, err := parsePlausibilityRules("1.8.0,2.8.0 monotonic max_rate=50000 rebase=1h; 16.7.0 min=-30000 max=30000")
+
+	// Then
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := rules.ruleOf(&Measurement{Ident: "2.8.0", Type: NumberValue})
+	if counter == nil || !counter.monotonic || counter.maxRate != 50000 || counter.rebase != time.Hour || !math.IsInf(counter.max, 1) {
+		t.Errorf("Unexpected counter rule %+v", counter)
+	}
+	power := rules.ruleOf(&Measurement{Ident: "16.7.0", Type: NumberValue})
+	if power == nil || power.monotonic || power.min != -30000 || power.max != 30000 || power.rebase != 15*time.Minute {
+		t.Errorf("Unexpected power rule %+v", power)
+	}
+	if rules.ruleOf(&Measurement{Ident: "16.7.0", Type: StringValue}) != nil {
+		t.Error("Expected text values not to be checked")
+	}
+}
+
+func TestParseInvalidPlausibilityRules(t *testing.T) {
+	for _, raw := range []string{"1.8.0 monotonic=sometimes", "1.8.0 max_rate=0", "1.8.0 min=low", "1.8.0 min=10 max=5", "1.8.0 rebase=-1m", "1.8.0 smooth"} {
+		if _, err := parsePlausibilityRules(raw); err == nil {
+			t.Errorf("Expected '%s' to be invalid", raw)
+		}
+	}
+}
+
+type quarantined struct {
+	measurements []Measurement
+	reasons      []string
+}
+
+func (q *quarantined) add(measure Measurement, reason string) {
+	q.measurements = append(q.measurements, measure)
+	q.reasons = append(q.reasons, reason)
+}
+
+func TestValidateCounter(t *testing.T) {
+	// Given
+	rules, _ := parsePlausibilityRules("1.8.0 monotonic max_rate=50000")
+	quarantine := &quarantined{}
+	validator := newValidator(rules, quarantine.add)
+	start := time.Now()
+	counter := func(offset time.Duration, value float64) Measurement {
+		return Measurement{Ident: "1.8.0", Unit: "Wh", Type: NumberValue, Value: value, Time: start.Add(offset)}
+	}
+
+	// When && Then
+	for i, e := range []struct {
+		measure  Measurement
+		expected bool
+	}{
+		{counter(0, 100000), true},
+		{counter(time.Second, 100010), true},
+		{counter(2*time.Second, 3100010), false},
+		{counter(3*time.Second, 100005), false},
+		{counter(4*time.Second, 100020), true},
+		{counter(time.Hour, 140000), true},
+	} {
+		if validator.validate(e.measure) != e.expected {
+			t.Errorf("Expected #%d to be valid: %t", i, e.expected)
+		}
+	}
+	if len(quarantine.reasons) != 2 || !strings.Contains(quarantine.reasons[0], "per hour") || !strings.Contains(quarantine.reasons[1], "went back") {
+		t.Errorf("Unexpected quarantine %v", quarantine.reasons)
+	}
+	if quarantine.measurements[0].Value != 3100010 {
+		t.Errorf("Expected rejected reading in quarantine, got %+v", quarantine.measurements[0])
+	}
+}
+
+func TestValidateRange(t *testing.T) {
+	rules, _ := parsePlausibilityRules("16.7.0 min=-30000 max=30000")
+	validator := newValidator(rules, (&quarantined{}).add)
+	for value, expected := range map[float64]bool{-30000: true, 0: true, 30000: true, 30001: false, -1e9: false} {
+		if validator.validate(Measurement{Ident: "16.7.0", Type: NumberValue, Value: value, Time: time.Now()}) != expected {
+			t.Errorf("Expected %f to be valid: %t", value, expected)
+		}
+	}
+	if !validator.validate(Measurement{Ident: "1.8.0", Type: NumberValue, Value: 1e12, Time: time.Now()}) {
+		t.Error("Expected measurements without rule to be valid")
+	}
+}
+
+func TestValidateRebase(t *testing.T) {
+	// Given
+	rules, _ := parsePlausibilityRules("1.8.0 monotonic rebase=10m")
+	validator := newValidator(rules, (&quarantined{}).add)
+	start := time.Now()
+	counter := func(offset time.Duration, value float64) Measurement {
+		return Measurement{Ident: "1.8.0", Type: NumberValue, Value: value, Time: start.Add(offset)}
+	}
+	validator.validate(counter(0, 500000))
+
+	// When && Then
+	if validator.validate(counter(time.Minute, 10)) {
+		t.Error("Expected reset counter to be rejected first")
+	}
+	if validator.validate(counter(5*time.Minute, 20)) {
+		t.Error("Expected reset counter to be rejected within rebase")
+	}
+	if !validator.validate(counter(11*time.Minute, 30)) {
+		t.Error("Expected reset counter to be accepted after rebase")
+	}
+	if !validator.validate(counter(12*time.Minute, 40)) {
+		t.Error("Expected counter to be valid after rebase")
+	}
+}
+
+func TestValidateRebaseOnAgreeingReadingsOnly(t *testing.T) {
+	// Given
+	rules, _ := parsePlausibilityRules("1.8.0 monotonic max_rate=1000 rebase=10m")
+	validator := newValidator(rules, (&quarantined{}).add)
+	start := time.Now()
+	counter := func(offset time.Duration, value float64) Measurement {
+		return Measurement{Ident: "1.8.0", Type: NumberValue, Value: value, Time: start.Add(offset)}
+	}
+	validator.validate(counter(0, 500000))
+
+	// When && Then
+	for _, garbage := range []Measurement{counter(time.Minute, 10), counter(6*time.Minute, 5), counter(12*time.Minute, 6)} {
+		if validator.validate(garbage) {
+			t.Errorf("Expected %f to be rejected as the rejected readings disagree", garbage.Value)
+		}
+	}
+	if !validator.validate(counter(17*time.Minute, 7)) {
+		t.Error("Expected counter to be accepted after agreeing since rebase")
+	}
+}
+
+func TestQuarantineTo(t *testing.T) {
+	// Given
+	dir := t.TempDir()
+	files, _ := newRotatingFiles(dir, "quarantine", ".log", 1024, time.Hour, 2)
+	quarantine := quarantineTo(files)
+
+	// When
+	quarantine(Measurement{Device: "home", Ident: "1.8.0", Value: 1}, "first")
+	quarantine(Measurement{Device: "home", Ident: "1.8.0", Value: 2}, "second")
+	files.close()
+
+	// Then
+	logs, _ := filepath.Glob(filepath.Join(dir, "quarantine-*.log"))
+	if len(logs) != 1 {
+		t.Fatalf("Expected a single quarantine file, got %v", logs)
+	}
+	content, err := os.ReadFile(logs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(lines))
+	}
+	var entry struct {
+		Reason      string
+		Measurement Measurement
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil || entry.Reason != "second" || entry.Measurement.Value != 2 {
+		t.Errorf("Unexpected entry %s", lines[1])
+	}
+}
+
+func TestQuarantineRotates(t *testing.T) {
+	// Given
+	dir := t.TempDir()
+	files, _ := newRotatingFiles(dir, "quarantine", ".log", 100, time.Hour, 2)
+	quarantine := quarantineTo(files)
+
+	// When
+	for i := range 5 {
+		quarantine(Measurement{Device: "home", Ident: "1.8.0", Value: float64(i)}, "implausible")
+		// file names have millisecond resolution
+		time.Sleep(2 * time.Millisecond)
+	}
+	files.close()
+
+	// Then
+	if logs, _ := filepath.Glob(filepath.Join(dir, "quarantine-*.log")); len(logs) != 2 {
+		t.Errorf("Expected 2 quarantine files, got %v", logs)
+	}
+}